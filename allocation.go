@@ -20,6 +20,17 @@ func genHashFloat(visitorID string, vgID string) (float32, error) {
 	return float32(hashed % 100), nil
 }
 
+// getAllocationHash returns the hash used to allocate a variation of the variation group
+func getAllocationHash(visitorID string, decisionGroup string, vgID string) (float32, error) {
+	// Use decision group by default for decision hash, otherwise use visitor ID
+	decisionID := visitorID
+	if decisionGroup != "" {
+		decisionID = decisionGroup
+	}
+
+	return genHashFloat(decisionID, vgID)
+}
+
 // getRandomAllocation returns a random allocation for a variationGroup
 func getRandomAllocation(visitorID string, decisionGroup string, variationGroup *VariationGroup, isCumulativeAlloc bool) (*Variation, error) {
 	// performance shortcut to prevent hash generation
@@ -27,13 +38,7 @@ func getRandomAllocation(visitorID string, decisionGroup string, variationGroup
 		return variationGroup.Variations[0], nil
 	}
 
-	// Use decision group by default for decision hash, otherwise use visitor ID
-	decisionID := visitorID
-	if decisionGroup != "" {
-		decisionID = decisionGroup
-	}
-
-	z, err := genHashFloat(decisionID, variationGroup.ID)
+	z, err := getAllocationHash(visitorID, decisionGroup, variationGroup.ID)
 	if err != nil {
 		return nil, err
 	}
@@ -70,3 +75,21 @@ func isVisitorInBucket(visitorID string, campaign *Campaign) (bool, error) {
 	}
 	return false, nil
 }
+
+func isVisitorInLayerSlices(visitorID string, cl *campaignLayer) (bool, error) {
+	if cl == nil {
+		return false, errors.New("campaign layer is null")
+	}
+
+	z, err := genHashFloat(visitorID, cl.salt)
+	if err != nil {
+		return false, err
+	}
+
+	for _, s := range cl.slices {
+		if z >= float32(s.Start) && z < float32(s.End) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
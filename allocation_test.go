@@ -201,3 +201,24 @@ func TestIsVisitorInBucket(t *testing.T) {
 	assert.Nil(t, err)
 	assert.False(t, is)
 }
+
+func TestIsVisitorInLayerSlices(t *testing.T) {
+	_, err := isVisitorInLayerSlices("vid", nil)
+	assert.NotNil(t, err)
+
+	z, _ := genHashFloat("vid", "salt")
+	cl := &campaignLayer{
+		layerID: "l1",
+		salt:    "salt",
+		slices:  []*LayerSlice{{CampaignID: "c1", Start: float64(z), End: float64(z) + 1}},
+	}
+	isIn, err := isVisitorInLayerSlices("vid", cl)
+	assert.Nil(t, err)
+	assert.True(t, isIn)
+
+	cl.slices[0].Start = float64(z) + 1
+	cl.slices[0].End = float64(z) + 2
+	isIn, err = isVisitorInLayerSlices("vid", cl)
+	assert.Nil(t, err)
+	assert.False(t, isIn)
+}
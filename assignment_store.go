@@ -0,0 +1,163 @@
+package decision
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// OperationNotSupportedError is returned by assignment stores that do not support an operation
+var OperationNotSupportedError = errors.New("operation not supported by assignment store")
+
+// StoreClosedError is returned by assignment stores that have been closed
+var StoreClosedError = errors.New("assignment store closed")
+
+// VersionConflictError is returned by compare and save operations when the stored assignments version has changed
+var VersionConflictError = errors.New("assignments version conflict")
+
+// AssignmentStore loads and saves the visitors assignments, by environment ID and visitor ID, anonymous ID or decision group.
+// Set it in the decision handlers to use it instead of the cache handlers
+type AssignmentStore interface {
+	// Get returns the assignments of the ID, or nil if there is none
+	Get(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error)
+	// Save stores the assignments of the ID
+	Save(ctx context.Context, environmentID string, id string, assignments *VisitorAssignments) error
+	// Delete removes the assignments of the ID
+	Delete(ctx context.Context, environmentID string, id string) error
+	// BatchGet returns the assignments of the IDs, by ID. IDs without assignments are omitted
+	BatchGet(ctx context.Context, environmentID string, ids []string) (map[string]*VisitorAssignments, error)
+	// Close releases the store resources
+	Close() error
+}
+
+// CompareAndSwapStore is implemented by assignment stores supporting optimistic concurrency.
+// The decision uses it instead of Save when available
+type CompareAndSwapStore interface {
+	// CompareAndSave stores the assignments of the ID only if the stored version equals the assignments version,
+	// and increments the stored version. It returns VersionConflictError otherwise
+	CompareAndSave(ctx context.Context, environmentID string, id string, assignments *VisitorAssignments) error
+}
+
+// ScanStore is implemented by assignment stores able to list the IDs they store.
+// Exports and migrations use it to process all the IDs of an environment when no IDs are given
+type ScanStore interface {
+	// IDs returns the sorted IDs of the environment with assignments that are not expired
+	IDs(ctx context.Context, environmentID string) ([]string, error)
+}
+
+// storeIDs returns the given IDs, or all the IDs of the environment if they are nil and the assignment store can list them
+func (h DecisionHandlers) storeIDs(ctx context.Context, environmentID string, ids []string) ([]string, error) {
+	if ids != nil {
+		return ids, nil
+	}
+	scanStore, ok := h.AssignmentStore.(ScanStore)
+	if !ok {
+		return nil, OperationNotSupportedError
+	}
+	return scanStore.IDs(ctx, environmentID)
+}
+
+// handlersAssignmentStore adapts the cache handlers into an assignment store
+type handlersAssignmentStore struct {
+	getCache  func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error)
+	saveCache func(ctx context.Context, environmentID string, id string, assignment *VisitorAssignments) error
+}
+
+// NewHandlersAssignmentStore creates an assignment store from the GetCache and SaveCache decision handlers.
+// Delete is not supported and returns OperationNotSupportedError
+func NewHandlersAssignmentStore(handlers DecisionHandlers) AssignmentStore {
+	return &handlersAssignmentStore{
+		getCache:  handlers.GetCache,
+		saveCache: handlers.SaveCache,
+	}
+}
+
+func (s *handlersAssignmentStore) Get(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+	if s.getCache == nil {
+		return nil, OperationNotSupportedError
+	}
+	return s.getCache(ctx, environmentID, id)
+}
+
+func (s *handlersAssignmentStore) Save(ctx context.Context, environmentID string, id string, assignments *VisitorAssignments) error {
+	if s.saveCache == nil {
+		return OperationNotSupportedError
+	}
+	return s.saveCache(ctx, environmentID, id, assignments)
+}
+
+func (s *handlersAssignmentStore) Delete(ctx context.Context, environmentID string, id string) error {
+	return OperationNotSupportedError
+}
+
+// BatchGet gets the assignments of all the IDs in parallel
+func (s *handlersAssignmentStore) BatchGet(ctx context.Context, environmentID string, ids []string) (map[string]*VisitorAssignments, error) {
+	if s.getCache == nil {
+		return nil, OperationNotSupportedError
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var errs []error
+	results := map[string]*VisitorAssignments{}
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			assignments, err := s.getCache(ctx, environmentID, id)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			if assignments != nil {
+				results[id] = assignments
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	return results, errors.Join(errs...)
+}
+
+func (s *handlersAssignmentStore) Close() error {
+	return nil
+}
+
+// withAssignmentStore returns the handlers using the assignment store as cache handlers, if it is set
+func (h DecisionHandlers) withAssignmentStore() DecisionHandlers {
+	if h.AssignmentStore == nil {
+		return h
+	}
+	h.GetCache = h.AssignmentStore.Get
+	h.SaveCache = h.AssignmentStore.Save
+	h.CompareAndSaveCache = nil
+	if casStore, ok := h.AssignmentStore.(CompareAndSwapStore); ok {
+		h.CompareAndSaveCache = casStore.CompareAndSave
+	}
+	return h
+}
+
+// withAssignmentStore returns the batch handlers using the assignment store as batch cache handlers, if it is set
+func (h BatchDecisionHandlers) withAssignmentStore() BatchDecisionHandlers {
+	if h.AssignmentStore == nil {
+		return h
+	}
+	store := h.AssignmentStore
+	h.BatchGetCache = store.BatchGet
+	h.BatchSaveCache = func(ctx context.Context, environmentID string, assignments map[string]*VisitorAssignments) error {
+		var errs []error
+		for id, a := range assignments {
+			if err := store.Save(ctx, environmentID, id, a); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	}
+	h.CompareAndSaveCache = nil
+	if casStore, ok := store.(CompareAndSwapStore); ok {
+		h.CompareAndSaveCache = casStore.CompareAndSave
+	}
+	return h
+}
@@ -0,0 +1,472 @@
+package decision
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spaolacci/murmur3"
+)
+
+const (
+	defaultFileStoreShards = 256
+	fileStoreExtension     = ".assignments"
+	fileStoreTempPrefix    = ".tmp-"
+	fileStoreLockName      = ".lock"
+	// fileStoreMaxNameLength is the maximum length of the encoded file names, below the 255 bytes limit of most filesystems.
+	// Longer names are replaced by a prefix and a hash of the ID
+	fileStoreMaxNameLength = 200
+	// fileStoreTempMaxAge is the age after which compaction removes the temporary files left by interrupted writes
+	fileStoreTempMaxAge = time.Hour
+)
+
+// EmptyEnvironmentIDError is returned by the filesystem assignment store when saving assignments without environment ID,
+// whose shard directories would be mixed with the environment directories
+var EmptyEnvironmentIDError = errors.New("empty environment ID")
+
+// FileStoreOptions configures the filesystem assignment store
+type FileStoreOptions struct {
+	// Codec encodes the assignments files. Defaults to the JSON codec
+	Codec AssignmentsCodec
+	// Shards is the number of directories the IDs of an environment are spread across. Defaults to 256
+	Shards int
+}
+
+// CompactionStats are the results of a filesystem assignment store compaction
+type CompactionStats struct {
+	// Files is the number of assignments files read
+	Files int
+	// Removed is the number of expired or empty assignments files removed
+	Removed int
+	// TempFiles is the number of temporary files left by interrupted writes that were removed
+	TempFiles int
+	// Invalid is the number of assignments files that could not be decoded, which are kept
+	Invalid int
+}
+
+// FileAssignmentStore is an assignment store persisting the visitors assignments in a local directory,
+// so that they survive process restarts.
+// Each ID is stored in its own file, in a shard directory of its environment directory.
+// The file of an ID is named after its encoding, or after its hash if the encoding is too long, the file then embedding the full ID.
+// Files are written atomically and writes are serialized with a lock file by shard, so that several processes can share the directory
+type FileAssignmentStore struct {
+	dir     string
+	options FileStoreOptions
+
+	// locks serialize the writes of the store by shard, the lock files serializing them between processes
+	locks  []sync.Mutex
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewFileAssignmentStore creates a filesystem assignment store in the directory, creating it if needed
+func NewFileAssignmentStore(dir string, options FileStoreOptions) (*FileAssignmentStore, error) {
+	if options.Codec == nil {
+		options.Codec = NewJSONCodec()
+	}
+	if options.Shards <= 0 {
+		options.Shards = defaultFileStoreShards
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &FileAssignmentStore{
+		dir:     dir,
+		options: options,
+		locks:   make([]sync.Mutex, options.Shards),
+	}, nil
+}
+
+// Get returns the assignments of the ID, or nil if there is none or if they are expired
+func (s *FileAssignmentStore) Get(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, StoreClosedError
+	}
+
+	storedID, assignments, err := s.read(s.path(environmentID, id))
+	if err != nil || storedID != id || assignments.isExpired(time.Now()) {
+		return nil, err
+	}
+	return assignments, nil
+}
+
+// Save writes the assignments of the ID, incrementing the stored version.
+// It returns EmptyEnvironmentIDError if the environment ID is empty
+func (s *FileAssignmentStore) Save(ctx context.Context, environmentID string, id string, assignments *VisitorAssignments) error {
+	return s.write(environmentID, id, func(stored *VisitorAssignments) error {
+		return nil
+	}, assignments)
+}
+
+// CompareAndSave writes the assignments of the ID if the stored version equals the assignments version,
+// incrementing it. It returns VersionConflictError otherwise
+func (s *FileAssignmentStore) CompareAndSave(ctx context.Context, environmentID string, id string, assignments *VisitorAssignments) error {
+	return s.write(environmentID, id, func(stored *VisitorAssignments) error {
+		var version int64
+		if stored != nil {
+			version = stored.Version
+		}
+		if assignments == nil || version != assignments.Version {
+			return VersionConflictError
+		}
+		return nil
+	}, assignments)
+}
+
+// Delete removes the assignments file of the ID
+func (s *FileAssignmentStore) Delete(ctx context.Context, environmentID string, id string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return StoreClosedError
+	}
+
+	unlock, err := s.lock(environmentID, s.shard(id))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := os.Remove(s.path(environmentID, id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// BatchGet returns the assignments of the IDs, by ID. IDs without assignments are omitted
+func (s *FileAssignmentStore) BatchGet(ctx context.Context, environmentID string, ids []string) (map[string]*VisitorAssignments, error) {
+	results := map[string]*VisitorAssignments{}
+	var errs []error
+	for _, id := range ids {
+		assignments, err := s.Get(ctx, environmentID, id)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if assignments != nil {
+			results[id] = assignments
+		}
+	}
+	return results, errors.Join(errs...)
+}
+
+// IDs returns the sorted IDs of the environment with assignments that are not expired, reading the files of all its shards.
+// Files that cannot be decoded are skipped
+func (s *FileAssignmentStore) IDs(ctx context.Context, environmentID string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, StoreClosedError
+	}
+
+	files, err := filepath.Glob(filepath.Join(s.dir, encodeFileName(environmentID), "*", "*"+fileStoreExtension))
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	now := time.Now()
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		id, assignments, err := s.read(file)
+		if errors.Is(err, InvalidPayloadError) {
+			logger.Logf(WarnLevel, "skipping invalid assignments file %s: %v", file, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if assignments != nil && !assignments.isExpired(now) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Close closes the store. The files are kept, and the store cannot be used anymore
+func (s *FileAssignmentStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	return nil
+}
+
+// Compact removes the expired and empty assignments files and the temporary files left by interrupted writes.
+// Files that cannot be decoded are kept and counted as invalid. Directories and lock files are kept,
+// since other processes may be waiting for the locks
+func (s *FileAssignmentStore) Compact(ctx context.Context) (CompactionStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := CompactionStats{}
+	if s.closed {
+		return stats, StoreClosedError
+	}
+
+	envDirs, err := os.ReadDir(s.dir)
+	if err != nil {
+		return stats, err
+	}
+	now := time.Now()
+	for _, envDir := range envDirs {
+		if !envDir.IsDir() {
+			continue
+		}
+		envPath := filepath.Join(s.dir, envDir.Name())
+		shardDirs, err := os.ReadDir(envPath)
+		if err != nil {
+			return stats, err
+		}
+		for _, shardDir := range shardDirs {
+			if err := ctx.Err(); err != nil {
+				return stats, err
+			}
+			if !shardDir.IsDir() {
+				continue
+			}
+			if err := s.compactShard(envDir.Name(), shardDir.Name(), now, &stats); err != nil {
+				return stats, err
+			}
+		}
+	}
+	return stats, nil
+}
+
+// compactShard compacts the files of a shard directory, holding its lock
+func (s *FileAssignmentStore) compactShard(envDir string, shardDir string, now time.Time, stats *CompactionStats) error {
+	dir := filepath.Join(s.dir, envDir, shardDir)
+	var shard int
+	if _, err := fmt.Sscanf(shardDir, "%x", &shard); err != nil || shard >= len(s.locks) {
+		// The directory has been created with another number of shards, and is only locked between processes
+		shard = -1
+	}
+	unlock, err := s.lockDir(dir, shard)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		path := filepath.Join(dir, name)
+		switch {
+		case strings.HasPrefix(name, fileStoreTempPrefix):
+			info, err := file.Info()
+			if err == nil && now.Sub(info.ModTime()) > fileStoreTempMaxAge {
+				if err := os.Remove(path); err == nil {
+					stats.TempFiles++
+				}
+			}
+		case strings.HasSuffix(name, fileStoreExtension):
+			stats.Files++
+			_, assignments, err := s.read(path)
+			if err != nil {
+				stats.Invalid++
+				continue
+			}
+			if assignments == nil || len(assignments.Assignments) == 0 || assignments.isExpired(now) {
+				if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+					return err
+				}
+				stats.Removed++
+			}
+		}
+	}
+	return nil
+}
+
+// write writes the assignments of the ID atomically, holding the shard lock,
+// if check accepts the stored assignments. The stored version is incremented
+func (s *FileAssignmentStore) write(environmentID string, id string, check func(stored *VisitorAssignments) error, assignments *VisitorAssignments) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return StoreClosedError
+	}
+	if environmentID == "" {
+		return EmptyEnvironmentIDError
+	}
+
+	unlock, err := s.lock(environmentID, s.shard(id))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	path := s.path(environmentID, id)
+	storedID, stored, err := s.read(path)
+	if err != nil && !errors.Is(err, InvalidPayloadError) {
+		return err
+	}
+	if storedID != id || stored.isExpired(time.Now()) {
+		stored = nil
+	}
+	if err := check(stored); err != nil {
+		return err
+	}
+
+	toStore := assignments.clone()
+	if toStore == nil {
+		toStore = &VisitorAssignments{}
+	}
+	toStore.Version = 1
+	if stored != nil {
+		toStore.Version = stored.Version + 1
+	}
+	data, err := s.options.Codec.Encode(toStore)
+	if err != nil {
+		return err
+	}
+	if isHashedFileName(filepath.Base(path)) {
+		data = append(binary.AppendUvarint(nil, uint64(len(id))), append([]byte(id), data...)...)
+	}
+	return writeFileAtomic(path, data)
+}
+
+// read reads and decodes the assignments file, returning nil if it does not exist.
+// It returns the ID of the file, decoded from its name or read from the file if the name is hashed
+func (s *FileAssignmentStore) read(path string) (string, *VisitorAssignments, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	name := strings.TrimSuffix(filepath.Base(path), fileStoreExtension)
+	var id string
+	if isHashedFileName(name) {
+		n, size := binary.Uvarint(data)
+		if size <= 0 || uint64(len(data)-size) < n {
+			return "", nil, fmt.Errorf("%w: invalid ID header", InvalidPayloadError)
+		}
+		id = string(data[size : size+int(n)])
+		data = data[size+int(n):]
+	} else {
+		decoded, err := base64.RawURLEncoding.DecodeString(name)
+		if err != nil {
+			return "", nil, fmt.Errorf("%w: invalid file name", InvalidPayloadError)
+		}
+		id = string(decoded)
+	}
+
+	assignments, err := s.options.Codec.Decode(data)
+	if err != nil {
+		return "", nil, err
+	}
+	return id, assignments, nil
+}
+
+// lock locks the shard of the environment in the process and between processes, creating its directory if needed
+func (s *FileAssignmentStore) lock(environmentID string, shard int) (func(), error) {
+	dir := s.shardDir(environmentID, shard)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return s.lockDir(dir, shard)
+}
+
+// lockDir locks the shard directory in the process, if the shard is known, and between processes with its lock file
+func (s *FileAssignmentStore) lockDir(dir string, shard int) (func(), error) {
+	if shard >= 0 {
+		s.locks[shard].Lock()
+	}
+	unlockFile, err := lockFile(filepath.Join(dir, fileStoreLockName))
+	if err != nil {
+		if shard >= 0 {
+			s.locks[shard].Unlock()
+		}
+		return nil, err
+	}
+	return func() {
+		unlockFile()
+		if shard >= 0 {
+			s.locks[shard].Unlock()
+		}
+	}, nil
+}
+
+// shard returns the shard of the ID
+func (s *FileAssignmentStore) shard(id string) int {
+	hash := murmur3.New32()
+	_, _ = hash.Write([]byte(id))
+	return int(hash.Sum32() % uint32(s.options.Shards))
+}
+
+func (s *FileAssignmentStore) shardDir(environmentID string, shard int) string {
+	return filepath.Join(s.dir, encodeFileName(environmentID), fmt.Sprintf("%02x", shard))
+}
+
+// path returns the assignments file of the ID
+func (s *FileAssignmentStore) path(environmentID string, id string) string {
+	return filepath.Join(s.shardDir(environmentID, s.shard(id)), encodeFileName(id)+fileStoreExtension)
+}
+
+// encodeFileName encodes the ID into a file name that is valid on every filesystem and cannot escape the store directory.
+// If the encoding is longer than fileStoreMaxNameLength, the name is a prefix of the encoding and the SHA-256 hash of the ID,
+// separated by a dot that the encoding never contains
+func encodeFileName(id string) string {
+	name := base64.RawURLEncoding.EncodeToString([]byte(id))
+	if len(name) <= fileStoreMaxNameLength {
+		return name
+	}
+	hash := sha256.Sum256([]byte(id))
+	hashName := hex.EncodeToString(hash[:])
+	return name[:fileStoreMaxNameLength-len(hashName)-1] + "." + hashName
+}
+
+// isHashedFileName returns true if the file name is the hashed name of a long ID
+func isHashedFileName(name string) bool {
+	return strings.Contains(strings.TrimSuffix(name, fileStoreExtension), ".")
+}
+
+// writeFileAtomic writes the data to a temporary file of the directory and renames it to the path,
+// so that readers see either the previous or the new file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), fileStoreTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+	}
+	return err
+}
@@ -0,0 +1,256 @@
+package decision
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileAssignmentStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := NewFileAssignmentStore(dir, FileStoreOptions{Shards: 4})
+	assert.Nil(t, err)
+
+	a, err := store.Get(ctx, "env", "vis1")
+	assert.Nil(t, err)
+	assert.Nil(t, a)
+
+	assignments := &VisitorAssignments{
+		Timestamp:   1,
+		Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1", Activated: true}},
+	}
+	assert.Nil(t, store.Save(ctx, "env", "vis1", assignments))
+	a, err = store.Get(ctx, "env", "vis1")
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", a.Assignments["vg1"].VariationID)
+	assert.True(t, a.Assignments["vg1"].Activated)
+	assert.Equal(t, int64(1), a.Version)
+
+	// IDs are stored by shard, and cannot escape the store directory
+	assert.Nil(t, store.Save(ctx, "env", "../../vis2", &VisitorAssignments{}))
+	files, _ := filepath.Glob(filepath.Join(dir, "*", "*", "*"+fileStoreExtension))
+	assert.Len(t, files, 2)
+	for _, f := range files {
+		shard := filepath.Base(filepath.Dir(f))
+		assert.Contains(t, []string{"00", "01", "02", "03"}, shard)
+	}
+	tmpFiles, _ := filepath.Glob(filepath.Join(dir, "*", "*", fileStoreTempPrefix+"*"))
+	assert.Len(t, tmpFiles, 0)
+
+	// Environments should be isolated
+	a, _ = store.Get(ctx, "env2", "vis1")
+	assert.Nil(t, a)
+
+	results, err := store.BatchGet(ctx, "env", []string{"vis1", "../../vis2", "vis3"})
+	assert.Nil(t, err)
+	assert.Len(t, results, 2)
+
+	// Assignments should survive a store restart
+	assert.Nil(t, store.Close())
+	_, err = store.Get(ctx, "env", "vis1")
+	assert.Equal(t, StoreClosedError, err)
+	assert.Equal(t, StoreClosedError, store.Save(ctx, "env", "vis1", nil))
+	assert.Equal(t, StoreClosedError, store.Delete(ctx, "env", "vis1"))
+
+	store, _ = NewFileAssignmentStore(dir, FileStoreOptions{Shards: 4})
+	a, _ = store.Get(ctx, "env", "vis1")
+	assert.Equal(t, "v1", a.Assignments["vg1"].VariationID)
+
+	assert.Nil(t, store.Delete(ctx, "env", "vis1"))
+	assert.Nil(t, store.Delete(ctx, "env", "unknown"))
+	a, _ = store.Get(ctx, "env", "vis1")
+	assert.Nil(t, a)
+
+	// Expired assignments are not returned
+	assert.Nil(t, store.Save(ctx, "env", "vis1", &VisitorAssignments{Timestamp: time.Now().Add(-2 * time.Hour).Unix(), TTL: time.Hour}))
+	a, _ = store.Get(ctx, "env", "vis1")
+	assert.Nil(t, a)
+}
+
+func TestFileAssignmentStoreLongIDs(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, _ := NewFileAssignmentStore(dir, FileStoreOptions{Shards: 1})
+
+	// Long IDs sharing the prefix of their file name are stored in distinct files
+	long1 := strings.Repeat("x", 1000) + "1"
+	long2 := strings.Repeat("x", 1000) + "2"
+	longEnv := strings.Repeat("e", 300)
+	assert.Nil(t, store.Save(ctx, longEnv, long1, &VisitorAssignments{Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1"}}}))
+	assert.Nil(t, store.CompareAndSave(ctx, longEnv, long2, &VisitorAssignments{Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v2"}}}))
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*", "*", "*"+fileStoreExtension))
+	assert.Len(t, files, 2)
+	for _, f := range files {
+		assert.LessOrEqual(t, len(filepath.Base(f)), 255)
+		assert.LessOrEqual(t, len(filepath.Base(filepath.Dir(filepath.Dir(f)))), 255)
+		assert.True(t, isHashedFileName(filepath.Base(f)))
+	}
+
+	a, err := store.Get(ctx, longEnv, long1)
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", a.Assignments["vg1"].VariationID)
+	a, _ = store.Get(ctx, longEnv, long2)
+	assert.Equal(t, "v2", a.Assignments["vg1"].VariationID)
+
+	// The full ID is kept in the file
+	id, _, err := store.read(store.path(longEnv, long1))
+	assert.Nil(t, err)
+	assert.Equal(t, long1, id)
+
+	stats, err := store.Compact(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, CompactionStats{Files: 2}, stats)
+
+	assert.Nil(t, store.Delete(ctx, longEnv, long1))
+	a, _ = store.Get(ctx, longEnv, long1)
+	assert.Nil(t, a)
+	assert.False(t, isHashedFileName(encodeFileName("vis1")+fileStoreExtension))
+}
+
+func TestFileAssignmentStoreIDs(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, _ := NewFileAssignmentStore(dir, FileStoreOptions{Shards: 4})
+
+	long := strings.Repeat("x", 1000)
+	for _, id := range []string{"vis2", "vis1", long} {
+		assert.Nil(t, store.Save(ctx, "env", id, &VisitorAssignments{}))
+	}
+	assert.Nil(t, store.Save(ctx, "env2", "vis3", &VisitorAssignments{}))
+	assert.Nil(t, store.Save(ctx, "env", "expired", &VisitorAssignments{Timestamp: time.Now().Add(-2 * time.Hour).Unix(), TTL: time.Hour}))
+	shardDir := filepath.Dir(store.path("env", "vis1"))
+	assert.Nil(t, os.WriteFile(filepath.Join(shardDir, "invalid"+fileStoreExtension), []byte("invalid"), 0o644))
+
+	ids, err := store.IDs(ctx, "env")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"vis1", "vis2", long}, ids)
+	ids, _ = store.IDs(ctx, "unknown")
+	assert.Len(t, ids, 0)
+
+	assert.Nil(t, store.Close())
+	_, err = store.IDs(ctx, "env")
+	assert.Equal(t, StoreClosedError, err)
+}
+
+func TestFileAssignmentStoreCompareAndSave(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, _ := NewFileAssignmentStore(dir, FileStoreOptions{Codec: NewProtobufCodec()})
+
+	assert.Nil(t, store.CompareAndSave(ctx, "env", "vis1", &VisitorAssignments{Timestamp: 1}))
+	assert.Equal(t, VersionConflictError, store.CompareAndSave(ctx, "env", "vis1", &VisitorAssignments{Timestamp: 2}))
+	assert.Nil(t, store.CompareAndSave(ctx, "env", "vis1", &VisitorAssignments{Timestamp: 2, Version: 1}))
+	a, _ := store.Get(ctx, "env", "vis1")
+	assert.Equal(t, int64(2), a.Timestamp)
+	assert.Equal(t, int64(2), a.Version)
+
+	// Stores sharing the directory, as several processes would, do not lose updates
+	other, _ := NewFileAssignmentStore(dir, FileStoreOptions{Codec: NewProtobufCodec()})
+	stores := []*FileAssignmentStore{store, other}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(s *FileAssignmentStore) {
+			defer wg.Done()
+			for {
+				a, err := s.Get(ctx, "env", "vis1")
+				assert.Nil(t, err)
+				a.Timestamp++
+				err = s.CompareAndSave(ctx, "env", "vis1", a)
+				if err != VersionConflictError {
+					assert.Nil(t, err)
+					return
+				}
+			}
+		}(stores[i%2])
+	}
+	wg.Wait()
+
+	a, _ = store.Get(ctx, "env", "vis1")
+	assert.Equal(t, int64(12), a.Timestamp)
+	assert.Equal(t, int64(12), a.Version)
+}
+
+func TestFileAssignmentStoreCompact(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, _ := NewFileAssignmentStore(dir, FileStoreOptions{Shards: 1})
+
+	assert.Nil(t, store.Save(ctx, "env", "vis1", &VisitorAssignments{Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1"}}}))
+	assert.Nil(t, store.Save(ctx, "env", "vis2", &VisitorAssignments{}))
+	assert.Nil(t, store.Save(ctx, "env", "vis3", &VisitorAssignments{
+		Timestamp:   time.Now().Add(-2 * time.Hour).Unix(),
+		TTL:         time.Hour,
+		Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1"}},
+	}))
+
+	shardDir := filepath.Dir(store.path("env", "vis1"))
+	assert.Nil(t, os.WriteFile(filepath.Join(shardDir, "invalid"+fileStoreExtension), []byte("invalid"), 0o644))
+	oldTmp := filepath.Join(shardDir, fileStoreTempPrefix+"old")
+	assert.Nil(t, os.WriteFile(oldTmp, []byte("partial"), 0o644))
+	old := time.Now().Add(-2 * fileStoreTempMaxAge)
+	assert.Nil(t, os.Chtimes(oldTmp, old, old))
+	assert.Nil(t, os.WriteFile(filepath.Join(shardDir, fileStoreTempPrefix+"new"), []byte("partial"), 0o644))
+
+	stats, err := store.Compact(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, CompactionStats{Files: 4, Removed: 2, TempFiles: 1, Invalid: 1}, stats)
+
+	files, _ := os.ReadDir(shardDir)
+	names := []string{}
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	assert.ElementsMatch(t, []string{
+		fileStoreLockName,
+		encodeFileName("vis1") + fileStoreExtension,
+		"invalid" + fileStoreExtension,
+		fileStoreTempPrefix + "new",
+	}, names)
+
+	a, _ := store.Get(ctx, "env", "vis1")
+	assert.Len(t, a.Assignments, 1)
+
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = store.Compact(canceledCtx)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestFileAssignmentStoreEmptyEnvironment(t *testing.T) {
+	ctx := context.Background()
+	store, _ := NewFileAssignmentStore(t.TempDir(), FileStoreOptions{Shards: 4})
+
+	// Assignments without environment ID are rejected, so that compaction always finds the environment directories
+	assignments := &VisitorAssignments{Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1"}}}
+	assert.Equal(t, EmptyEnvironmentIDError, store.Save(ctx, "", "vis1", assignments))
+	assert.Equal(t, EmptyEnvironmentIDError, store.CompareAndSave(ctx, "", "vis1", assignments))
+	a, err := store.Get(ctx, "", "vis1")
+	assert.Nil(t, err)
+	assert.Nil(t, a)
+
+	assert.Nil(t, store.Save(ctx, "env", "vis1", &VisitorAssignments{Timestamp: time.Now().Add(-2 * time.Hour).Unix(), TTL: time.Hour}))
+	stats, err := store.Compact(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, CompactionStats{Files: 1, Removed: 1}, stats)
+}
+
+func TestFileAssignmentStoreDecision(t *testing.T) {
+	store, _ := NewFileAssignmentStore(t.TempDir(), FileStoreOptions{})
+	handlers := DecisionHandlers{AssignmentStore: store}
+
+	decision, err := GetDecision(createBatchVisitor("vis1", true), createBatchEnvironment(), DecisionOptions{}, handlers)
+	assert.Nil(t, err)
+	assert.Len(t, decision.Campaigns, 1)
+
+	a, _ := store.Get(context.Background(), "env_id", "vis1")
+	assert.Equal(t, decision.Campaigns[0].Variation.Id.Value, a.Assignments["vg1"].VariationID)
+}
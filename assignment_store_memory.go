@@ -0,0 +1,217 @@
+package decision
+
+import (
+	"container/list"
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryAssignmentStore is a concurrency-safe in-memory assignment store.
+// It keeps at most maxSize IDs, evicting the least recently used ones, and removes the assignments once their TTL is over
+type MemoryAssignmentStore struct {
+	mu      sync.Mutex
+	maxSize int
+	entries map[string]*list.Element
+	lru     *list.List
+	closed  bool
+}
+
+type memoryStoreEntry struct {
+	key           string
+	environmentID string
+	id            string
+	assignments   *VisitorAssignments
+}
+
+// NewMemoryAssignmentStore creates an in-memory assignment store bounded to maxSize IDs.
+// A maxSize lower or equal to 0 means no bound
+func NewMemoryAssignmentStore(maxSize int) *MemoryAssignmentStore {
+	return &MemoryAssignmentStore{
+		maxSize: maxSize,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// assignmentsKey returns the key of the assignments of the ID in the environment.
+// The environment ID is prefixed with its length, so that the key is unique whatever the characters of the IDs
+func assignmentsKey(environmentID string, id string) string {
+	return strconv.Itoa(len(environmentID)) + ":" + environmentID + "|" + id
+}
+
+// Get returns a copy of the assignments of the ID, or nil if there is none
+func (s *MemoryAssignmentStore) Get(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, StoreClosedError
+	}
+	return s.get(assignmentsKey(environmentID, id)), nil
+}
+
+// Save stores a copy of the assignments of the ID, incrementing the stored version
+func (s *MemoryAssignmentStore) Save(ctx context.Context, environmentID string, id string, assignments *VisitorAssignments) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return StoreClosedError
+	}
+
+	s.put(environmentID, id, assignments)
+	return nil
+}
+
+// CompareAndSave stores a copy of the assignments of the ID if the stored version equals the assignments version,
+// incrementing it. It returns VersionConflictError otherwise
+func (s *MemoryAssignmentStore) CompareAndSave(ctx context.Context, environmentID string, id string, assignments *VisitorAssignments) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return StoreClosedError
+	}
+
+	if s.version(assignmentsKey(environmentID, id)) != assignments.Version {
+		return VersionConflictError
+	}
+	s.put(environmentID, id, assignments)
+	return nil
+}
+
+// version returns the version of the stored assignments, 0 if there is none
+func (s *MemoryAssignmentStore) version(key string) int64 {
+	if e, ok := s.lookup(key); ok {
+		return e.Value.(*memoryStoreEntry).assignments.Version
+	}
+	return 0
+}
+
+// put stores a copy of the assignments with the next version, evicting the least recently used IDs if needed
+func (s *MemoryAssignmentStore) put(environmentID string, id string, assignments *VisitorAssignments) {
+	key := assignmentsKey(environmentID, id)
+	stored := assignments.clone()
+	if stored == nil {
+		stored = &VisitorAssignments{}
+	}
+	stored.Version = s.version(key) + 1
+
+	if e, ok := s.lookup(key); ok {
+		e.Value.(*memoryStoreEntry).assignments = stored
+		s.lru.MoveToFront(e)
+		return
+	}
+
+	s.entries[key] = s.lru.PushFront(&memoryStoreEntry{
+		key:           key,
+		environmentID: environmentID,
+		id:            id,
+		assignments:   stored,
+	})
+	if s.maxSize > 0 && s.lru.Len() > s.maxSize {
+		s.removeElement(s.lru.Back())
+	}
+}
+
+// Delete removes the assignments of the ID
+func (s *MemoryAssignmentStore) Delete(ctx context.Context, environmentID string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return StoreClosedError
+	}
+	if e, ok := s.entries[assignmentsKey(environmentID, id)]; ok {
+		s.removeElement(e)
+	}
+	return nil
+}
+
+// BatchGet returns a copy of the assignments of the IDs, by ID
+func (s *MemoryAssignmentStore) BatchGet(ctx context.Context, environmentID string, ids []string) (map[string]*VisitorAssignments, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, StoreClosedError
+	}
+
+	results := map[string]*VisitorAssignments{}
+	for _, id := range ids {
+		if a := s.get(assignmentsKey(environmentID, id)); a != nil {
+			results[id] = a
+		}
+	}
+	return results, nil
+}
+
+// IDs returns the sorted IDs of the environment with assignments that are not expired
+func (s *MemoryAssignmentStore) IDs(ctx context.Context, environmentID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, StoreClosedError
+	}
+
+	ids := []string{}
+	now := time.Now()
+	for _, e := range s.entries {
+		entry := e.Value.(*memoryStoreEntry)
+		if entry.environmentID == environmentID && !entry.assignments.isExpired(now) {
+			ids = append(ids, entry.id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Close removes all the assignments. The store cannot be used anymore
+func (s *MemoryAssignmentStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.entries = map[string]*list.Element{}
+	s.lru.Init()
+	return nil
+}
+
+// Len returns the number of IDs in the store
+func (s *MemoryAssignmentStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lru.Len()
+}
+
+func (s *MemoryAssignmentStore) get(key string) *VisitorAssignments {
+	e, ok := s.lookup(key)
+	if !ok {
+		return nil
+	}
+	s.lru.MoveToFront(e)
+	return e.Value.(*memoryStoreEntry).assignments.clone()
+}
+
+// lookup returns the element of the key, removing it if its assignments are expired
+func (s *MemoryAssignmentStore) lookup(key string) (*list.Element, bool) {
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if e.Value.(*memoryStoreEntry).assignments.isExpired(time.Now()) {
+		s.removeElement(e)
+		return nil, false
+	}
+	return e, true
+}
+
+func (s *MemoryAssignmentStore) removeElement(e *list.Element) {
+	s.lru.Remove(e)
+	delete(s.entries, e.Value.(*memoryStoreEntry).key)
+}
@@ -0,0 +1,149 @@
+package decision
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryAssignmentStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryAssignmentStore(2)
+
+	a, err := store.Get(ctx, "env", "vis1")
+	assert.Nil(t, err)
+	assert.Nil(t, a)
+
+	assignments := &VisitorAssignments{
+		Timestamp:   1,
+		Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1"}},
+	}
+	assert.Nil(t, store.Save(ctx, "env", "vis1", assignments))
+
+	// Stored assignments should not be shared with the caller
+	assignments.Assignments["vg1"].VariationID = "v2"
+	a, err = store.Get(ctx, "env", "vis1")
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", a.Assignments["vg1"].VariationID)
+	a.Assignments["vg2"] = &VisitorCache{VariationID: "v3"}
+	a, _ = store.Get(ctx, "env", "vis1")
+	assert.Len(t, a.Assignments, 1)
+
+	// Environments should be isolated
+	a, _ = store.Get(ctx, "env2", "vis1")
+	assert.Nil(t, a)
+
+	// The least recently used ID should be evicted
+	assert.Nil(t, store.Save(ctx, "env", "vis2", &VisitorAssignments{}))
+	_, _ = store.Get(ctx, "env", "vis1")
+	assert.Nil(t, store.Save(ctx, "env", "vis3", &VisitorAssignments{}))
+	assert.Equal(t, 2, store.Len())
+
+	results, err := store.BatchGet(ctx, "env", []string{"vis1", "vis2", "vis3"})
+	assert.Nil(t, err)
+	assert.Len(t, results, 2)
+	assert.Contains(t, results, "vis1")
+	assert.Contains(t, results, "vis3")
+
+	// Saving an existing ID should replace its assignments
+	assert.Nil(t, store.Save(ctx, "env", "vis1", &VisitorAssignments{Timestamp: 2}))
+	a, _ = store.Get(ctx, "env", "vis1")
+	assert.Equal(t, int64(2), a.Timestamp)
+	assert.Equal(t, 2, store.Len())
+
+	assert.Nil(t, store.Delete(ctx, "env", "vis1"))
+	assert.Nil(t, store.Delete(ctx, "env", "unknown"))
+	a, _ = store.Get(ctx, "env", "vis1")
+	assert.Nil(t, a)
+	assert.Equal(t, 1, store.Len())
+
+	assert.Nil(t, store.Close())
+	assert.Equal(t, 0, store.Len())
+	_, err = store.Get(ctx, "env", "vis3")
+	assert.Equal(t, StoreClosedError, err)
+	assert.Equal(t, StoreClosedError, store.Save(ctx, "env", "vis3", nil))
+	assert.Equal(t, StoreClosedError, store.Delete(ctx, "env", "vis3"))
+	_, err = store.BatchGet(ctx, "env", []string{"vis3"})
+	assert.Equal(t, StoreClosedError, err)
+}
+
+func TestMemoryAssignmentStoreCompareAndSave(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryAssignmentStore(0)
+
+	// Version 0 means that no assignments are stored
+	assert.Nil(t, store.CompareAndSave(ctx, "env", "vis1", &VisitorAssignments{Timestamp: 1}))
+	a, _ := store.Get(ctx, "env", "vis1")
+	assert.Equal(t, int64(1), a.Version)
+	assert.Equal(t, VersionConflictError, store.CompareAndSave(ctx, "env", "vis1", &VisitorAssignments{Timestamp: 2}))
+
+	assert.Nil(t, store.CompareAndSave(ctx, "env", "vis1", a))
+	a, _ = store.Get(ctx, "env", "vis1")
+	assert.Equal(t, int64(2), a.Version)
+
+	// Plain saves also increment the version, so that they are detected by concurrent compare and saves
+	assert.Nil(t, store.Save(ctx, "env", "vis1", &VisitorAssignments{Timestamp: 3}))
+	assert.Equal(t, VersionConflictError, store.CompareAndSave(ctx, "env", "vis1", a))
+	a, _ = store.Get(ctx, "env", "vis1")
+	assert.Equal(t, int64(3), a.Version)
+
+	assert.Nil(t, store.Close())
+	assert.Equal(t, StoreClosedError, store.CompareAndSave(ctx, "env", "vis1", a))
+}
+
+func TestMemoryAssignmentStoreConcurrent(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryAssignmentStore(50)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := strconv.Itoa(i)
+			assert.Nil(t, store.Save(ctx, "env", id, &VisitorAssignments{
+				Assignments: map[string]*VisitorCache{"vg1": {VariationID: id}},
+			}))
+			_, err := store.Get(ctx, "env", id)
+			assert.Nil(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 50, store.Len())
+}
+
+func TestMemoryAssignmentStoreIDs(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryAssignmentStore(0)
+	assert.Nil(t, store.Save(ctx, "env", "vis2", &VisitorAssignments{}))
+	assert.Nil(t, store.Save(ctx, "env", "vis1", &VisitorAssignments{}))
+	assert.Nil(t, store.Save(ctx, "env|vis3", "vis4", &VisitorAssignments{}))
+	assert.Nil(t, store.Save(ctx, "env", "expired", &VisitorAssignments{Timestamp: time.Now().Add(-2 * time.Hour).Unix(), TTL: time.Hour}))
+
+	ids, err := store.IDs(ctx, "env")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"vis1", "vis2"}, ids)
+	ids, _ = store.IDs(ctx, "unknown")
+	assert.Len(t, ids, 0)
+
+	assert.Nil(t, store.Close())
+	_, err = store.IDs(ctx, "env")
+	assert.Equal(t, StoreClosedError, err)
+}
+
+func TestMemoryAssignmentStoreKeys(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryAssignmentStore(0)
+
+	// IDs containing the key separator should not share their assignments
+	assert.Nil(t, store.Save(ctx, "a|b", "c", &VisitorAssignments{Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1"}}}))
+	a, err := store.Get(ctx, "a", "b|c")
+	assert.Nil(t, err)
+	assert.Nil(t, a)
+	assert.NotEqual(t, assignmentsKey("a|b", "c"), assignmentsKey("a", "b|c"))
+}
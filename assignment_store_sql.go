@@ -0,0 +1,526 @@
+package decision
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SQLDialect defines the placeholders and upsert syntax of the database of the SQL assignment store
+type SQLDialect int
+
+const (
+	// SQLDialectPostgres uses $n placeholders and ON CONFLICT upserts
+	SQLDialectPostgres SQLDialect = iota
+	// SQLDialectMySQL uses ? placeholders and ON DUPLICATE KEY UPDATE upserts
+	SQLDialectMySQL
+	// SQLDialectSQLite uses ? placeholders and ON CONFLICT upserts
+	SQLDialectSQLite
+)
+
+const (
+	defaultSQLStoreTablePrefix  = "flagship_"
+	defaultSQLStoreMaxBatchSize = 500
+)
+
+// SQLStoreOptions configures the SQL assignment store
+type SQLStoreOptions struct {
+	Dialect SQLDialect
+	// TablePrefix prefixes the names of the store tables. Defaults to "flagship_"
+	TablePrefix string
+	// MaxBatchSize is the maximum number of IDs read by a single query. Defaults to 500
+	MaxBatchSize int
+}
+
+// sqlMigrations are the schema migrations of the SQL assignment store, by version.
+// The tables are named with the table prefix, %[1]s being the prefix. With the default prefix, the schema is:
+//
+//	CREATE TABLE flagship_visitors (
+//	  environment_id VARCHAR(255) NOT NULL,
+//	  id VARCHAR(255) NOT NULL,
+//	  assignments_timestamp BIGINT NOT NULL,  -- VisitorAssignments.Timestamp, in seconds
+//	  version BIGINT NOT NULL,                -- VisitorAssignments.Version, incremented by each save
+//	  ttl_ms BIGINT NOT NULL,                 -- VisitorAssignments.TTL, in milliseconds
+//	  history TEXT,                           -- VisitorAssignments.History, as JSON
+//	  PRIMARY KEY (environment_id, id)
+//	);
+//	CREATE TABLE flagship_assignments (
+//	  environment_id VARCHAR(255) NOT NULL,
+//	  id VARCHAR(255) NOT NULL,
+//	  variation_group_id VARCHAR(255) NOT NULL,
+//	  variation_id VARCHAR(255) NOT NULL,
+//	  activated BOOLEAN NOT NULL,
+//	  assigned_at BIGINT NOT NULL DEFAULT 0,  -- VisitorCache.AssignedAt, in seconds
+//	  PRIMARY KEY (environment_id, id, variation_group_id)
+//	);
+//
+// The applied versions are stored in the flagship_schema_migrations table
+var sqlMigrations = [][]string{
+	{
+		`CREATE TABLE %[1]svisitors (
+	environment_id VARCHAR(255) NOT NULL,
+	id VARCHAR(255) NOT NULL,
+	assignments_timestamp BIGINT NOT NULL,
+	version BIGINT NOT NULL,
+	ttl_ms BIGINT NOT NULL,
+	PRIMARY KEY (environment_id, id)
+)`,
+		`CREATE TABLE %[1]sassignments (
+	environment_id VARCHAR(255) NOT NULL,
+	id VARCHAR(255) NOT NULL,
+	variation_group_id VARCHAR(255) NOT NULL,
+	variation_id VARCHAR(255) NOT NULL,
+	activated BOOLEAN NOT NULL,
+	PRIMARY KEY (environment_id, id, variation_group_id)
+)`,
+	},
+	{
+		`ALTER TABLE %[1]svisitors ADD COLUMN history TEXT`,
+	},
+	{
+		`ALTER TABLE %[1]sassignments ADD COLUMN assigned_at BIGINT NOT NULL DEFAULT 0`,
+	},
+}
+
+// SQLAssignmentStore is an assignment store on a database/sql database, such as Postgres, MySQL or SQLite.
+// Each ID is stored as a visitors row, with an assignments row by variation group.
+// Like the other stores, Save and CompareAndSave replace the stored assignments of the ID: they upsert the rows of the saved variation groups
+// and remove the other ones, so that the assignments dropped as expired or pruned are not served again.
+// Decisions save with CompareAndSave, so that concurrent decisions merge their assignments instead of dropping each other's.
+// BatchGet reads all the IDs with a single query, so batch decisions load the visitor, anonymous and decision group IDs at once.
+// Call Migrate to create or update the schema before using the store
+type SQLAssignmentStore struct {
+	db      *sql.DB
+	options SQLStoreOptions
+
+	visitorsTable    string
+	assignmentsTable string
+	migrationsTable  string
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewSQLAssignmentStore creates an assignment store on the database. The database is not closed by the store
+func NewSQLAssignmentStore(db *sql.DB, options SQLStoreOptions) *SQLAssignmentStore {
+	if options.TablePrefix == "" {
+		options.TablePrefix = defaultSQLStoreTablePrefix
+	}
+	if options.MaxBatchSize <= 0 {
+		options.MaxBatchSize = defaultSQLStoreMaxBatchSize
+	}
+
+	return &SQLAssignmentStore{
+		db:               db,
+		options:          options,
+		visitorsTable:    options.TablePrefix + "visitors",
+		assignmentsTable: options.TablePrefix + "assignments",
+		migrationsTable:  options.TablePrefix + "schema_migrations",
+	}
+}
+
+// Migrate applies the schema migrations that have not been applied yet. It returns the schema version.
+// Each migration is run in a transaction with the insertion of its version, so that a failed migration is rolled back
+// on databases with transactional DDL, such as Postgres and SQLite. MySQL commits each DDL statement implicitly,
+// so a failed migration may be partially applied there, and must be completed by hand before migrating again
+func (s *SQLAssignmentStore) Migrate(ctx context.Context) (int, error) {
+	if _, err := s.db.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version INT NOT NULL PRIMARY KEY)", s.migrationsTable)); err != nil {
+		return 0, err
+	}
+
+	var version int
+	if err := s.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COALESCE(MAX(version), 0) FROM %s", s.migrationsTable)).Scan(&version); err != nil {
+		return 0, err
+	}
+
+	for ; version < len(sqlMigrations); version++ {
+		logger.Logf(InfoLevel, "applying assignment store schema migration %d", version+1)
+		err := s.inTx(ctx, func(tx *sql.Tx) error {
+			for _, statement := range sqlMigrations[version] {
+				if _, err := tx.ExecContext(ctx, fmt.Sprintf(statement, s.options.TablePrefix)); err != nil {
+					return err
+				}
+			}
+			_, err := tx.ExecContext(ctx, s.rebind(fmt.Sprintf("INSERT INTO %s (version) VALUES (?)", s.migrationsTable)), version+1)
+			return err
+		})
+		if err != nil {
+			return version, fmt.Errorf("error when applying schema migration %d: %w", version+1, err)
+		}
+	}
+	return version, nil
+}
+
+// Get returns the assignments of the ID, or nil if there is none or if they are expired
+func (s *SQLAssignmentStore) Get(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+	results, err := s.BatchGet(ctx, environmentID, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	return results[id], nil
+}
+
+// BatchGet returns the assignments of the IDs, by ID, reading them by batches of MaxBatchSize IDs.
+// IDs without assignments or with expired ones are omitted
+func (s *SQLAssignmentStore) BatchGet(ctx context.Context, environmentID string, ids []string) (map[string]*VisitorAssignments, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, StoreClosedError
+	}
+
+	results := map[string]*VisitorAssignments{}
+	for start := 0; start < len(ids); start += s.options.MaxBatchSize {
+		end := start + s.options.MaxBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if err := s.batchGet(ctx, environmentID, ids[start:end], results); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	for id, assignments := range results {
+		if assignments.isExpired(now) {
+			delete(results, id)
+		}
+	}
+	return results, nil
+}
+
+// Save replaces the assignments of the ID, incrementing the stored version.
+// Use CompareAndSave to save assignments merged into the stored ones without dropping concurrent saves
+func (s *SQLAssignmentStore) Save(ctx context.Context, environmentID string, id string, assignments *VisitorAssignments) error {
+	return s.write(ctx, func(tx *sql.Tx) error {
+		if assignments == nil {
+			assignments = &VisitorAssignments{}
+		}
+		history, err := encodeSQLHistory(assignments.History)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, s.upsertVisitorQuery(), environmentID, id, assignments.Timestamp, assignments.TTL.Milliseconds(), history); err != nil {
+			return err
+		}
+		return s.saveAssignments(ctx, tx, environmentID, id, assignments.Assignments)
+	})
+}
+
+// CompareAndSave stores the assignments of the ID if the stored version equals the assignments version,
+// incrementing it. It returns VersionConflictError otherwise
+func (s *SQLAssignmentStore) CompareAndSave(ctx context.Context, environmentID string, id string, assignments *VisitorAssignments) error {
+	if assignments == nil {
+		return VersionConflictError
+	}
+
+	history, err := encodeSQLHistory(assignments.History)
+	if err != nil {
+		return err
+	}
+
+	return s.write(ctx, func(tx *sql.Tx) error {
+		var result sql.Result
+		var err error
+		if assignments.Version == 0 {
+			// Expired assignments are not returned by Get, so they are replaced as if there were none
+			if err := s.deleteExpired(ctx, tx, environmentID, id); err != nil {
+				return err
+			}
+			result, err = tx.ExecContext(ctx, s.insertVisitorQuery(), environmentID, id, assignments.Timestamp, assignments.TTL.Milliseconds(), history)
+		} else {
+			result, err = tx.ExecContext(ctx, s.rebind(fmt.Sprintf(
+				"UPDATE %s SET assignments_timestamp = ?, ttl_ms = ?, history = ?, version = version + 1 WHERE environment_id = ? AND id = ? AND version = ?",
+				s.visitorsTable,
+			)), assignments.Timestamp, assignments.TTL.Milliseconds(), history, environmentID, id, assignments.Version)
+		}
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return VersionConflictError
+		}
+		return s.saveAssignments(ctx, tx, environmentID, id, assignments.Assignments)
+	})
+}
+
+// IDs returns the sorted IDs of the environment with assignments that are not expired
+func (s *SQLAssignmentStore) IDs(ctx context.Context, environmentID string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, StoreClosedError
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(fmt.Sprintf(
+		"SELECT id FROM %s WHERE environment_id = ? AND (ttl_ms <= 0 OR assignments_timestamp <= 0 OR assignments_timestamp * 1000 + ttl_ms >= ?) ORDER BY id",
+		s.visitorsTable,
+	)), environmentID, time.Now().UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Delete removes the assignments of the ID
+func (s *SQLAssignmentStore) Delete(ctx context.Context, environmentID string, id string) error {
+	return s.write(ctx, func(tx *sql.Tx) error {
+		return s.delete(ctx, tx, environmentID, id)
+	})
+}
+
+// Close closes the store. The database is not closed, and the store cannot be used anymore
+func (s *SQLAssignmentStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	return nil
+}
+
+// batchGet reads the assignments of the IDs with a single query, adding them to the results
+func (s *SQLAssignmentStore) batchGet(ctx context.Context, environmentID string, ids []string, results map[string]*VisitorAssignments) error {
+	args := make([]any, 0, len(ids)+1)
+	args = append(args, environmentID)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(fmt.Sprintf(
+		"SELECT v.id, v.assignments_timestamp, v.version, v.ttl_ms, v.history, a.variation_group_id, a.variation_id, a.activated, a.assigned_at "+
+			"FROM %s v LEFT JOIN %s a ON a.environment_id = v.environment_id AND a.id = v.id "+
+			"WHERE v.environment_id = ? AND v.id IN (%s)",
+		s.visitorsTable, s.assignmentsTable, placeholders(len(ids)),
+	)), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var timestamp, version, ttl int64
+		var history, vgID, variationID sql.NullString
+		var activated sql.NullBool
+		var assignedAt sql.NullInt64
+		if err := rows.Scan(&id, &timestamp, &version, &ttl, &history, &vgID, &variationID, &activated, &assignedAt); err != nil {
+			return err
+		}
+
+		assignments, ok := results[id]
+		if !ok {
+			assignments = &VisitorAssignments{
+				Timestamp:   timestamp,
+				Version:     version,
+				TTL:         time.Duration(ttl) * time.Millisecond,
+				Assignments: map[string]*VisitorCache{},
+			}
+			if assignments.History, err = decodeSQLHistory(history); err != nil {
+				return err
+			}
+			results[id] = assignments
+		}
+		if vgID.Valid {
+			assignments.Assignments[vgID.String] = &VisitorCache{
+				VariationID: variationID.String,
+				Activated:   activated.Bool,
+				AssignedAt:  assignedAt.Int64,
+			}
+		}
+	}
+	return rows.Err()
+}
+
+// encodeSQLHistory returns the JSON value of the history column, nil if the history is empty
+func encodeSQLHistory(history map[string][]AssignmentHistoryEntry) (any, error) {
+	payload := encodeJSONHistory(history)
+	if payload == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// decodeSQLHistory returns the history of the JSON value of the history column
+func decodeSQLHistory(value sql.NullString) (map[string][]AssignmentHistoryEntry, error) {
+	if !value.Valid || value.String == "" {
+		return nil, nil
+	}
+	payload := map[string][]jsonHistoryEntry{}
+	if err := json.Unmarshal([]byte(value.String), &payload); err != nil {
+		return nil, fmt.Errorf("%w: %v", InvalidPayloadError, err)
+	}
+	return decodeJSONHistory(payload), nil
+}
+
+// saveAssignments upserts the assignments rows of the ID and removes the ones of the other variation groups
+func (s *SQLAssignmentStore) saveAssignments(ctx context.Context, tx *sql.Tx, environmentID string, id string, assignments map[string]*VisitorCache) error {
+	vgIDs := make([]string, 0, len(assignments))
+	for vgID, a := range assignments {
+		if a != nil {
+			vgIDs = append(vgIDs, vgID)
+		}
+	}
+	// Sort the variation groups so that concurrent saves lock the rows in the same order
+	sort.Strings(vgIDs)
+
+	deleteArgs := []any{environmentID, id}
+	deleteQuery := fmt.Sprintf("DELETE FROM %s WHERE environment_id = ? AND id = ?", s.assignmentsTable)
+	if len(vgIDs) > 0 {
+		deleteQuery += fmt.Sprintf(" AND variation_group_id NOT IN (%s)", placeholders(len(vgIDs)))
+		for _, vgID := range vgIDs {
+			deleteArgs = append(deleteArgs, vgID)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, s.rebind(deleteQuery), deleteArgs...); err != nil {
+		return err
+	}
+
+	if len(vgIDs) == 0 {
+		return nil
+	}
+	upsertArgs := make([]any, 0, len(vgIDs)*6)
+	for _, vgID := range vgIDs {
+		a := assignments[vgID]
+		upsertArgs = append(upsertArgs, environmentID, id, vgID, a.VariationID, a.Activated, a.AssignedAt)
+	}
+	_, err := tx.ExecContext(ctx, s.upsertAssignmentsQuery(len(vgIDs)), upsertArgs...)
+	return err
+}
+
+// deleteExpired removes the assignments of the ID if they are expired
+func (s *SQLAssignmentStore) deleteExpired(ctx context.Context, tx *sql.Tx, environmentID string, id string) error {
+	result, err := tx.ExecContext(ctx, s.rebind(fmt.Sprintf(
+		"DELETE FROM %s WHERE environment_id = ? AND id = ? AND ttl_ms > 0 AND assignments_timestamp > 0 AND assignments_timestamp * 1000 + ttl_ms < ?",
+		s.visitorsTable,
+	)), environmentID, id, time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, s.rebind(fmt.Sprintf("DELETE FROM %s WHERE environment_id = ? AND id = ?", s.assignmentsTable)), environmentID, id)
+	return err
+}
+
+// delete removes the rows of the ID
+func (s *SQLAssignmentStore) delete(ctx context.Context, tx *sql.Tx, environmentID string, id string) error {
+	for _, table := range []string{s.assignmentsTable, s.visitorsTable} {
+		if _, err := tx.ExecContext(ctx, s.rebind(fmt.Sprintf("DELETE FROM %s WHERE environment_id = ? AND id = ?", table)), environmentID, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write runs the function in a transaction if the store is not closed
+func (s *SQLAssignmentStore) write(ctx context.Context, f func(tx *sql.Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return StoreClosedError
+	}
+	return s.inTx(ctx, f)
+}
+
+// inTx runs the function in a transaction, committing it if the function succeeds and rolling it back otherwise
+func (s *SQLAssignmentStore) inTx(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
+			logger.Logf(ErrorLevel, "error when rolling back assignment store transaction: %v", rollbackErr)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// upsertVisitorQuery inserts the visitors row of the ID with version 1, or updates it and increments its version
+func (s *SQLAssignmentStore) upsertVisitorQuery() string {
+	query := fmt.Sprintf("INSERT INTO %s (environment_id, id, assignments_timestamp, version, ttl_ms, history) VALUES (?, ?, ?, 1, ?, ?)", s.visitorsTable)
+	if s.options.Dialect == SQLDialectMySQL {
+		query += " ON DUPLICATE KEY UPDATE assignments_timestamp = VALUES(assignments_timestamp), ttl_ms = VALUES(ttl_ms), history = VALUES(history), version = version + 1"
+	} else {
+		query += fmt.Sprintf(" ON CONFLICT (environment_id, id) DO UPDATE SET assignments_timestamp = excluded.assignments_timestamp, ttl_ms = excluded.ttl_ms, history = excluded.history, version = %s.version + 1", s.visitorsTable)
+	}
+	return s.rebind(query)
+}
+
+// insertVisitorQuery inserts the visitors row of the ID with version 1, and does nothing if it exists
+func (s *SQLAssignmentStore) insertVisitorQuery() string {
+	if s.options.Dialect == SQLDialectMySQL {
+		return fmt.Sprintf("INSERT IGNORE INTO %s (environment_id, id, assignments_timestamp, version, ttl_ms, history) VALUES (?, ?, ?, 1, ?, ?)", s.visitorsTable)
+	}
+	return s.rebind(fmt.Sprintf("INSERT INTO %s (environment_id, id, assignments_timestamp, version, ttl_ms, history) VALUES (?, ?, ?, 1, ?, ?) ON CONFLICT (environment_id, id) DO NOTHING", s.visitorsTable))
+}
+
+// upsertAssignmentsQuery inserts or updates n assignments rows
+func (s *SQLAssignmentStore) upsertAssignmentsQuery(n int) string {
+	values := make([]string, n)
+	for i := range values {
+		values[i] = "(?, ?, ?, ?, ?, ?)"
+	}
+	query := fmt.Sprintf("INSERT INTO %s (environment_id, id, variation_group_id, variation_id, activated, assigned_at) VALUES %s", s.assignmentsTable, strings.Join(values, ", "))
+	if s.options.Dialect == SQLDialectMySQL {
+		query += " ON DUPLICATE KEY UPDATE variation_id = VALUES(variation_id), activated = VALUES(activated), assigned_at = VALUES(assigned_at)"
+	} else {
+		query += " ON CONFLICT (environment_id, id, variation_group_id) DO UPDATE SET variation_id = excluded.variation_id, activated = excluded.activated, assigned_at = excluded.assigned_at"
+	}
+	return s.rebind(query)
+}
+
+// rebind replaces the ? placeholders of the query with the placeholders of the dialect
+func (s *SQLAssignmentStore) rebind(query string) string {
+	if s.options.Dialect != SQLDialectPostgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+		n++
+		b.WriteByte('$')
+		b.WriteString(strconv.Itoa(n))
+	}
+	return b.String()
+}
+
+// placeholders returns n comma separated ? placeholders
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
@@ -0,0 +1,631 @@
+package decision
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// standInSQLDriver is an in-memory database/sql driver understanding the statements of the SQL assignment store
+type standInSQLDriver struct {
+	mu        sync.Mutex
+	databases map[string]*standInDatabase
+}
+
+type standInKey struct {
+	environmentID string
+	id            string
+}
+
+type standInVisitor struct {
+	timestamp int64
+	version   int64
+	ttl       int64
+	history   driver.Value
+}
+
+type standInAssignment struct {
+	variationID string
+	activated   bool
+	assignedAt  int64
+}
+
+type standInState struct {
+	tables      map[string]bool
+	migrations  map[int64]bool
+	visitors    map[standInKey]standInVisitor
+	assignments map[standInKey]map[string]standInAssignment
+}
+
+type standInDatabase struct {
+	mu      sync.Mutex
+	state   *standInState
+	selects int
+	failOn  string
+}
+
+var standInDriver = &standInSQLDriver{databases: map[string]*standInDatabase{}}
+
+var standInDatabases int32
+
+func init() {
+	sql.Register("assignments-standin", standInDriver)
+}
+
+// openStandInDB opens a new empty stand-in database
+func openStandInDB(t *testing.T) (*sql.DB, *standInDatabase) {
+	name := fmt.Sprintf("%s-%d", t.Name(), atomic.AddInt32(&standInDatabases, 1))
+	db, err := sql.Open("assignments-standin", name)
+	assert.Nil(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db, standInDriver.database(name)
+}
+
+func (d *standInSQLDriver) database(name string) *standInDatabase {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.databases[name]; !ok {
+		d.databases[name] = &standInDatabase{state: &standInState{
+			tables:      map[string]bool{},
+			migrations:  map[int64]bool{},
+			visitors:    map[standInKey]standInVisitor{},
+			assignments: map[standInKey]map[string]standInAssignment{},
+		}}
+	}
+	return d.databases[name]
+}
+
+func (d *standInSQLDriver) Open(name string) (driver.Conn, error) {
+	return &standInConn{db: d.database(name)}, nil
+}
+
+func (s *standInState) clone() *standInState {
+	c := &standInState{
+		tables:      map[string]bool{},
+		migrations:  map[int64]bool{},
+		visitors:    map[standInKey]standInVisitor{},
+		assignments: map[standInKey]map[string]standInAssignment{},
+	}
+	for k, v := range s.tables {
+		c.tables[k] = v
+	}
+	for k, v := range s.migrations {
+		c.migrations[k] = v
+	}
+	for k, v := range s.visitors {
+		c.visitors[k] = v
+	}
+	for k, v := range s.assignments {
+		c.assignments[k] = map[string]standInAssignment{}
+		for vgID, a := range v {
+			c.assignments[k][vgID] = a
+		}
+	}
+	return c
+}
+
+type standInConn struct {
+	db       *standInDatabase
+	snapshot *standInState
+}
+
+func (c *standInConn) Prepare(query string) (driver.Stmt, error) {
+	return &standInStmt{conn: c, query: query}, nil
+}
+
+func (c *standInConn) Close() error {
+	return nil
+}
+
+func (c *standInConn) Begin() (driver.Tx, error) {
+	c.db.mu.Lock()
+	c.snapshot = c.db.state.clone()
+	return c, nil
+}
+
+func (c *standInConn) Commit() error {
+	c.snapshot = nil
+	c.db.mu.Unlock()
+	return nil
+}
+
+func (c *standInConn) Rollback() error {
+	c.db.state = c.snapshot
+	c.snapshot = nil
+	c.db.mu.Unlock()
+	return nil
+}
+
+type standInStmt struct {
+	conn  *standInConn
+	query string
+}
+
+func (s *standInStmt) Close() error {
+	return nil
+}
+
+func (s *standInStmt) NumInput() int {
+	return -1
+}
+
+func (s *standInStmt) Exec(args []driver.Value) (driver.Result, error) {
+	var n int64
+	err := s.run(func(db *standInDatabase) error {
+		var err error
+		n, err = db.exec(s.query, args)
+		return err
+	})
+	return driver.RowsAffected(n), err
+}
+
+func (s *standInStmt) Query(args []driver.Value) (driver.Rows, error) {
+	var rows *standInRows
+	err := s.run(func(db *standInDatabase) error {
+		var err error
+		rows, err = db.query(s.query, args)
+		return err
+	})
+	return rows, err
+}
+
+// run runs the statement holding the database lock, already held by transactions
+func (s *standInStmt) run(f func(db *standInDatabase) error) error {
+	if s.conn.snapshot == nil {
+		s.conn.db.mu.Lock()
+		defer s.conn.db.mu.Unlock()
+	}
+	if s.conn.db.failOn != "" && strings.Contains(s.query, s.conn.db.failOn) {
+		return errors.New("stand-in failure")
+	}
+	return f(s.conn.db)
+}
+
+func (db *standInDatabase) requireTable(query string, table string) error {
+	if strings.Contains(query, table) && !db.state.tables[table] {
+		return fmt.Errorf("no such table: %s", table)
+	}
+	return nil
+}
+
+func (db *standInDatabase) exec(query string, args []driver.Value) (int64, error) {
+	state := db.state
+	for _, table := range []string{"flagship_visitors", "flagship_assignments", "history", "assigned_at"} {
+		if !strings.HasPrefix(query, "CREATE TABLE "+table) && !strings.HasPrefix(query, "ALTER TABLE") {
+			if err := db.requireTable(query, table); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	key := func() standInKey {
+		return standInKey{args[0].(string), args[1].(string)}
+	}
+	switch {
+	case strings.HasPrefix(query, "CREATE TABLE IF NOT EXISTS flagship_schema_migrations"):
+		state.tables["flagship_schema_migrations"] = true
+	case strings.HasPrefix(query, "CREATE TABLE "):
+		table := strings.Fields(query)[2]
+		if state.tables[table] {
+			return 0, fmt.Errorf("table %s already exists", table)
+		}
+		state.tables[table] = true
+	case strings.HasPrefix(query, "ALTER TABLE flagship_visitors ADD COLUMN history"):
+		if err := db.requireTable(query, "flagship_visitors"); err != nil {
+			return 0, err
+		}
+		state.tables["history"] = true
+	case strings.HasPrefix(query, "ALTER TABLE flagship_assignments ADD COLUMN assigned_at"):
+		if err := db.requireTable(query, "flagship_assignments"); err != nil {
+			return 0, err
+		}
+		state.tables["assigned_at"] = true
+	case strings.HasPrefix(query, "INSERT INTO flagship_schema_migrations"):
+		version := args[0].(int64)
+		if state.migrations[version] {
+			return 0, fmt.Errorf("duplicate migration %d", version)
+		}
+		state.migrations[version] = true
+	case strings.HasPrefix(query, "INSERT INTO flagship_visitors"), strings.HasPrefix(query, "INSERT IGNORE INTO flagship_visitors"):
+		v, exists := state.visitors[key()]
+		if exists && (strings.Contains(query, "DO NOTHING") || strings.HasPrefix(query, "INSERT IGNORE")) {
+			return 0, nil
+		}
+		state.visitors[key()] = standInVisitor{timestamp: args[2].(int64), version: v.version + 1, ttl: args[3].(int64), history: args[4]}
+	case strings.HasPrefix(query, "UPDATE flagship_visitors"):
+		k := standInKey{args[3].(string), args[4].(string)}
+		v, exists := state.visitors[k]
+		if !exists || v.version != args[5].(int64) {
+			return 0, nil
+		}
+		state.visitors[k] = standInVisitor{timestamp: args[0].(int64), version: v.version + 1, ttl: args[1].(int64), history: args[2]}
+	case strings.HasPrefix(query, "INSERT INTO flagship_assignments"):
+		for i := 0; i < len(args); i += 6 {
+			k := standInKey{args[i].(string), args[i+1].(string)}
+			if state.assignments[k] == nil {
+				state.assignments[k] = map[string]standInAssignment{}
+			}
+			state.assignments[k][args[i+2].(string)] = standInAssignment{variationID: args[i+3].(string), activated: args[i+4].(bool), assignedAt: args[i+5].(int64)}
+		}
+		return int64(len(args) / 6), nil
+	case strings.HasPrefix(query, "DELETE FROM flagship_assignments"):
+		kept := map[string]bool{}
+		for _, vgID := range args[2:] {
+			kept[vgID.(string)] = true
+		}
+		n := int64(0)
+		for vgID := range state.assignments[key()] {
+			if !kept[vgID] {
+				delete(state.assignments[key()], vgID)
+				n++
+			}
+		}
+		return n, nil
+	case strings.HasPrefix(query, "DELETE FROM flagship_visitors"):
+		v, exists := state.visitors[key()]
+		if !exists {
+			return 0, nil
+		}
+		if strings.Contains(query, "ttl_ms > 0") && (v.ttl <= 0 || v.timestamp <= 0 || v.timestamp*1000+v.ttl >= args[2].(int64)) {
+			return 0, nil
+		}
+		delete(state.visitors, key())
+	default:
+		return 0, fmt.Errorf("unexpected statement: %s", query)
+	}
+	return 1, nil
+}
+
+func (db *standInDatabase) query(query string, args []driver.Value) (*standInRows, error) {
+	switch {
+	case strings.HasPrefix(query, "SELECT COALESCE(MAX(version), 0) FROM flagship_schema_migrations"):
+		max := int64(0)
+		for v := range db.state.migrations {
+			if v > max {
+				max = v
+			}
+		}
+		return &standInRows{columns: []string{"version"}, values: [][]driver.Value{{max}}}, nil
+	case strings.HasPrefix(query, "SELECT id FROM flagship_visitors"):
+		rows := &standInRows{columns: []string{"id"}}
+		ids := []string{}
+		for k, v := range db.state.visitors {
+			if k.environmentID == args[0].(string) && (v.ttl <= 0 || v.timestamp <= 0 || v.timestamp*1000+v.ttl >= args[1].(int64)) {
+				ids = append(ids, k.id)
+			}
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			rows.values = append(rows.values, []driver.Value{id})
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "SELECT v.id"):
+		for _, table := range []string{"flagship_visitors", "flagship_assignments", "history", "assigned_at"} {
+			if err := db.requireTable(query, table); err != nil {
+				return nil, err
+			}
+		}
+		db.selects++
+		rows := &standInRows{columns: []string{"id", "assignments_timestamp", "version", "ttl_ms", "history", "variation_group_id", "variation_id", "activated", "assigned_at"}}
+		for _, id := range args[1:] {
+			k := standInKey{args[0].(string), id.(string)}
+			v, ok := db.state.visitors[k]
+			if !ok {
+				continue
+			}
+			if len(db.state.assignments[k]) == 0 {
+				rows.values = append(rows.values, []driver.Value{k.id, v.timestamp, v.version, v.ttl, v.history, nil, nil, nil, nil})
+			}
+			for vgID, a := range db.state.assignments[k] {
+				rows.values = append(rows.values, []driver.Value{k.id, v.timestamp, v.version, v.ttl, v.history, vgID, a.variationID, a.activated, a.assignedAt})
+			}
+		}
+		return rows, nil
+	}
+	return nil, fmt.Errorf("unexpected query: %s", query)
+}
+
+type standInRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *standInRows) Columns() []string {
+	return r.columns
+}
+
+func (r *standInRows) Close() error {
+	return nil
+}
+
+func (r *standInRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func TestSQLAssignmentStoreMigrate(t *testing.T) {
+	ctx := context.Background()
+	db, standIn := openStandInDB(t)
+	store := NewSQLAssignmentStore(db, SQLStoreOptions{})
+
+	// The tables do not exist before the migration
+	_, err := store.Get(ctx, "env", "vis1")
+	assert.NotNil(t, err)
+
+	version, err := store.Migrate(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, len(sqlMigrations), version)
+	assert.True(t, standIn.state.tables["flagship_visitors"])
+	assert.True(t, standIn.state.tables["flagship_assignments"])
+
+	// Applied migrations are not applied again
+	version, err = store.Migrate(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, len(sqlMigrations), version)
+
+	// Failed migrations are rolled back
+	db, standIn = openStandInDB(t)
+	standIn.failOn = "CREATE TABLE flagship_assignments"
+	version, err = NewSQLAssignmentStore(db, SQLStoreOptions{}).Migrate(ctx)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, version)
+	assert.False(t, standIn.state.tables["flagship_visitors"])
+	assert.Len(t, standIn.state.migrations, 0)
+}
+
+func TestSQLAssignmentStore(t *testing.T) {
+	for name, dialect := range map[string]SQLDialect{"postgres": SQLDialectPostgres, "mysql": SQLDialectMySQL, "sqlite": SQLDialectSQLite} {
+		t.Run(name, func(t *testing.T) {
+			testSQLAssignmentStore(t, dialect)
+		})
+	}
+}
+
+func testSQLAssignmentStore(t *testing.T, dialect SQLDialect) {
+	ctx := context.Background()
+	db, _ := openStandInDB(t)
+	store := NewSQLAssignmentStore(db, SQLStoreOptions{Dialect: dialect})
+	_, err := store.Migrate(ctx)
+	assert.Nil(t, err)
+
+	a, err := store.Get(ctx, "env", "vis1")
+	assert.Nil(t, err)
+	assert.Nil(t, a)
+
+	now := time.Now().Unix()
+	assert.Nil(t, store.Save(ctx, "env", "vis1", &VisitorAssignments{
+		Timestamp: now,
+		TTL:       time.Hour,
+		Assignments: map[string]*VisitorCache{
+			"vg1": {VariationID: "v1", Activated: true, AssignedAt: now - 60},
+			"vg2": {VariationID: "v2"},
+		},
+	}))
+	a, err = store.Get(ctx, "env", "vis1")
+	assert.Nil(t, err)
+	assert.Equal(t, &VisitorAssignments{
+		Timestamp: now,
+		Version:   1,
+		TTL:       time.Hour,
+		Assignments: map[string]*VisitorCache{
+			"vg1": {VariationID: "v1", Activated: true, AssignedAt: now - 60},
+			"vg2": {VariationID: "v2"},
+		},
+	}, a)
+
+	// Saves upsert the saved variation groups and remove the other ones
+	assert.Nil(t, store.Save(ctx, "env", "vis1", &VisitorAssignments{
+		Timestamp:   2,
+		Assignments: map[string]*VisitorCache{"vg2": {VariationID: "v2", Activated: true}, "vg3": {VariationID: "v3"}},
+	}))
+	a, _ = store.Get(ctx, "env", "vis1")
+	assert.Equal(t, int64(2), a.Version)
+	assert.Equal(t, time.Duration(0), a.TTL)
+	assert.Equal(t, map[string]*VisitorCache{"vg2": {VariationID: "v2", Activated: true}, "vg3": {VariationID: "v3"}}, a.Assignments)
+
+	// IDs without variation groups are stored too
+	assert.Nil(t, store.Save(ctx, "env", "vis2", nil))
+	a, _ = store.Get(ctx, "env", "vis2")
+	assert.Equal(t, &VisitorAssignments{Version: 1, Assignments: map[string]*VisitorCache{}}, a)
+
+	// Environments should be isolated
+	a, _ = store.Get(ctx, "env2", "vis1")
+	assert.Nil(t, a)
+
+	assert.Nil(t, store.Delete(ctx, "env", "vis1"))
+	assert.Nil(t, store.Delete(ctx, "env", "unknown"))
+	a, _ = store.Get(ctx, "env", "vis1")
+	assert.Nil(t, a)
+
+	assert.Nil(t, store.Close())
+	_, err = store.Get(ctx, "env", "vis2")
+	assert.Equal(t, StoreClosedError, err)
+	assert.Equal(t, StoreClosedError, store.Save(ctx, "env", "vis2", nil))
+	assert.Equal(t, StoreClosedError, store.Delete(ctx, "env", "vis2"))
+}
+
+func TestSQLAssignmentStoreBatchGet(t *testing.T) {
+	ctx := context.Background()
+	db, standIn := openStandInDB(t)
+	store := NewSQLAssignmentStore(db, SQLStoreOptions{MaxBatchSize: 2})
+	_, _ = store.Migrate(ctx)
+
+	for _, id := range []string{"vis1", "anonymous1", "group1"} {
+		assert.Nil(t, store.Save(ctx, "env", id, &VisitorAssignments{Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1"}}}))
+	}
+	assert.Nil(t, store.Save(ctx, "env", "expired", &VisitorAssignments{
+		Timestamp:   time.Now().Add(-2 * time.Hour).Unix(),
+		TTL:         time.Hour,
+		Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1"}},
+	}))
+
+	results, err := store.BatchGet(ctx, "env", []string{"vis1", "anonymous1", "group1", "expired", "unknown"})
+	assert.Nil(t, err)
+	assert.Len(t, results, 3)
+	assert.Equal(t, "v1", results["group1"].Assignments["vg1"].VariationID)
+	assert.Equal(t, 3, standIn.selects)
+
+	// Batch decisions load the visitor, anonymous and decision group IDs in a single call
+	standIn.selects = 0
+	visitor := createBatchVisitor("vis2", true)
+	visitor.AnonymousID = "anonymous2"
+	visitor.DecisionGroup = "group2"
+	results2, err := GetDecisions([]Visitor{visitor}, createBatchEnvironment(), DecisionOptions{}, BatchDecisionHandlers{AssignmentStore: store})
+	assert.Nil(t, err)
+	assert.Nil(t, results2[0].Err)
+	assert.Equal(t, 2, standIn.selects)
+	// Decision groups are stored by their base64 encoding
+	for _, id := range []string{"vis2", "anonymous2", base64.StdEncoding.EncodeToString([]byte("group2"))} {
+		a, _ := store.Get(ctx, "env_id", id)
+		assert.NotNil(t, a, id)
+	}
+}
+
+func TestSQLAssignmentStoreCompareAndSave(t *testing.T) {
+	ctx := context.Background()
+	db, standIn := openStandInDB(t)
+	store := NewSQLAssignmentStore(db, SQLStoreOptions{})
+	_, _ = store.Migrate(ctx)
+
+	assert.Nil(t, store.CompareAndSave(ctx, "env", "vis1", &VisitorAssignments{Timestamp: 1, Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1"}}}))
+	assert.Equal(t, VersionConflictError, store.CompareAndSave(ctx, "env", "vis1", &VisitorAssignments{Timestamp: 2}))
+	assert.Equal(t, VersionConflictError, store.CompareAndSave(ctx, "env", "vis1", &VisitorAssignments{Timestamp: 2, Version: 2}))
+	assert.Equal(t, VersionConflictError, store.CompareAndSave(ctx, "env", "vis1", nil))
+
+	a, _ := store.Get(ctx, "env", "vis1")
+	a.Assignments["vg2"] = &VisitorCache{VariationID: "v2"}
+	assert.Nil(t, store.CompareAndSave(ctx, "env", "vis1", a))
+	a, _ = store.Get(ctx, "env", "vis1")
+	assert.Equal(t, int64(2), a.Version)
+	assert.Len(t, a.Assignments, 2)
+
+	// Failed saves are rolled back
+	standIn.failOn = "INSERT INTO flagship_assignments"
+	assert.NotNil(t, store.CompareAndSave(ctx, "env", "vis1", &VisitorAssignments{Timestamp: 3, Version: 2, Assignments: map[string]*VisitorCache{"vg3": {VariationID: "v3"}}}))
+	standIn.failOn = ""
+	a, _ = store.Get(ctx, "env", "vis1")
+	assert.Equal(t, int64(2), a.Version)
+	assert.Len(t, a.Assignments, 2)
+
+	// Expired assignments are replaced as if there were none
+	assert.Nil(t, store.Save(ctx, "env", "vis2", &VisitorAssignments{
+		Timestamp:   time.Now().Add(-2 * time.Hour).Unix(),
+		TTL:         time.Hour,
+		Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1"}},
+	}))
+	a, _ = store.Get(ctx, "env", "vis2")
+	assert.Nil(t, a)
+	assert.Nil(t, store.CompareAndSave(ctx, "env", "vis2", &VisitorAssignments{Timestamp: time.Now().Unix(), Assignments: map[string]*VisitorCache{"vg2": {VariationID: "v2"}}}))
+	a, _ = store.Get(ctx, "env", "vis2")
+	assert.Equal(t, int64(1), a.Version)
+	assert.Equal(t, map[string]*VisitorCache{"vg2": {VariationID: "v2"}}, a.Assignments)
+}
+
+func TestSQLAssignmentStoreConcurrentSaves(t *testing.T) {
+	ctx := context.Background()
+	db, _ := openStandInDB(t)
+	store := NewSQLAssignmentStore(db, SQLStoreOptions{})
+	_, _ = store.Migrate(ctx)
+
+	// Decisions save with compare and save, as saves replace the stored assignments
+	handlers := DecisionHandlers{AssignmentStore: store}.withAssignmentStore()
+	assert.NotNil(t, handlers.CompareAndSaveCache)
+
+	assert.Nil(t, store.Save(ctx, "env_id", "vis1", &VisitorAssignments{Assignments: map[string]*VisitorCache{"vg0": {VariationID: "v0"}}}))
+	stale, _ := store.Get(ctx, "env_id", "vis1")
+	concurrent := stale.clone()
+	concurrent.Assignments["vg2"] = &VisitorCache{VariationID: "v2"}
+	assert.Nil(t, store.CompareAndSave(ctx, "env_id", "vis1", concurrent))
+
+	// The assignments merged with the stale version are merged again into the concurrent ones
+	env := &compileEnvironment(createBatchEnvironment()).environment
+	err := compareAndSaveAssignments(ctx, env, "vis1", stale, map[string]*VisitorCache{"vg1": {VariationID: "v1"}}, time.Now(), handlers.GetCache, handlers.CompareAndSaveCache)
+	assert.Nil(t, err)
+	a, _ := store.Get(ctx, "env_id", "vis1")
+	assert.Len(t, a.Assignments, 3)
+	assert.Equal(t, int64(3), a.Version)
+}
+
+func TestSQLAssignmentStoreIDs(t *testing.T) {
+	ctx := context.Background()
+	db, _ := openStandInDB(t)
+	store := NewSQLAssignmentStore(db, SQLStoreOptions{Dialect: SQLDialectPostgres})
+	_, _ = store.Migrate(ctx)
+
+	for _, id := range []string{"vis2", "vis1"} {
+		assert.Nil(t, store.Save(ctx, "env", id, &VisitorAssignments{Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1"}}}))
+	}
+	assert.Nil(t, store.Save(ctx, "env2", "vis3", nil))
+	assert.Nil(t, store.Save(ctx, "env", "expired", &VisitorAssignments{Timestamp: time.Now().Add(-2 * time.Hour).Unix(), TTL: time.Hour}))
+
+	ids, err := store.IDs(ctx, "env")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"vis1", "vis2"}, ids)
+
+	assert.Nil(t, store.Close())
+	_, err = store.IDs(ctx, "env")
+	assert.Equal(t, StoreClosedError, err)
+}
+
+func TestSQLAssignmentStoreHistory(t *testing.T) {
+	ctx := context.Background()
+	db, _ := openStandInDB(t)
+	store := NewSQLAssignmentStore(db, SQLStoreOptions{})
+	_, err := store.Migrate(ctx)
+	assert.Nil(t, err)
+
+	history := map[string][]AssignmentHistoryEntry{"vg1": {{VariationID: "v2", FirstSeen: 1, LastSeen: 2}, {VariationID: "v1", FirstSeen: 3, LastSeen: 3}}}
+	assert.Nil(t, store.Save(ctx, "env", "vis1", &VisitorAssignments{
+		Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1"}},
+		History:     history,
+	}))
+	a, _ := store.Get(ctx, "env", "vis1")
+	assert.Equal(t, history, a.History)
+
+	a.History = nil
+	assert.Nil(t, store.CompareAndSave(ctx, "env", "vis1", a))
+	a, _ = store.Get(ctx, "env", "vis1")
+	assert.Nil(t, a.History)
+
+	// The history column is added by the second migration
+	db, standIn := openStandInDB(t)
+	standIn.failOn = "ALTER TABLE"
+	version, err := NewSQLAssignmentStore(db, SQLStoreOptions{}).Migrate(ctx)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, version)
+	_, err = NewSQLAssignmentStore(db, SQLStoreOptions{}).Get(ctx, "env", "vis1")
+	assert.NotNil(t, err)
+
+	// The assigned_at column is added by the third migration
+	db, standIn = openStandInDB(t)
+	standIn.failOn = "ADD COLUMN assigned_at"
+	version, err = NewSQLAssignmentStore(db, SQLStoreOptions{}).Migrate(ctx)
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, version)
+}
+
+func TestSQLAssignmentStoreRebind(t *testing.T) {
+	store := NewSQLAssignmentStore(nil, SQLStoreOptions{})
+	assert.Equal(t, "SELECT a FROM t WHERE b = $1 AND c IN ($2, $3)", store.rebind("SELECT a FROM t WHERE b = ? AND c IN ("+placeholders(2)+")"))
+
+	store = NewSQLAssignmentStore(nil, SQLStoreOptions{Dialect: SQLDialectMySQL, TablePrefix: "custom_"})
+	assert.Equal(t, "SELECT a FROM t WHERE b = ?", store.rebind("SELECT a FROM t WHERE b = ?"))
+	assert.True(t, strings.HasPrefix(store.upsertAssignmentsQuery(2), "INSERT INTO custom_assignments (environment_id, id, variation_group_id, variation_id, activated, assigned_at) VALUES (?, ?, ?, ?, ?, ?), (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE"))
+}
@@ -0,0 +1,122 @@
+package decision
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlersAssignmentStore(t *testing.T) {
+	ctx := context.Background()
+	memoryStore := NewMemoryAssignmentStore(0)
+	store := NewHandlersAssignmentStore(DecisionHandlers{
+		GetCache: func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+			if id == "error" {
+				return nil, errors.New("get error")
+			}
+			return memoryStore.Get(ctx, environmentID, id)
+		},
+		SaveCache: memoryStore.Save,
+	})
+
+	assert.Nil(t, store.Save(ctx, "env", "vis1", &VisitorAssignments{Timestamp: 1}))
+	a, err := store.Get(ctx, "env", "vis1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), a.Timestamp)
+
+	results, err := store.BatchGet(ctx, "env", []string{"vis1", "vis2"})
+	assert.Nil(t, err)
+	assert.Len(t, results, 1)
+	assert.Contains(t, results, "vis1")
+
+	results, err = store.BatchGet(ctx, "env", []string{"vis1", "error"})
+	assert.NotNil(t, err)
+	assert.Len(t, results, 1)
+
+	assert.Equal(t, OperationNotSupportedError, store.Delete(ctx, "env", "vis1"))
+	assert.Nil(t, store.Close())
+
+	emptyStore := NewHandlersAssignmentStore(DecisionHandlers{})
+	_, err = emptyStore.Get(ctx, "env", "vis1")
+	assert.Equal(t, OperationNotSupportedError, err)
+	_, err = emptyStore.BatchGet(ctx, "env", []string{"vis1"})
+	assert.Equal(t, OperationNotSupportedError, err)
+	assert.Equal(t, OperationNotSupportedError, emptyStore.Save(ctx, "env", "vis1", nil))
+}
+
+func TestDecisionAssignmentStore(t *testing.T) {
+	store := NewMemoryAssignmentStore(100)
+	vi := createBatchVisitor("vis1", true)
+	ei := createBatchEnvironment()
+
+	decision, err := GetDecision(vi, ei, DecisionOptions{TriggerHit: true}, DecisionHandlers{AssignmentStore: store})
+	assert.Nil(t, err)
+	assert.Len(t, decision.Campaigns, 1)
+
+	a, err := store.Get(context.Background(), "env_id", "vis1")
+	assert.Nil(t, err)
+	assert.Equal(t, decision.Campaigns[0].Variation.Id.Value, a.Assignments["vg1"].VariationID)
+	assert.True(t, a.Assignments["vg1"].Activated)
+
+	// The stored assignment should be used for the next decisions
+	otherVariation := "v1"
+	if a.Assignments["vg1"].VariationID == "v1" {
+		otherVariation = "v2"
+	}
+	a.Assignments["vg1"].VariationID = otherVariation
+	assert.Nil(t, store.Save(context.Background(), "env_id", "vis1", a))
+
+	decision, err = GetDecision(vi, ei, DecisionOptions{}, DecisionHandlers{AssignmentStore: store})
+	assert.Nil(t, err)
+	assert.Equal(t, otherVariation, decision.Campaigns[0].Variation.Id.Value)
+
+	results, err := GetDecisions([]Visitor{vi, createBatchVisitor("vis2", true)}, ei, DecisionOptions{}, BatchDecisionHandlers{AssignmentStore: store})
+	assert.Nil(t, err)
+	assert.Equal(t, otherVariation, results[0].Response.Campaigns[0].Variation.Id.Value)
+
+	a, _ = store.Get(context.Background(), "env_id", "vis2")
+	assert.Equal(t, results[1].Response.Campaigns[0].Variation.Id.Value, a.Assignments["vg1"].VariationID)
+}
+
+func TestDecisionAssignmentStoreMerge(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryAssignmentStore(0)
+	handlers := DecisionHandlers{AssignmentStore: store}.withAssignmentStore()
+	assert.NotNil(t, handlers.CompareAndSaveCache)
+
+	// Assignments of other variation groups should be kept
+	old := map[string]*VisitorCache{"vg_old": {VariationID: "v_old", Activated: true}}
+	assert.Nil(t, store.Save(ctx, "env_id", "vis1", &VisitorAssignments{Assignments: old}))
+	assert.Nil(t, store.Save(ctx, "env_id", "vis2", &VisitorAssignments{Assignments: old}))
+
+	_, err := GetDecision(createBatchVisitor("vis1", true), createBatchEnvironment(), DecisionOptions{}, DecisionHandlers{AssignmentStore: store})
+	assert.Nil(t, err)
+	a, _ := store.Get(ctx, "env_id", "vis1")
+	assert.Len(t, a.Assignments, 2)
+	assert.Contains(t, a.Assignments, "vg_old")
+	assert.Equal(t, int64(2), a.Version)
+
+	_, err = GetDecisions([]Visitor{createBatchVisitor("vis2", true)}, createBatchEnvironment(), DecisionOptions{}, BatchDecisionHandlers{AssignmentStore: store})
+	assert.Nil(t, err)
+	a, _ = store.Get(ctx, "env_id", "vis2")
+	assert.Len(t, a.Assignments, 2)
+	assert.Contains(t, a.Assignments, "vg_old")
+	assert.Equal(t, int64(2), a.Version)
+
+	// Handlers without compare and save should receive the merged assignments
+	var saved *VisitorAssignments
+	_, err = GetDecisions([]Visitor{createBatchVisitor("vis3", true)}, createBatchEnvironment(), DecisionOptions{}, BatchDecisionHandlers{
+		BatchGetCache: func(ctx context.Context, environmentID string, ids []string) (map[string]*VisitorAssignments, error) {
+			return map[string]*VisitorAssignments{"vis3": {Assignments: old, Version: 4}}, nil
+		},
+		BatchSaveCache: func(ctx context.Context, environmentID string, assignments map[string]*VisitorAssignments) error {
+			saved = assignments["vis3"]
+			return nil
+		},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, saved.Assignments, 2)
+	assert.Equal(t, int64(4), saved.Version)
+}
@@ -0,0 +1,319 @@
+package decision
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultTieredStoreMaxSize = 10000
+	defaultTieredStoreTTL     = time.Minute
+)
+
+// TieredStoreOptions configures the in-memory tier of the tiered assignment store
+type TieredStoreOptions struct {
+	// MaxSize is the maximum number of IDs kept in memory, evicting the least recently used ones. Defaults to 10000
+	MaxSize int
+	// TTL is the time the assignments of an ID are kept in memory before being read again from the remote store. Defaults to 1 minute
+	TTL time.Duration
+	// OnWrite is called after the assignments of an ID are saved or deleted in the remote store,
+	// for example to publish the invalidation to the other instances, that call Invalidate
+	OnWrite func(environmentID string, id string)
+}
+
+// TieredStoreStats are the counters of the in-memory tier of the tiered assignment store
+type TieredStoreStats struct {
+	Hits          int64
+	Misses        int64
+	Evictions     int64
+	Invalidations int64
+}
+
+// TieredAssignmentStore is an assignment store keeping the assignments of the hot IDs in memory,
+// in front of a remote store or remote GetCache and SaveCache handlers.
+// Saves are written through to the remote store, so the in-memory tier is only stale when the assignments
+// are written by other instances, until its TTL is over or the ID is invalidated.
+// Since the in-memory tier can be stale, saves do not use compare and save
+type TieredAssignmentStore struct {
+	remote  AssignmentStore
+	options TieredStoreOptions
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	// fetching counts the remote reads in progress by key, and stale marks the keys written during these reads,
+	// so that the reads do not put outdated assignments in memory
+	fetching map[string]int
+	stale    map[string]bool
+
+	hits          int64
+	misses        int64
+	evictions     int64
+	invalidations int64
+}
+
+type tieredStoreEntry struct {
+	key         string
+	assignments *VisitorAssignments
+	expiration  time.Time
+}
+
+// NewTieredAssignmentStore creates a tiered assignment store in front of the AssignmentStore of the handlers,
+// or of their GetCache and SaveCache handlers
+func NewTieredAssignmentStore(handlers DecisionHandlers, options TieredStoreOptions) *TieredAssignmentStore {
+	if options.MaxSize <= 0 {
+		options.MaxSize = defaultTieredStoreMaxSize
+	}
+	if options.TTL <= 0 {
+		options.TTL = defaultTieredStoreTTL
+	}
+
+	remote := handlers.AssignmentStore
+	if remote == nil {
+		remote = NewHandlersAssignmentStore(handlers)
+	}
+	return &TieredAssignmentStore{
+		remote:   remote,
+		options:  options,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+		fetching: map[string]int{},
+		stale:    map[string]bool{},
+	}
+}
+
+// Get returns a copy of the assignments of the ID, reading them from the remote store if they are not in memory
+func (s *TieredAssignmentStore) Get(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+	key := assignmentsKey(environmentID, id)
+	if assignments, ok := s.get(key); ok {
+		return assignments, nil
+	}
+
+	s.startFetch(key)
+	assignments, err := s.remote.Get(ctx, environmentID, id)
+	s.endFetch(key, assignments, err == nil)
+	return assignments, err
+}
+
+// BatchGet returns a copy of the assignments of the IDs, reading the ones that are not in memory from the remote store in one call
+func (s *TieredAssignmentStore) BatchGet(ctx context.Context, environmentID string, ids []string) (map[string]*VisitorAssignments, error) {
+	results := map[string]*VisitorAssignments{}
+	missingIDs := []string{}
+	for _, id := range ids {
+		assignments, ok := s.get(assignmentsKey(environmentID, id))
+		if !ok {
+			missingIDs = append(missingIDs, id)
+			continue
+		}
+		if assignments != nil {
+			results[id] = assignments
+		}
+	}
+	if len(missingIDs) == 0 {
+		return results, nil
+	}
+
+	for _, id := range missingIDs {
+		s.startFetch(assignmentsKey(environmentID, id))
+	}
+	remoteResults, err := s.remote.BatchGet(ctx, environmentID, missingIDs)
+	for _, id := range missingIDs {
+		assignments := remoteResults[id]
+		// IDs without assignments are only known to have none if the whole batch succeeded
+		s.endFetch(assignmentsKey(environmentID, id), assignments, assignments != nil || err == nil)
+		if assignments != nil {
+			results[id] = assignments.clone()
+		}
+	}
+	return results, err
+}
+
+// Save writes the assignments of the ID to the remote store, and keeps a copy of them in memory if the write succeeded
+func (s *TieredAssignmentStore) Save(ctx context.Context, environmentID string, id string, assignments *VisitorAssignments) error {
+	key := assignmentsKey(environmentID, id)
+	err := s.remote.Save(ctx, environmentID, id, assignments)
+
+	s.mu.Lock()
+	s.markStale(key)
+	if err != nil {
+		s.remove(key)
+	} else {
+		s.put(key, assignments)
+	}
+	s.mu.Unlock()
+
+	if err == nil && s.options.OnWrite != nil {
+		s.options.OnWrite(environmentID, id)
+	}
+	return err
+}
+
+// Delete removes the assignments of the ID from memory and from the remote store
+func (s *TieredAssignmentStore) Delete(ctx context.Context, environmentID string, id string) error {
+	key := assignmentsKey(environmentID, id)
+	err := s.remote.Delete(ctx, environmentID, id)
+
+	s.mu.Lock()
+	s.markStale(key)
+	s.remove(key)
+	s.mu.Unlock()
+
+	if err == nil && s.options.OnWrite != nil {
+		s.options.OnWrite(environmentID, id)
+	}
+	return err
+}
+
+// IDs returns the sorted IDs of the environment of the remote store, as saves are written through to it.
+// It returns OperationNotSupportedError if the remote store cannot list its IDs
+func (s *TieredAssignmentStore) IDs(ctx context.Context, environmentID string) ([]string, error) {
+	scanStore, ok := s.remote.(ScanStore)
+	if !ok {
+		return nil, OperationNotSupportedError
+	}
+	return scanStore.IDs(ctx, environmentID)
+}
+
+// Invalidate removes the assignments of the ID from memory, so that the next read gets them from the remote store
+func (s *TieredAssignmentStore) Invalidate(environmentID string, id string) {
+	key := assignmentsKey(environmentID, id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.markStale(key)
+	if s.remove(key) {
+		atomic.AddInt64(&s.invalidations, 1)
+	}
+}
+
+// InvalidateAll removes all the assignments from memory
+func (s *TieredAssignmentStore) InvalidateAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.fetching {
+		s.stale[key] = true
+	}
+	atomic.AddInt64(&s.invalidations, int64(s.lru.Len()))
+	s.entries = map[string]*list.Element{}
+	s.lru.Init()
+}
+
+// Close removes all the assignments from memory and closes the remote store
+func (s *TieredAssignmentStore) Close() error {
+	s.InvalidateAll()
+	return s.remote.Close()
+}
+
+// Len returns the number of IDs in memory
+func (s *TieredAssignmentStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lru.Len()
+}
+
+// Stats returns the counters of the in-memory tier
+func (s *TieredAssignmentStore) Stats() TieredStoreStats {
+	return TieredStoreStats{
+		Hits:          atomic.LoadInt64(&s.hits),
+		Misses:        atomic.LoadInt64(&s.misses),
+		Evictions:     atomic.LoadInt64(&s.evictions),
+		Invalidations: atomic.LoadInt64(&s.invalidations),
+	}
+}
+
+// get returns a copy of the assignments of the key if they are in memory, counting the hits and misses
+func (s *TieredAssignmentStore) get(key string) (*VisitorAssignments, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if ok {
+		entry := e.Value.(*tieredStoreEntry)
+		if now := time.Now(); now.After(entry.expiration) || entry.assignments.isExpired(now) {
+			s.removeElement(e)
+			ok = false
+		}
+	}
+	if !ok {
+		atomic.AddInt64(&s.misses, 1)
+		return nil, false
+	}
+
+	atomic.AddInt64(&s.hits, 1)
+	s.lru.MoveToFront(e)
+	return e.Value.(*tieredStoreEntry).assignments.clone(), true
+}
+
+// startFetch registers a remote read of the key
+func (s *TieredAssignmentStore) startFetch(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fetching[key]++
+}
+
+// endFetch unregisters a remote read of the key, and keeps the read assignments in memory
+// if the read succeeded and the key has not been written during the read
+func (s *TieredAssignmentStore) endFetch(key string, assignments *VisitorAssignments, succeeded bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if succeeded && !s.stale[key] {
+		s.put(key, assignments)
+	}
+	s.fetching[key]--
+	if s.fetching[key] <= 0 {
+		delete(s.fetching, key)
+		delete(s.stale, key)
+	}
+}
+
+// markStale marks the key as written for the remote reads in progress
+func (s *TieredAssignmentStore) markStale(key string) {
+	if s.fetching[key] > 0 {
+		s.stale[key] = true
+	}
+}
+
+// put keeps a copy of the assignments of the key in memory, evicting the least recently used IDs if needed.
+// Nil assignments are kept too, so that IDs without assignments are not read again from the remote store
+func (s *TieredAssignmentStore) put(key string, assignments *VisitorAssignments) {
+	expiration := time.Now().Add(s.options.TTL)
+	if e, ok := s.entries[key]; ok {
+		entry := e.Value.(*tieredStoreEntry)
+		entry.assignments = assignments.clone()
+		entry.expiration = expiration
+		s.lru.MoveToFront(e)
+		return
+	}
+
+	s.entries[key] = s.lru.PushFront(&tieredStoreEntry{
+		key:         key,
+		assignments: assignments.clone(),
+		expiration:  expiration,
+	})
+	if s.lru.Len() > s.options.MaxSize {
+		s.removeElement(s.lru.Back())
+		atomic.AddInt64(&s.evictions, 1)
+	}
+}
+
+// remove removes the key from memory and returns true if it was in memory
+func (s *TieredAssignmentStore) remove(key string) bool {
+	e, ok := s.entries[key]
+	if ok {
+		s.removeElement(e)
+	}
+	return ok
+}
+
+func (s *TieredAssignmentStore) removeElement(e *list.Element) {
+	s.lru.Remove(e)
+	delete(s.entries, e.Value.(*tieredStoreEntry).key)
+}
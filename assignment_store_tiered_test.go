@@ -0,0 +1,197 @@
+package decision
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type countingAssignmentStore struct {
+	*MemoryAssignmentStore
+	gets      int32
+	batchGets int32
+}
+
+func (s *countingAssignmentStore) Get(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+	atomic.AddInt32(&s.gets, 1)
+	return s.MemoryAssignmentStore.Get(ctx, environmentID, id)
+}
+
+func (s *countingAssignmentStore) BatchGet(ctx context.Context, environmentID string, ids []string) (map[string]*VisitorAssignments, error) {
+	atomic.AddInt32(&s.batchGets, 1)
+	return s.MemoryAssignmentStore.BatchGet(ctx, environmentID, ids)
+}
+
+func TestTieredAssignmentStore(t *testing.T) {
+	ctx := context.Background()
+	remote := &countingAssignmentStore{MemoryAssignmentStore: NewMemoryAssignmentStore(0)}
+	writes := []string{}
+	store := NewTieredAssignmentStore(DecisionHandlers{AssignmentStore: remote}, TieredStoreOptions{
+		MaxSize: 2,
+		OnWrite: func(environmentID string, id string) {
+			writes = append(writes, id)
+		},
+	})
+
+	// IDs without assignments are kept in memory too
+	a, err := store.Get(ctx, "env", "vis1")
+	assert.Nil(t, err)
+	assert.Nil(t, a)
+	a, _ = store.Get(ctx, "env", "vis1")
+	assert.Nil(t, a)
+	assert.Equal(t, int32(1), remote.gets)
+	assert.Equal(t, TieredStoreStats{Hits: 1, Misses: 1}, store.Stats())
+
+	// Saves are written through
+	assert.Nil(t, store.Save(ctx, "env", "vis1", &VisitorAssignments{Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1"}}}))
+	a, _ = remote.MemoryAssignmentStore.Get(ctx, "env", "vis1")
+	assert.Equal(t, "v1", a.Assignments["vg1"].VariationID)
+	a, _ = store.Get(ctx, "env", "vis1")
+	assert.Equal(t, "v1", a.Assignments["vg1"].VariationID)
+	assert.Equal(t, int32(1), remote.gets)
+	assert.Equal(t, []string{"vis1"}, writes)
+
+	// Assignments in memory should not be shared with the caller
+	a.Assignments["vg1"].VariationID = "v2"
+	a, _ = store.Get(ctx, "env", "vis1")
+	assert.Equal(t, "v1", a.Assignments["vg1"].VariationID)
+
+	// Invalidated IDs are read again from the remote store
+	assert.Nil(t, remote.Save(ctx, "env", "vis1", &VisitorAssignments{Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v3"}}}))
+	a, _ = store.Get(ctx, "env", "vis1")
+	assert.Equal(t, "v1", a.Assignments["vg1"].VariationID)
+	store.Invalidate("env", "vis1")
+	a, _ = store.Get(ctx, "env", "vis1")
+	assert.Equal(t, "v3", a.Assignments["vg1"].VariationID)
+	assert.Equal(t, int32(2), remote.gets)
+
+	// The least recently used ID should be evicted
+	_, _ = store.Get(ctx, "env", "vis2")
+	_, _ = store.Get(ctx, "env", "vis3")
+	assert.Equal(t, 2, store.Len())
+	assert.Equal(t, TieredStoreStats{Hits: 4, Misses: 4, Evictions: 1, Invalidations: 1}, store.Stats())
+
+	// Only the IDs that are not in memory are read from the remote store
+	results, err := store.BatchGet(ctx, "env", []string{"vis1", "vis2", "vis3"})
+	assert.Nil(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "v3", results["vis1"].Assignments["vg1"].VariationID)
+	assert.Equal(t, int32(1), remote.batchGets)
+	_, _ = store.BatchGet(ctx, "env", []string{"vis1", "vis3"})
+	assert.Equal(t, int32(1), remote.batchGets)
+
+	assert.Nil(t, store.Delete(ctx, "env", "vis1"))
+	a, _ = store.Get(ctx, "env", "vis1")
+	assert.Nil(t, a)
+	assert.Equal(t, []string{"vis1", "vis1"}, writes)
+
+	store.InvalidateAll()
+	assert.Equal(t, 0, store.Len())
+	assert.Nil(t, store.Close())
+	_, err = remote.Get(ctx, "env", "vis1")
+	assert.Equal(t, StoreClosedError, err)
+}
+
+func TestTieredAssignmentStoreTTL(t *testing.T) {
+	ctx := context.Background()
+	nbGets := 0
+	store := NewTieredAssignmentStore(DecisionHandlers{
+		GetCache: func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+			nbGets++
+			return &VisitorAssignments{}, nil
+		},
+	}, TieredStoreOptions{TTL: 10 * time.Millisecond})
+
+	_, _ = store.Get(ctx, "env", "vis1")
+	_, _ = store.Get(ctx, "env", "vis1")
+	assert.Equal(t, 1, nbGets)
+
+	time.Sleep(20 * time.Millisecond)
+	_, _ = store.Get(ctx, "env", "vis1")
+	assert.Equal(t, 2, nbGets)
+
+	assert.Equal(t, OperationNotSupportedError, store.Save(ctx, "env", "vis1", &VisitorAssignments{}))
+	_, _ = store.Get(ctx, "env", "vis1")
+	assert.Equal(t, 3, nbGets)
+}
+
+func TestTieredAssignmentStoreErrors(t *testing.T) {
+	ctx := context.Background()
+	errRemote := errors.New("remote error")
+	release := make(chan struct{})
+	var nbGets int32
+	store := NewTieredAssignmentStore(DecisionHandlers{
+		GetCache: func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+			if atomic.AddInt32(&nbGets, 1) == 1 {
+				return nil, errRemote
+			}
+			<-release
+			return &VisitorAssignments{Timestamp: 1}, nil
+		},
+		SaveCache: func(ctx context.Context, environmentID string, id string, assignments *VisitorAssignments) error {
+			return nil
+		},
+	}, TieredStoreOptions{})
+
+	// Failed reads are not kept in memory
+	_, err := store.Get(ctx, "env", "vis1")
+	assert.Equal(t, errRemote, err)
+	assert.Equal(t, 0, store.Len())
+
+	// Reads in progress during a save do not overwrite the saved assignments
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = store.Get(ctx, "env", "vis1")
+	}()
+	assert.Eventually(t, func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return store.fetching[assignmentsKey("env", "vis1")] == 1
+	}, time.Second, time.Millisecond)
+	assert.Nil(t, store.Save(ctx, "env", "vis1", &VisitorAssignments{Timestamp: 2}))
+	close(release)
+	<-done
+
+	a, _ := store.Get(ctx, "env", "vis1")
+	assert.Equal(t, int64(2), a.Timestamp)
+	assert.Len(t, store.fetching, 0)
+	assert.Len(t, store.stale, 0)
+}
+
+func TestTieredAssignmentStoreDecision(t *testing.T) {
+	remote := &countingAssignmentStore{MemoryAssignmentStore: NewMemoryAssignmentStore(0)}
+	store := NewTieredAssignmentStore(DecisionHandlers{AssignmentStore: remote}, TieredStoreOptions{})
+	handlers := DecisionHandlers{AssignmentStore: store}
+
+	for i := 0; i < 3; i++ {
+		decision, err := GetDecision(createBatchVisitor("vis1", true), createBatchEnvironment(), DecisionOptions{}, handlers)
+		assert.Nil(t, err)
+		assert.Len(t, decision.Campaigns, 1)
+	}
+
+	// Only the first decision reads from the remote store
+	assert.Equal(t, int32(1), remote.gets)
+	a, _ := remote.MemoryAssignmentStore.Get(context.Background(), "env_id", "vis1")
+	assert.Len(t, a.Assignments, 1)
+}
+
+func TestTieredAssignmentStoreIDs(t *testing.T) {
+	ctx := context.Background()
+	remote := NewMemoryAssignmentStore(0)
+	store := NewTieredAssignmentStore(DecisionHandlers{AssignmentStore: remote}, TieredStoreOptions{})
+	assert.Nil(t, store.Save(ctx, "env", "vis1", &VisitorAssignments{}))
+	assert.Nil(t, remote.Save(ctx, "env", "vis2", &VisitorAssignments{}))
+
+	// IDs are listed from the remote store
+	ids, err := store.IDs(ctx, "env")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"vis1", "vis2"}, ids)
+
+	_, err = NewTieredAssignmentStore(DecisionHandlers{GetCache: remote.Get}, TieredStoreOptions{}).IDs(ctx, "env")
+	assert.Equal(t, OperationNotSupportedError, err)
+}
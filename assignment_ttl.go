@@ -0,0 +1,131 @@
+package decision
+
+import (
+	"time"
+)
+
+// AssignmentTTLPolicy defines how long the visitors assignments stay sticky, according to the environment and campaigns TTLs.
+// The TTL of an assignment is counted from its AssignedAt timestamp, so that saving other assignments of the visitor does not extend it.
+// Once expired, an assignment is treated as absent and the visitor is allocated again
+type AssignmentTTLPolicy struct {
+	defaultTTL time.Duration
+	// ttls stores the TTL of the variation groups whose campaign overrides the environment TTL, by variation group ID
+	ttls map[string]time.Duration
+}
+
+// newAssignmentTTLPolicy creates the TTL policy of the environment campaigns
+func newAssignmentTTLPolicy(environmentInfos Environment) *AssignmentTTLPolicy {
+	policy := &AssignmentTTLPolicy{
+		defaultTTL: environmentInfos.AssignmentTTL,
+		ttls:       map[string]time.Duration{},
+	}
+	for _, c := range environmentInfos.Campaigns {
+		if c.AssignmentTTL <= 0 {
+			continue
+		}
+		for _, vg := range c.VariationGroups {
+			policy.ttls[vg.ID] = c.AssignmentTTL
+		}
+	}
+	return policy
+}
+
+// TTL returns the TTL of the assignment of the variation group, 0 if it never expires
+func (p *AssignmentTTLPolicy) TTL(vgID string) time.Duration {
+	if p == nil {
+		return 0
+	}
+	if ttl, ok := p.ttls[vgID]; ok {
+		return ttl
+	}
+	return p.defaultTTL
+}
+
+// AssignmentsTTL returns the duration from now after which all the assignments are expired, 0 if any of them never expires.
+// Assignments without AssignedAt timestamp are considered assigned now.
+// Stores can use it to set a native expiry on the saved assignments
+func (p *AssignmentTTLPolicy) AssignmentsTTL(assignments map[string]*VisitorCache, now time.Time) time.Duration {
+	var maxTTL time.Duration
+	for vgID, a := range assignments {
+		ttl := p.TTL(vgID)
+		if ttl <= 0 {
+			return 0
+		}
+		if a != nil && a.AssignedAt > 0 {
+			ttl -= time.Duration(now.Unix()-a.AssignedAt) * time.Second
+		}
+		if ttl > maxTTL {
+			maxTTL = ttl
+		}
+	}
+	if len(assignments) > 0 && maxTTL < time.Second {
+		// The assignments are not expired yet, so that a TTL of 0 would wrongly mean they never expire
+		maxTTL = time.Second
+	}
+	return maxTTL
+}
+
+// IsExpired returns true if the assignment of the variation group is older than its TTL.
+// The assignment age is counted from its AssignedAt timestamp, or from the assignments Timestamp if unknown.
+// Assignments without timestamp never expire
+func (p *AssignmentTTLPolicy) IsExpired(assignments *VisitorAssignments, vgID string, now time.Time) bool {
+	ttl := p.TTL(vgID)
+	assignedAt := assignments.assignedAt(vgID)
+	if ttl <= 0 || assignedAt <= 0 {
+		return false
+	}
+	return now.Sub(time.Unix(assignedAt, 0)) > ttl
+}
+
+// assignedAt returns the AssignedAt timestamp of the assignment of the variation group,
+// or the assignments Timestamp if unknown
+func (va *VisitorAssignments) assignedAt(vgID string) int64 {
+	if va == nil {
+		return 0
+	}
+	if a := va.Assignments[vgID]; a != nil && a.AssignedAt > 0 {
+		return a.AssignedAt
+	}
+	return va.Timestamp
+}
+
+// removeExpired returns the assignments without the expired ones.
+// The assignments are copied only if some of them are expired
+func (p *AssignmentTTLPolicy) removeExpired(assignments *VisitorAssignments, now time.Time) *VisitorAssignments {
+	if assignments == nil {
+		return nil
+	}
+
+	var active *VisitorAssignments
+	for vgID := range assignments.Assignments {
+		if !p.IsExpired(assignments, vgID, now) {
+			continue
+		}
+		logger.Logf(DebugLevel, "assignment of variation group %s is expired", vgID)
+		if active == nil {
+			active = assignments.clone()
+		}
+		delete(active.Assignments, vgID)
+	}
+	if active == nil {
+		return assignments
+	}
+	return active
+}
+
+// isExpired returns true if all the assignments are expired according to the TTL set on save
+func (va *VisitorAssignments) isExpired(now time.Time) bool {
+	if va == nil || va.TTL <= 0 || va.Timestamp <= 0 {
+		return false
+	}
+	return now.Sub(time.Unix(va.Timestamp, 0)) > va.TTL
+}
+
+// removeExpired returns the assignments of all the IDs without the expired ones
+func (a allVisitorAssignments) removeExpired(policy *AssignmentTTLPolicy, now time.Time) allVisitorAssignments {
+	return allVisitorAssignments{
+		Standard:      policy.removeExpired(a.Standard, now),
+		Anonymous:     policy.removeExpired(a.Anonymous, now),
+		DecisionGroup: policy.removeExpired(a.DecisionGroup, now),
+	}
+}
@@ -0,0 +1,177 @@
+package decision
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func createTTLEnvironment() Environment {
+	return Environment{
+		ID:            "env_id",
+		CacheEnabled:  true,
+		AssignmentTTL: 24 * time.Hour,
+		Campaigns: []*Campaign{
+			{
+				ID:            "c_ttl",
+				Priority:      1,
+				AssignmentTTL: time.Hour,
+				BucketRanges:  [][]float64{{0., 100.}},
+				VariationGroups: []*VariationGroup{
+					{
+						ID:         "vg_ttl",
+						Targetings: createBoolTargeting(),
+						Variations: []*Variation{{ID: "v1", Allocation: 0}, {ID: "v2", Allocation: 100}},
+					},
+				},
+			},
+			{
+				ID:           "c_default",
+				BucketRanges: [][]float64{{0., 100.}},
+				VariationGroups: []*VariationGroup{
+					{
+						ID:         "vg_default",
+						Targetings: createBoolTargeting(),
+						Variations: []*Variation{{ID: "v1", Allocation: 0}, {ID: "v2", Allocation: 100}},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestAssignmentTTLPolicy(t *testing.T) {
+	policy := compileEnvironment(createTTLEnvironment()).AssignmentTTLPolicy()
+	assert.Equal(t, time.Hour, policy.TTL("vg_ttl"))
+	assert.Equal(t, 24*time.Hour, policy.TTL("vg_default"))
+	assert.Equal(t, 24*time.Hour, policy.TTL("unknown"))
+
+	now := time.Now()
+	assert.Equal(t, 24*time.Hour, policy.AssignmentsTTL(map[string]*VisitorCache{"vg_ttl": {}, "vg_default": {}}, now))
+	assert.Equal(t, time.Hour, policy.AssignmentsTTL(map[string]*VisitorCache{"vg_ttl": {}}, now))
+	assert.Equal(t, 23*time.Hour, policy.AssignmentsTTL(map[string]*VisitorCache{"vg_default": {AssignedAt: now.Add(-time.Hour).Unix()}}, now))
+	assert.Equal(t, time.Second, policy.AssignmentsTTL(map[string]*VisitorCache{"vg_ttl": {AssignedAt: now.Add(-time.Hour).Unix()}}, now))
+
+	assignments := &VisitorAssignments{
+		Timestamp: now.Add(-2 * time.Hour).Unix(),
+		Assignments: map[string]*VisitorCache{
+			"vg_ttl":     {VariationID: "v1"},
+			"vg_default": {VariationID: "v1"},
+		},
+	}
+	assert.True(t, policy.IsExpired(assignments, "vg_ttl", now))
+	assert.False(t, policy.IsExpired(assignments, "vg_default", now))
+	assert.False(t, policy.IsExpired(&VisitorAssignments{}, "vg_ttl", now))
+	assert.False(t, policy.IsExpired(nil, "vg_ttl", now))
+
+	// The assignment timestamp takes precedence over the assignments one
+	assignments.Assignments["vg_ttl"].AssignedAt = now.Unix()
+	assert.False(t, policy.IsExpired(assignments, "vg_ttl", now))
+	assignments.Assignments["vg_ttl"].AssignedAt = 0
+
+	active := policy.removeExpired(assignments, now)
+	assert.Len(t, active.Assignments, 1)
+	assert.Contains(t, active.Assignments, "vg_default")
+	assert.Len(t, assignments.Assignments, 2)
+
+	// Environments without TTL never expire
+	var noPolicy *AssignmentTTLPolicy
+	assert.Equal(t, time.Duration(0), noPolicy.TTL("vg_ttl"))
+	assert.Equal(t, time.Duration(0), noPolicy.AssignmentsTTL(assignments.Assignments, now))
+	assert.Same(t, assignments, noPolicy.removeExpired(assignments, now))
+	policy = compileEnvironment(Environment{}).AssignmentTTLPolicy()
+	assert.Equal(t, time.Duration(0), policy.AssignmentsTTL(assignments.Assignments, now))
+}
+
+func TestDecisionAssignmentTTL(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryAssignmentStore(0)
+	assert.Nil(t, store.Save(ctx, "env_id", "vis1", &VisitorAssignments{
+		Timestamp: time.Now().Add(-2 * time.Hour).Unix(),
+		Assignments: map[string]*VisitorCache{
+			"vg_ttl":     {VariationID: "v1", Activated: true},
+			"vg_default": {VariationID: "v1", Activated: true},
+			"vg_deleted": {VariationID: "v1", Activated: true},
+		},
+	}))
+
+	explanation := &DecisionExplanation{}
+	decision, err := GetDecision(createBatchVisitor("vis1", true), createTTLEnvironment(), DecisionOptions{Explanation: explanation}, DecisionHandlers{AssignmentStore: store})
+	assert.Nil(t, err)
+	assert.Len(t, decision.Campaigns, 2)
+
+	// The expired assignment is allocated again
+	ce, _ := explanation.Campaign("c_ttl")
+	assert.Equal(t, "v2", ce.VariationID)
+	assert.Equal(t, VariationSourceAllocation, ce.Source)
+
+	ce, _ = explanation.Campaign("c_default")
+	assert.Equal(t, "v1", ce.VariationID)
+	assert.Equal(t, VariationSourceCache, ce.Source)
+
+	// The new assignment is saved with the assignments TTL, and unknown variation groups use the environment TTL.
+	// The kept assignments are still counted from their previous save
+	a, _ := store.Get(ctx, "env_id", "vis1")
+	assert.Equal(t, "v2", a.Assignments["vg_ttl"].VariationID)
+	assert.Equal(t, "v1", a.Assignments["vg_default"].VariationID)
+	assert.InDelta(t, time.Now().Add(-2*time.Hour).Unix(), a.Assignments["vg_default"].AssignedAt, 1)
+	assert.Contains(t, a.Assignments, "vg_deleted")
+	assert.InDelta(t, 22*time.Hour, a.TTL, float64(time.Minute))
+
+	// Expired assignments are dropped on save
+	expired := &VisitorAssignments{
+		Timestamp:   time.Now().Add(-48 * time.Hour).Unix(),
+		Assignments: map[string]*VisitorCache{"vg_deleted": {VariationID: "v1"}},
+	}
+	merged := mergeAssignments(expired, map[string]*VisitorCache{"vg_ttl": {VariationID: "v2"}}, time.Now(), &compileEnvironment(createTTLEnvironment()).environment)
+	assert.Len(t, merged.Assignments, 1)
+	assert.Equal(t, time.Hour, merged.TTL)
+}
+
+func TestAssignmentTTLPerAssignment(t *testing.T) {
+	env := &compileEnvironment(createTTLEnvironment()).environment
+	now := time.Now()
+
+	// The first variation group is saved 20 minutes before the second one
+	saved := mergeAssignments(nil, map[string]*VisitorCache{"vg_ttl": {VariationID: "v1"}}, now.Add(-80*time.Minute), env)
+	saved = mergeAssignments(saved, map[string]*VisitorCache{"vg_default": {VariationID: "v1"}}, now.Add(-time.Hour), env)
+	assert.Equal(t, now.Add(-80*time.Minute).Unix(), saved.Assignments["vg_ttl"].AssignedAt)
+	assert.Equal(t, now.Add(-time.Hour).Unix(), saved.Assignments["vg_default"].AssignedAt)
+
+	// Saving another assignment or the same variation again does not extend the TTL of the older one
+	saved = mergeAssignments(saved, map[string]*VisitorCache{"vg_default": {VariationID: "v1", Activated: true}}, now.Add(-30*time.Minute), env)
+	assert.Equal(t, now.Add(-time.Hour).Unix(), saved.Assignments["vg_default"].AssignedAt)
+	assert.Equal(t, now.Add(-30*time.Minute).Unix(), saved.Timestamp)
+
+	assert.True(t, env.assignmentTTLPolicy.IsExpired(saved, "vg_ttl", now))
+	assert.False(t, env.assignmentTTLPolicy.IsExpired(saved, "vg_default", now))
+	active := env.assignmentTTLPolicy.removeExpired(saved, now)
+	assert.Len(t, active.Assignments, 1)
+	assert.Contains(t, active.Assignments, "vg_default")
+
+	// A new variation restarts the TTL
+	saved = mergeAssignments(saved, map[string]*VisitorCache{"vg_default": {VariationID: "v2"}}, now, env)
+	assert.Equal(t, now.Unix(), saved.Assignments["vg_default"].AssignedAt)
+	assert.NotContains(t, saved.Assignments, "vg_ttl")
+}
+
+func TestMemoryAssignmentStoreTTL(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryAssignmentStore(0)
+
+	assert.Nil(t, store.Save(ctx, "env", "expired", &VisitorAssignments{Timestamp: time.Now().Add(-2 * time.Hour).Unix(), TTL: time.Hour}))
+	assert.Nil(t, store.Save(ctx, "env", "active", &VisitorAssignments{Timestamp: time.Now().Unix(), TTL: time.Hour}))
+	assert.Nil(t, store.Save(ctx, "env", "sticky", &VisitorAssignments{Timestamp: time.Now().Add(-2 * time.Hour).Unix()}))
+
+	results, err := store.BatchGet(ctx, "env", []string{"expired", "active", "sticky"})
+	assert.Nil(t, err)
+	assert.Len(t, results, 2)
+	assert.NotContains(t, results, "expired")
+	assert.Equal(t, 2, store.Len())
+
+	// Expired assignments are considered absent by compare and save
+	assert.Nil(t, store.Save(ctx, "env", "expired", &VisitorAssignments{Timestamp: time.Now().Add(-2 * time.Hour).Unix(), TTL: time.Hour}))
+	assert.Nil(t, store.CompareAndSave(ctx, "env", "expired", &VisitorAssignments{Timestamp: time.Now().Unix()}))
+}
@@ -0,0 +1,130 @@
+package decision
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// CacheFailurePolicy defines how the decision behaves when the cached assignments fail to load
+type CacheFailurePolicy int
+
+const (
+	// CacheFailureEmpty returns an empty decision without error. It is the default policy
+	CacheFailureEmpty CacheFailurePolicy = iota
+	// CacheFailureOpen decides as if there were no cache: cached assignments are ignored and new ones are not saved
+	CacheFailureOpen
+	// CacheFailureClosed returns an empty decision with the cache error
+	CacheFailureClosed
+	// CacheFailurePartial decides with the cached assignments that loaded successfully.
+	// New assignments are not saved for the IDs that failed to load
+	CacheFailurePartial
+)
+
+// CacheError aggregates the errors that occurred when loading the cached assignments of each ID type.
+// A nil field means that the assignments of this ID type loaded successfully, or were not needed
+type CacheError struct {
+	Standard      error
+	Anonymous     error
+	DecisionGroup error
+}
+
+// Error returns the errors of each failed ID type
+func (e *CacheError) Error() string {
+	messages := []string{}
+	if e.Standard != nil {
+		messages = append(messages, fmt.Sprintf("standard ID: %v", e.Standard))
+	}
+	if e.Anonymous != nil {
+		messages = append(messages, fmt.Sprintf("anonymous ID: %v", e.Anonymous))
+	}
+	if e.DecisionGroup != nil {
+		messages = append(messages, fmt.Sprintf("decision group: %v", e.DecisionGroup))
+	}
+	return "error when getting cached assignments for " + strings.Join(messages, ", ")
+}
+
+// Unwrap returns the errors of each failed ID type, to be used with errors.Is and errors.As
+func (e *CacheError) Unwrap() []error {
+	errs := []error{}
+	for _, err := range []error{e.Standard, e.Anonymous, e.DecisionGroup} {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// setError sets the error of an ID type
+func (e *CacheError) setError(idType string, err error) {
+	switch idType {
+	case "standard":
+		e.Standard = err
+	case "anonymous":
+		e.Anonymous = err
+	case "decisionGroup":
+		e.DecisionGroup = err
+	}
+}
+
+// hasError returns true if any ID type failed
+func (e *CacheError) hasError() bool {
+	return e != nil && (e.Standard != nil || e.Anonymous != nil || e.DecisionGroup != nil)
+}
+
+// getCacheFailurePolicy returns the cache failure policy of the decision options if set, or the one of the environment
+func getCacheFailurePolicy(environmentInfos Environment, options DecisionOptions) CacheFailurePolicy {
+	if options.CacheFailurePolicy != nil {
+		return *options.CacheFailurePolicy
+	}
+	return environmentInfos.CacheFailurePolicy
+}
+
+// handleCacheError applies the cache failure policy when the cached assignments failed to load.
+// It returns true if the decision should stop and return the empty response, along with the error to return
+func (vd *visitorDecision) handleCacheError(policy CacheFailurePolicy, err error, allCacheAssignments *allVisitorAssignments) (bool, error) {
+	switch policy {
+	case CacheFailureOpen:
+		logger.Logf(WarnLevel, "error occured when getting cached assignments, deciding without cache: %v", err)
+		*allCacheAssignments = allVisitorAssignments{}
+		vd.enableCache = false
+		return false, nil
+	case CacheFailureClosed:
+		logger.Logf(ErrorLevel, "error occured when getting cached assignments: %v", err)
+		return true, err
+	case CacheFailurePartial:
+		logger.Logf(WarnLevel, "error occured when getting cached assignments, deciding with loaded assignments: %v", err)
+		var cacheErr *CacheError
+		if !errors.As(err, &cacheErr) {
+			// The failed ID types are unknown, so no assignment can be trusted
+			cacheErr = &CacheError{Standard: err, Anonymous: err, DecisionGroup: err}
+			*allCacheAssignments = allVisitorAssignments{}
+		}
+		vd.cacheError = cacheErr
+		return false, nil
+	default:
+		logger.Logf(ErrorLevel, "error occured when getting cached assignments: %v", err)
+		return true, nil
+	}
+}
+
+// getSaveID returns the ID to save the new assignments for, or an empty ID if its cached assignments failed to load,
+// so that assignments that could not be read are not overwritten
+func (vd *visitorDecision) getSaveID(id string, idType string) string {
+	if vd.cacheError == nil {
+		return id
+	}
+	var err error
+	switch idType {
+	case "standard":
+		err = vd.cacheError.Standard
+	case "anonymous":
+		err = vd.cacheError.Anonymous
+	case "decisionGroup":
+		err = vd.cacheError.DecisionGroup
+	}
+	if err != nil {
+		return ""
+	}
+	return id
+}
@@ -0,0 +1,155 @@
+package decision
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errCacheTest = errors.New("cache error")
+
+func TestGetCacheError(t *testing.T) {
+	failingGetCache := func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+		if id == "visitor_id" {
+			return &VisitorAssignments{Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1"}}}, nil
+		}
+		return nil, errCacheTest
+	}
+
+	assignments, err := getCache(context.Background(), "env_id", "visitor_id", "anonymous_id", "decisionGroup", true, failingGetCache)
+	cacheErr := &CacheError{}
+	assert.ErrorAs(t, err, &cacheErr)
+	assert.ErrorIs(t, err, errCacheTest)
+	assert.Nil(t, cacheErr.Standard)
+	assert.Equal(t, errCacheTest, cacheErr.Anonymous)
+	assert.Equal(t, errCacheTest, cacheErr.DecisionGroup)
+	assert.Equal(t, "error when getting cached assignments for anonymous ID: cache error, decision group: cache error", err.Error())
+
+	// Assignments that loaded successfully are kept
+	assert.Equal(t, "v1", assignments.Standard.getAssignments()["vg1"].VariationID)
+	assert.Nil(t, assignments.Anonymous)
+	assert.Nil(t, assignments.DecisionGroup)
+
+	// The standard error should not be hidden by the other lookups
+	assignments, err = getCache(context.Background(), "env_id", "anonymous_id", "visitor_id", "", true, failingGetCache)
+	assert.ErrorAs(t, err, &cacheErr)
+	assert.Equal(t, errCacheTest, cacheErr.Standard)
+	assert.Nil(t, cacheErr.Anonymous)
+	assert.Nil(t, cacheErr.DecisionGroup)
+	assert.Nil(t, assignments.Standard)
+	assert.NotNil(t, assignments.Anonymous)
+}
+
+func TestGetDecisionCacheFailurePolicy(t *testing.T) {
+	vi := createBatchVisitor("vis1", true)
+	vi.AnonymousID = "anon1"
+
+	var mu sync.Mutex
+	var saves []string
+	handlers := DecisionHandlers{
+		GetCache: func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+			if id == "anon1" {
+				return nil, errCacheTest
+			}
+			return &VisitorAssignments{Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v2"}}}, nil
+		},
+		SaveCache: func(ctx context.Context, environmentID string, id string, assignments *VisitorAssignments) error {
+			mu.Lock()
+			defer mu.Unlock()
+			saves = append(saves, id)
+			return nil
+		},
+	}
+
+	decide := func(env Environment, options DecisionOptions) (int, error) {
+		saves = nil
+		decision, err := GetDecision(vi, env, options, handlers)
+		assert.Equal(t, "vis1", decision.VisitorId.Value)
+		return len(decision.Campaigns), err
+	}
+
+	// By default, the decision is empty without error
+	env := createBatchEnvironment()
+	nbCampaigns, err := decide(env, DecisionOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, nbCampaigns)
+	assert.Len(t, saves, 0)
+
+	env.CacheFailurePolicy = CacheFailureClosed
+	nbCampaigns, err = decide(env, DecisionOptions{})
+	cacheErr := &CacheError{}
+	assert.ErrorAs(t, err, &cacheErr)
+	assert.Nil(t, cacheErr.Standard)
+	assert.Equal(t, errCacheTest, cacheErr.Anonymous)
+	assert.Equal(t, 0, nbCampaigns)
+	assert.Len(t, saves, 0)
+
+	// Fail open decides without cache, and does not save
+	env.CacheFailurePolicy = CacheFailureOpen
+	nbCampaigns, err = decide(env, DecisionOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, nbCampaigns)
+	assert.Len(t, saves, 0)
+
+	// Options override the environment policy. Partial decides with the standard cache, and does not save the failed anonymous ID
+	policy := CacheFailurePartial
+	env.CacheFailurePolicy = CacheFailureClosed
+	explanation := &DecisionExplanation{}
+	nbCampaigns, err = decide(env, DecisionOptions{TriggerHit: true, CacheFailurePolicy: &policy, Explanation: explanation})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, nbCampaigns)
+	ce, _ := explanation.Campaign("c1")
+	assert.Equal(t, "v2", ce.VariationID)
+	assert.Equal(t, VariationSourceCache, ce.Source)
+	assert.Equal(t, []string{"vis1"}, saves)
+}
+
+func TestGetDecisionsCacheFailurePolicy(t *testing.T) {
+	visitors := []Visitor{
+		createBatchVisitor("vis1", true),
+		createBatchVisitor("vis2", true),
+	}
+
+	var mu sync.Mutex
+	var saves map[string]*VisitorAssignments
+	handlers := BatchDecisionHandlers{
+		BatchGetCache: func(ctx context.Context, environmentID string, ids []string) (map[string]*VisitorAssignments, error) {
+			return map[string]*VisitorAssignments{
+				"vis1": {Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v2"}}},
+			}, errCacheTest
+		},
+		BatchSaveCache: func(ctx context.Context, environmentID string, assignments map[string]*VisitorAssignments) error {
+			mu.Lock()
+			defer mu.Unlock()
+			saves = assignments
+			return nil
+		},
+	}
+
+	// Visitors whose assignments are missing are considered failed
+	env := createBatchEnvironment()
+	env.CacheFailurePolicy = CacheFailureClosed
+	results, err := GetDecisions(visitors, env, DecisionOptions{TriggerHit: true}, handlers)
+	assert.Nil(t, err)
+	assert.Nil(t, results[0].Err)
+	assert.Len(t, results[0].Response.Campaigns, 1)
+	cacheErr := &CacheError{}
+	assert.ErrorAs(t, results[1].Err, &cacheErr)
+	assert.Equal(t, errCacheTest, cacheErr.Standard)
+	assert.Len(t, results[1].Response.Campaigns, 0)
+
+	env.CacheFailurePolicy = CacheFailurePartial
+	saves = nil
+	results, err = GetDecisions(visitors, env, DecisionOptions{TriggerHit: true}, handlers)
+	assert.Nil(t, err)
+	for _, r := range results {
+		assert.Nil(t, r.Err)
+		assert.Len(t, r.Response.Campaigns, 1)
+	}
+	assert.Equal(t, "v2", results[0].Response.Campaigns[0].Variation.Id.Value)
+	assert.Contains(t, saves, "vis1")
+	assert.NotContains(t, saves, "vis2")
+}
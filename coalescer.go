@@ -0,0 +1,167 @@
+package decision
+
+import (
+	"context"
+	"sync"
+)
+
+// CacheCoalescer wraps the cache handlers so that concurrent lookups of the same environment and ID share one in-flight fetch,
+// and saves of the same environment and ID are serialized.
+// Use its GetCache, SaveCache and CompareAndSaveCache methods as decision handlers,
+// so that a burst of decisions for one visitor produces one consistent assignment set
+type CacheCoalescer struct {
+	getCache            func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error)
+	saveCache           func(ctx context.Context, environmentID string, id string, assignment *VisitorAssignments) error
+	compareAndSaveCache func(ctx context.Context, environmentID string, id string, assignment *VisitorAssignments) error
+
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+	locks map[string]*keyLock
+}
+
+// coalescedCall stores the result of a fetch shared by concurrent lookups
+type coalescedCall struct {
+	done        chan struct{}
+	assignments *VisitorAssignments
+	err         error
+	// callers is the number of lookups sharing the fetch
+	callers int
+}
+
+// keyLock serializes the saves of a key, and is removed once no save is waiting for it
+type keyLock struct {
+	mu      sync.Mutex
+	waiters int
+}
+
+// NewCacheCoalescer creates a coalescer wrapping the GetCache, SaveCache and CompareAndSaveCache handlers, or the AssignmentStore
+func NewCacheCoalescer(handlers DecisionHandlers) *CacheCoalescer {
+	handlers = handlers.withAssignmentStore()
+	return &CacheCoalescer{
+		getCache:            handlers.GetCache,
+		saveCache:           handlers.SaveCache,
+		compareAndSaveCache: handlers.CompareAndSaveCache,
+		calls:               map[string]*coalescedCall{},
+		locks:               map[string]*keyLock{},
+	}
+}
+
+// Handlers returns the decision handlers with the cache handlers replaced by the coalescer ones
+func (c *CacheCoalescer) Handlers(handlers DecisionHandlers) DecisionHandlers {
+	handlers.AssignmentStore = nil
+	handlers.GetCache = c.GetCache
+	handlers.SaveCache = c.SaveCache
+	handlers.CompareAndSaveCache = nil
+	if c.compareAndSaveCache != nil {
+		handlers.CompareAndSaveCache = c.CompareAndSaveCache
+	}
+	return handlers
+}
+
+// GetCache returns a copy of the assignments of the ID, sharing the fetch with the concurrent lookups of the same ID.
+// The shared fetch is not cancelled when the context of a caller is done
+func (c *CacheCoalescer) GetCache(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+	if c.getCache == nil {
+		return nil, OperationNotSupportedError
+	}
+
+	key := assignmentsKey(environmentID, id)
+	c.mu.Lock()
+	call, ok := c.calls[key]
+	if !ok {
+		call = &coalescedCall{done: make(chan struct{})}
+		c.calls[key] = call
+		go c.fetch(context.WithoutCancel(ctx), environmentID, id, key, call)
+	} else {
+		logger.Logf(DebugLevel, "sharing in-flight assignments fetch for %s", id)
+	}
+	call.callers++
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.assignments.clone(), call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// SaveCache saves the assignments of the ID once the previous saves of the ID are done.
+// As concurrent decisions compute their assignments from the same shared fetch, the stored assignments are reloaded first,
+// and if they were saved since the assignments were loaded, the assignments are merged into them,
+// so that the assignments of the previous saves are kept. Stores without versions are always merged into
+func (c *CacheCoalescer) SaveCache(ctx context.Context, environmentID string, id string, assignments *VisitorAssignments) error {
+	if c.saveCache == nil {
+		return OperationNotSupportedError
+	}
+
+	unlock := c.lock(assignmentsKey(environmentID, id))
+	defer unlock()
+
+	if c.getCache != nil {
+		stored, err := c.getCache(ctx, environmentID, id)
+		if err != nil {
+			return err
+		}
+		if isSavedSince(stored, assignments) {
+			logger.Logf(DebugLevel, "assignments of %s saved since they were loaded, merging them", id)
+			assignments = mergeQueuedAssignments(stored, assignments)
+		}
+	}
+	return c.saveCache(ctx, environmentID, id, assignments)
+}
+
+// CompareAndSaveCache compares and saves the assignments of the ID once the previous saves of the ID are done
+func (c *CacheCoalescer) CompareAndSaveCache(ctx context.Context, environmentID string, id string, assignments *VisitorAssignments) error {
+	if c.compareAndSaveCache == nil {
+		return OperationNotSupportedError
+	}
+
+	unlock := c.lock(assignmentsKey(environmentID, id))
+	defer unlock()
+
+	return c.compareAndSaveCache(ctx, environmentID, id, assignments)
+}
+
+// isSavedSince returns true if the stored assignments may have been saved since the assignments were loaded,
+// because their version changed or is unknown
+func isSavedSince(stored *VisitorAssignments, assignments *VisitorAssignments) bool {
+	if stored == nil {
+		return false
+	}
+	return assignments == nil || assignments.Version == 0 || stored.Version != assignments.Version
+}
+
+// fetch gets the assignments of the ID and shares the result with the waiting lookups
+func (c *CacheCoalescer) fetch(ctx context.Context, environmentID string, id string, key string, call *coalescedCall) {
+	call.assignments, call.err = c.getCache(ctx, environmentID, id)
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+	close(call.done)
+}
+
+// lock locks the saves of the key and returns the function to unlock them
+func (c *CacheCoalescer) lock(key string) func() {
+	c.mu.Lock()
+	l, ok := c.locks[key]
+	if !ok {
+		l = &keyLock{}
+		c.locks[key] = l
+	}
+	l.waiters++
+	c.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+
+		c.mu.Lock()
+		l.waiters--
+		if l.waiters == 0 {
+			delete(c.locks, key)
+		}
+		c.mu.Unlock()
+	}
+}
@@ -0,0 +1,235 @@
+package decision
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// waitCallers waits until the given number of lookups share the in-flight fetch of the key
+func waitCallers(coalescer *CacheCoalescer, key string, nbCallers int) {
+	for {
+		coalescer.mu.Lock()
+		call, ok := coalescer.calls[key]
+		registered := ok && call.callers >= nbCallers
+		coalescer.mu.Unlock()
+		if registered {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCacheCoalescerGetCache(t *testing.T) {
+	var nbFetches int32
+	var coalescer *CacheCoalescer
+	results := make([]*VisitorAssignments, 10)
+	coalescer = NewCacheCoalescer(DecisionHandlers{
+		GetCache: func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+			if atomic.AddInt32(&nbFetches, 1) == 1 {
+				waitCallers(coalescer, assignmentsKey(environmentID, id), len(results))
+			}
+			return &VisitorAssignments{Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1"}}}, nil
+		},
+	})
+
+	wg := sync.WaitGroup{}
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = coalescer.GetCache(context.Background(), "env_id", "vis1")
+		}(i)
+	}
+
+	// All the lookups share the same fetch
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&nbFetches))
+	for _, r := range results {
+		assert.Equal(t, "v1", r.Assignments["vg1"].VariationID)
+	}
+
+	// Each caller gets its own copy
+	results[0].Assignments["vg1"].VariationID = "v2"
+	assert.Equal(t, "v1", results[1].Assignments["vg1"].VariationID)
+
+	// Lookups after the fetch is done start a new fetch
+	_, err := coalescer.GetCache(context.Background(), "env_id", "vis1")
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&nbFetches))
+	assert.Len(t, coalescer.calls, 0)
+}
+
+func TestCacheCoalescerGetCacheContext(t *testing.T) {
+	release := make(chan struct{})
+	coalescer := NewCacheCoalescer(DecisionHandlers{
+		GetCache: func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+			<-release
+			return &VisitorAssignments{}, ctx.Err()
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := coalescer.GetCache(context.Background(), "env_id", "vis1")
+		done <- err
+	}()
+	assert.Eventually(t, func() bool {
+		coalescer.mu.Lock()
+		defer coalescer.mu.Unlock()
+		return len(coalescer.calls) == 1
+	}, time.Second, time.Millisecond)
+
+	// A cancelled caller returns without cancelling the shared fetch
+	cancel()
+	_, err := coalescer.GetCache(ctx, "env_id", "vis1")
+	assert.Equal(t, context.Canceled, err)
+
+	close(release)
+	assert.Nil(t, <-done)
+
+	_, err = NewCacheCoalescer(DecisionHandlers{}).GetCache(context.Background(), "env_id", "vis1")
+	assert.Equal(t, OperationNotSupportedError, err)
+}
+
+func TestCacheCoalescerSaveCache(t *testing.T) {
+	store := NewMemoryAssignmentStore(0)
+	var running, maxRunning int32
+	coalescer := NewCacheCoalescer(DecisionHandlers{
+		GetCache: store.Get,
+		SaveCache: func(ctx context.Context, environmentID string, id string, assignments *VisitorAssignments) error {
+			if n := atomic.AddInt32(&running, 1); n > atomic.LoadInt32(&maxRunning) {
+				atomic.StoreInt32(&maxRunning, n)
+			}
+			defer atomic.AddInt32(&running, -1)
+			time.Sleep(time.Millisecond)
+			return store.Save(ctx, environmentID, id, assignments)
+		},
+	})
+
+	// Concurrent saves are serialized
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := coalescer.SaveCache(context.Background(), "env_id", "vis1", &VisitorAssignments{
+				Assignments: map[string]*VisitorCache{fmt.Sprintf("vg%d", i): {VariationID: "v1"}},
+			})
+			assert.Nil(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	// Concurrent saves computed from the same stored assignments are merged into each other
+	assert.Equal(t, int32(1), atomic.LoadInt32(&maxRunning))
+	saved, _ := store.Get(context.Background(), "env_id", "vis1")
+	assert.Len(t, saved.Assignments, 5)
+	assert.Len(t, coalescer.locks, 0)
+
+	// Saves of unchanged stored assignments are not merged into them, so that the ones dropped by the decision merge stay dropped
+	env := &compileEnvironment(createTTLEnvironment()).environment
+	assert.Nil(t, store.Save(context.Background(), "env_id", "vis3", &VisitorAssignments{
+		Timestamp:   time.Now().Add(-2 * time.Hour).Unix(),
+		Assignments: map[string]*VisitorCache{"vg_ttl": {VariationID: "v1"}},
+	}))
+	expired, _ := store.Get(context.Background(), "env_id", "vis3")
+	merged := mergeAssignments(expired, map[string]*VisitorCache{"vg_default": {VariationID: "v1"}}, time.Now(), env)
+	assert.Nil(t, coalescer.SaveCache(context.Background(), "env_id", "vis3", merged))
+	saved, _ = store.Get(context.Background(), "env_id", "vis3")
+	assert.Len(t, saved.Assignments, 1)
+	assert.Contains(t, saved.Assignments, "vg_default")
+	assert.Equal(t, merged.TTL, saved.TTL)
+
+	// Saves of different IDs are not serialized together
+	unlock := coalescer.lock(assignmentsKey("env_id", "vis1"))
+	assert.Nil(t, coalescer.SaveCache(context.Background(), "env_id", "vis2", &VisitorAssignments{}))
+	unlock()
+
+	saved, _ = store.Get(context.Background(), "env_id", "vis2")
+	assert.NotNil(t, saved)
+	assert.Equal(t, OperationNotSupportedError, NewCacheCoalescer(DecisionHandlers{}).SaveCache(context.Background(), "env_id", "vis1", nil))
+}
+
+func TestCacheCoalescerDecisions(t *testing.T) {
+	store := NewMemoryAssignmentStore(0)
+	var nbFetches int32
+	var coalescer *CacheCoalescer
+	coalescer = NewCacheCoalescer(DecisionHandlers{
+		GetCache: func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+			if atomic.AddInt32(&nbFetches, 1) == 1 {
+				waitCallers(coalescer, assignmentsKey(environmentID, id), 5)
+			}
+			return store.Get(ctx, environmentID, id)
+		},
+		SaveCache:           store.Save,
+		CompareAndSaveCache: store.CompareAndSave,
+	})
+	handlers := coalescer.Handlers(DecisionHandlers{AssignmentStore: store})
+	assert.Nil(t, handlers.AssignmentStore)
+	assert.NotNil(t, handlers.CompareAndSaveCache)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			decision, err := GetDecision(createBatchVisitor("vis1", true), createBatchEnvironment(), DecisionOptions{}, handlers)
+			assert.Nil(t, err)
+			assert.Len(t, decision.Campaigns, 1)
+		}()
+	}
+	wg.Wait()
+
+	// The burst of decisions produces one assignment set
+	saved, _ := store.Get(context.Background(), "env_id", "vis1")
+	assert.Len(t, saved.Assignments, 1)
+}
+
+func TestCacheCoalescerDecisionsCampaigns(t *testing.T) {
+	store := NewMemoryAssignmentStore(0)
+	nbDecisions := 6
+	var nbFetches int32
+	var coalescer *CacheCoalescer
+	coalescer = NewCacheCoalescer(DecisionHandlers{
+		GetCache: func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+			if atomic.AddInt32(&nbFetches, 1) == 1 {
+				waitCallers(coalescer, assignmentsKey(environmentID, id), nbDecisions)
+			}
+			return store.Get(ctx, environmentID, id)
+		},
+		SaveCache: store.Save,
+	})
+	handlers := coalescer.Handlers(DecisionHandlers{})
+	assert.Nil(t, handlers.CompareAndSaveCache)
+
+	// Concurrent decisions for different campaigns all read the same shared fetch
+	wg := sync.WaitGroup{}
+	for i := 0; i < nbDecisions; i++ {
+		env := createBatchEnvironment()
+		env.Campaigns[0].ID = fmt.Sprintf("c%d", i)
+		env.Campaigns[0].VariationGroups[0].ID = fmt.Sprintf("vg%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			decision, err := GetDecision(createBatchVisitor("vis1", true), env, DecisionOptions{}, handlers)
+			assert.Nil(t, err)
+			assert.Len(t, decision.Campaigns, 1)
+		}()
+	}
+	wg.Wait()
+
+	// The assignments of every decision are stored
+	saved, _ := store.Get(context.Background(), "env_id", "vis1")
+	assert.Len(t, saved.Assignments, nbDecisions)
+	for i := 0; i < nbDecisions; i++ {
+		assert.Contains(t, saved.Assignments, fmt.Sprintf("vg%d", i))
+	}
+}
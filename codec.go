@@ -0,0 +1,441 @@
+package decision
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// AssignmentsSchemaVersion is the schema version embedded in the payloads encoded by the assignments codecs
+const AssignmentsSchemaVersion = 1
+
+// InvalidPayloadError is returned when an assignments payload cannot be decoded
+var InvalidPayloadError = errors.New("invalid assignments payload")
+
+// AssignmentsCodec encodes and decodes the visitor assignments to share them between services.
+// Payloads embed their schema version, and decoding ignores unknown fields so that newer payloads can be read by older codecs
+type AssignmentsCodec interface {
+	Encode(assignments *VisitorAssignments) ([]byte, error)
+	Decode(data []byte) (*VisitorAssignments, error)
+}
+
+type jsonCodec struct{}
+
+type jsonVisitorCache struct {
+	VariationID string `json:"v"`
+	Activated   bool   `json:"a,omitempty"`
+	AssignedAt  int64  `json:"at,omitempty"`
+}
+
+type jsonHistoryEntry struct {
+	VariationID string `json:"v"`
+	FirstSeen   int64  `json:"f,omitempty"`
+	LastSeen    int64  `json:"l,omitempty"`
+}
+
+type jsonVisitorAssignments struct {
+	SchemaVersion int                           `json:"s"`
+	Timestamp     int64                         `json:"t,omitempty"`
+	Version       int64                         `json:"ver,omitempty"`
+	TTL           int64                         `json:"ttl,omitempty"`
+	Assignments   map[string]*jsonVisitorCache  `json:"a"`
+	History       map[string][]jsonHistoryEntry `json:"h,omitempty"`
+}
+
+// NewJSONCodec creates a codec encoding the assignments as compact JSON.
+// The TTL is encoded in milliseconds
+func NewJSONCodec() AssignmentsCodec {
+	return jsonCodec{}
+}
+
+func (jsonCodec) Encode(assignments *VisitorAssignments) ([]byte, error) {
+	if assignments == nil {
+		assignments = &VisitorAssignments{}
+	}
+
+	payload := jsonVisitorAssignments{
+		SchemaVersion: AssignmentsSchemaVersion,
+		Timestamp:     assignments.Timestamp,
+		Version:       assignments.Version,
+		TTL:           assignments.TTL.Milliseconds(),
+		Assignments:   make(map[string]*jsonVisitorCache, len(assignments.Assignments)),
+	}
+	for vgID, a := range assignments.Assignments {
+		if a != nil {
+			payload.Assignments[vgID] = &jsonVisitorCache{VariationID: a.VariationID, Activated: a.Activated, AssignedAt: a.AssignedAt}
+		}
+	}
+	payload.History = encodeJSONHistory(assignments.History)
+	return json.Marshal(payload)
+}
+
+func (jsonCodec) Decode(data []byte) (*VisitorAssignments, error) {
+	payload := jsonVisitorAssignments{}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, fmt.Errorf("%w: %v", InvalidPayloadError, err)
+	}
+	if payload.SchemaVersion < 1 {
+		return nil, fmt.Errorf("%w: missing schema version", InvalidPayloadError)
+	}
+
+	assignments := &VisitorAssignments{
+		Timestamp:   payload.Timestamp,
+		Version:     payload.Version,
+		TTL:         time.Duration(payload.TTL) * time.Millisecond,
+		Assignments: make(map[string]*VisitorCache, len(payload.Assignments)),
+	}
+	for vgID, a := range payload.Assignments {
+		if a != nil {
+			assignments.Assignments[vgID] = &VisitorCache{VariationID: a.VariationID, Activated: a.Activated, AssignedAt: a.AssignedAt}
+		}
+	}
+	assignments.History = decodeJSONHistory(payload.History)
+	return assignments, nil
+}
+
+// encodeJSONHistory returns the JSON payload of the history, nil if it is empty
+func encodeJSONHistory(history map[string][]AssignmentHistoryEntry) map[string][]jsonHistoryEntry {
+	if len(history) == 0 {
+		return nil
+	}
+
+	payload := make(map[string][]jsonHistoryEntry, len(history))
+	for vgID, entries := range history {
+		for _, e := range entries {
+			payload[vgID] = append(payload[vgID], jsonHistoryEntry{VariationID: e.VariationID, FirstSeen: e.FirstSeen, LastSeen: e.LastSeen})
+		}
+	}
+	return payload
+}
+
+// decodeJSONHistory returns the history of the JSON payload, nil if it is empty
+func decodeJSONHistory(payload map[string][]jsonHistoryEntry) map[string][]AssignmentHistoryEntry {
+	if len(payload) == 0 {
+		return nil
+	}
+
+	history := make(map[string][]AssignmentHistoryEntry, len(payload))
+	for vgID, entries := range payload {
+		for _, e := range entries {
+			history[vgID] = append(history[vgID], AssignmentHistoryEntry{VariationID: e.VariationID, FirstSeen: e.FirstSeen, LastSeen: e.LastSeen})
+		}
+	}
+	return history
+}
+
+// Protobuf field numbers of the assignments schema:
+//
+//	message VisitorAssignments {
+//	  uint32 schema_version = 1;
+//	  int64 timestamp = 2;
+//	  int64 version = 3;
+//	  int64 ttl_ms = 4;
+//	  map<string, VisitorCache> assignments = 5;
+//	  map<string, AssignmentHistory> history = 6;
+//	}
+//	message VisitorCache {
+//	  string variation_id = 1;
+//	  bool activated = 2;
+//	  int64 assigned_at = 3;
+//	}
+//	message AssignmentHistory {
+//	  repeated AssignmentHistoryEntry entries = 1;
+//	}
+//	message AssignmentHistoryEntry {
+//	  string variation_id = 1;
+//	  int64 first_seen = 2;
+//	  int64 last_seen = 3;
+//	}
+const (
+	protoSchemaVersionField protowire.Number = 1
+	protoTimestampField     protowire.Number = 2
+	protoVersionField       protowire.Number = 3
+	protoTTLField           protowire.Number = 4
+	protoAssignmentsField   protowire.Number = 5
+	protoHistoryField       protowire.Number = 6
+
+	protoMapKeyField   protowire.Number = 1
+	protoMapValueField protowire.Number = 2
+
+	protoVariationIDField protowire.Number = 1
+	protoActivatedField   protowire.Number = 2
+	protoAssignedAtField  protowire.Number = 3
+
+	protoHistoryEntriesField protowire.Number = 1
+	protoFirstSeenField      protowire.Number = 2
+	protoLastSeenField       protowire.Number = 3
+)
+
+type protobufCodec struct{}
+
+// NewProtobufCodec creates a codec encoding the assignments in protobuf binary format.
+// The TTL is encoded in milliseconds
+func NewProtobufCodec() AssignmentsCodec {
+	return protobufCodec{}
+}
+
+func (protobufCodec) Encode(assignments *VisitorAssignments) ([]byte, error) {
+	if assignments == nil {
+		assignments = &VisitorAssignments{}
+	}
+
+	var b []byte
+	b = protowire.AppendTag(b, protoSchemaVersionField, protowire.VarintType)
+	b = protowire.AppendVarint(b, AssignmentsSchemaVersion)
+	b = appendProtoInt64(b, protoTimestampField, assignments.Timestamp)
+	b = appendProtoInt64(b, protoVersionField, assignments.Version)
+	b = appendProtoInt64(b, protoTTLField, assignments.TTL.Milliseconds())
+
+	for vgID, a := range assignments.Assignments {
+		if a == nil {
+			continue
+		}
+		var value []byte
+		value = protowire.AppendTag(value, protoVariationIDField, protowire.BytesType)
+		value = protowire.AppendString(value, a.VariationID)
+		if a.Activated {
+			value = protowire.AppendTag(value, protoActivatedField, protowire.VarintType)
+			value = protowire.AppendVarint(value, protowire.EncodeBool(true))
+		}
+		value = appendProtoInt64(value, protoAssignedAtField, a.AssignedAt)
+
+		var entry []byte
+		entry = protowire.AppendTag(entry, protoMapKeyField, protowire.BytesType)
+		entry = protowire.AppendString(entry, vgID)
+		entry = protowire.AppendTag(entry, protoMapValueField, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, value)
+
+		b = protowire.AppendTag(b, protoAssignmentsField, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+
+	for vgID, entries := range assignments.History {
+		var value []byte
+		for _, e := range entries {
+			var historyEntry []byte
+			historyEntry = protowire.AppendTag(historyEntry, protoVariationIDField, protowire.BytesType)
+			historyEntry = protowire.AppendString(historyEntry, e.VariationID)
+			historyEntry = appendProtoInt64(historyEntry, protoFirstSeenField, e.FirstSeen)
+			historyEntry = appendProtoInt64(historyEntry, protoLastSeenField, e.LastSeen)
+
+			value = protowire.AppendTag(value, protoHistoryEntriesField, protowire.BytesType)
+			value = protowire.AppendBytes(value, historyEntry)
+		}
+
+		var entry []byte
+		entry = protowire.AppendTag(entry, protoMapKeyField, protowire.BytesType)
+		entry = protowire.AppendString(entry, vgID)
+		entry = protowire.AppendTag(entry, protoMapValueField, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, value)
+
+		b = protowire.AppendTag(b, protoHistoryField, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b, nil
+}
+
+func (protobufCodec) Decode(data []byte) (*VisitorAssignments, error) {
+	assignments := &VisitorAssignments{
+		Assignments: map[string]*VisitorCache{},
+	}
+
+	var schemaVersion uint64
+	err := consumeProtoFields(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == protoSchemaVersionField && typ == protowire.VarintType:
+			schemaVersion, _ = protowire.ConsumeVarint(value)
+		case num == protoTimestampField && typ == protowire.VarintType:
+			v, _ := protowire.ConsumeVarint(value)
+			assignments.Timestamp = int64(v)
+		case num == protoVersionField && typ == protowire.VarintType:
+			v, _ := protowire.ConsumeVarint(value)
+			assignments.Version = int64(v)
+		case num == protoTTLField && typ == protowire.VarintType:
+			v, _ := protowire.ConsumeVarint(value)
+			assignments.TTL = time.Duration(int64(v)) * time.Millisecond
+		case num == protoAssignmentsField && typ == protowire.BytesType:
+			entry, _ := protowire.ConsumeBytes(value)
+			vgID, a, err := decodeProtoAssignment(entry)
+			if err != nil {
+				return err
+			}
+			assignments.Assignments[vgID] = a
+		case num == protoHistoryField && typ == protowire.BytesType:
+			entry, _ := protowire.ConsumeBytes(value)
+			vgID, entries, err := decodeProtoHistory(entry)
+			if err != nil {
+				return err
+			}
+			if assignments.History == nil {
+				assignments.History = map[string][]AssignmentHistoryEntry{}
+			}
+			assignments.History[vgID] = entries
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if schemaVersion < 1 {
+		return nil, fmt.Errorf("%w: missing schema version", InvalidPayloadError)
+	}
+	return assignments, nil
+}
+
+// appendProtoInt64 appends the int64 field if it is not the default value
+func appendProtoInt64(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+// consumeProtoFields calls the handler for each field of the protobuf message, with the raw field value
+func consumeProtoFields(data []byte, handler func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return fmt.Errorf("%w: %v", InvalidPayloadError, protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		m := protowire.ConsumeFieldValue(num, typ, data)
+		if m < 0 {
+			return fmt.Errorf("%w: %v", InvalidPayloadError, protowire.ParseError(m))
+		}
+		if err := handler(num, typ, data[:m]); err != nil {
+			return err
+		}
+		data = data[m:]
+	}
+	return nil
+}
+
+// decodeProtoAssignment decodes an entry of the assignments map
+func decodeProtoAssignment(entry []byte) (string, *VisitorCache, error) {
+	var vgID string
+	a := &VisitorCache{}
+	err := consumeProtoFields(entry, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == protoMapKeyField && typ == protowire.BytesType:
+			vgID, _ = protowire.ConsumeString(value)
+		case num == protoMapValueField && typ == protowire.BytesType:
+			cache, _ := protowire.ConsumeBytes(value)
+			return consumeProtoFields(cache, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				switch {
+				case num == protoVariationIDField && typ == protowire.BytesType:
+					a.VariationID, _ = protowire.ConsumeString(value)
+				case num == protoActivatedField && typ == protowire.VarintType:
+					v, _ := protowire.ConsumeVarint(value)
+					a.Activated = protowire.DecodeBool(v)
+				case num == protoAssignedAtField && typ == protowire.VarintType:
+					v, _ := protowire.ConsumeVarint(value)
+					a.AssignedAt = int64(v)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return vgID, a, err
+}
+
+// decodeProtoHistory decodes an entry of the history map
+func decodeProtoHistory(entry []byte) (string, []AssignmentHistoryEntry, error) {
+	var vgID string
+	var entries []AssignmentHistoryEntry
+	err := consumeProtoFields(entry, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == protoMapKeyField && typ == protowire.BytesType:
+			vgID, _ = protowire.ConsumeString(value)
+		case num == protoMapValueField && typ == protowire.BytesType:
+			history, _ := protowire.ConsumeBytes(value)
+			return consumeProtoFields(history, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				if num != protoHistoryEntriesField || typ != protowire.BytesType {
+					return nil
+				}
+				historyEntry, _ := protowire.ConsumeBytes(value)
+				e := AssignmentHistoryEntry{}
+				err := consumeProtoFields(historyEntry, func(num protowire.Number, typ protowire.Type, value []byte) error {
+					switch {
+					case num == protoVariationIDField && typ == protowire.BytesType:
+						e.VariationID, _ = protowire.ConsumeString(value)
+					case num == protoFirstSeenField && typ == protowire.VarintType:
+						v, _ := protowire.ConsumeVarint(value)
+						e.FirstSeen = int64(v)
+					case num == protoLastSeenField && typ == protowire.VarintType:
+						v, _ := protowire.ConsumeVarint(value)
+						e.LastSeen = int64(v)
+					}
+					return nil
+				})
+				entries = append(entries, e)
+				return err
+			})
+		}
+		return nil
+	})
+	return vgID, entries, err
+}
+
+// gzipMagic starts every gzip payload
+var gzipMagic = []byte{0x1f, 0x8b}
+
+type compressedCodec struct {
+	codec AssignmentsCodec
+	level int
+}
+
+// NewCompressedCodec creates a codec compressing with gzip the payloads of the given codec, for large assignment maps.
+// Uncompressed payloads of the given codec are still decoded, to ease the migration from the uncompressed codec
+func NewCompressedCodec(codec AssignmentsCodec) AssignmentsCodec {
+	return compressedCodec{
+		codec: codec,
+		level: gzip.BestSpeed,
+	}
+}
+
+func (c compressedCodec) Encode(assignments *VisitorAssignments) ([]byte, error) {
+	data, err := c.codec.Encode(assignments)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c compressedCodec) Decode(data []byte) (*VisitorAssignments, error) {
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return c.codec.Decode(data)
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", InvalidPayloadError, err)
+	}
+	defer r.Close()
+
+	uncompressed, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", InvalidPayloadError, err)
+	}
+	return c.codec.Decode(uncompressed)
+}
@@ -0,0 +1,123 @@
+package decision
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func createCodecAssignments() *VisitorAssignments {
+	return &VisitorAssignments{
+		Timestamp: 1700000000,
+		Version:   3,
+		TTL:       time.Hour,
+		Assignments: map[string]*VisitorCache{
+			"vg1": {VariationID: "v1", Activated: true, AssignedAt: 1690000000},
+			"vg2": {VariationID: "v2"},
+		},
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	codecs := map[string]AssignmentsCodec{
+		"json":            NewJSONCodec(),
+		"protobuf":        NewProtobufCodec(),
+		"compressed json": NewCompressedCodec(NewJSONCodec()),
+		"compressed pb":   NewCompressedCodec(NewProtobufCodec()),
+	}
+
+	for name, codec := range codecs {
+		data, err := codec.Encode(createCodecAssignments())
+		assert.Nil(t, err, name)
+
+		decoded, err := codec.Decode(data)
+		assert.Nil(t, err, name)
+		assert.Equal(t, createCodecAssignments(), decoded, name)
+
+		data, err = codec.Encode(nil)
+		assert.Nil(t, err, name)
+		decoded, err = codec.Decode(data)
+		assert.Nil(t, err, name)
+		assert.Equal(t, &VisitorAssignments{Assignments: map[string]*VisitorCache{}}, decoded, name)
+
+		_, err = codec.Decode([]byte("invalid"))
+		assert.ErrorIs(t, err, InvalidPayloadError, name)
+	}
+}
+
+func TestCodecsHistory(t *testing.T) {
+	assignments := createCodecAssignments()
+	assignments.History = map[string][]AssignmentHistoryEntry{
+		"vg1": {{VariationID: "v2", FirstSeen: 1600000000, LastSeen: 1650000000}, {VariationID: "v1", FirstSeen: 1700000000, LastSeen: 1700000000}},
+	}
+
+	for _, codec := range []AssignmentsCodec{NewJSONCodec(), NewProtobufCodec()} {
+		data, err := codec.Encode(assignments)
+		assert.Nil(t, err)
+		decoded, err := codec.Decode(data)
+		assert.Nil(t, err)
+		assert.Equal(t, assignments, decoded)
+	}
+
+	data, _ := NewJSONCodec().Encode(assignments)
+	assert.Contains(t, string(data), `"h":{"vg1":[{"v":"v2","f":1600000000,"l":1650000000},{"v":"v1","f":1700000000,"l":1700000000}]}`)
+}
+
+func TestJSONCodecCompatibility(t *testing.T) {
+	codec := NewJSONCodec()
+
+	data, _ := codec.Encode(createCodecAssignments())
+	assert.JSONEq(t, `{"s":1,"t":1700000000,"ver":3,"ttl":3600000,"a":{"vg1":{"v":"v1","a":true,"at":1690000000},"vg2":{"v":"v2"}}}`, string(data))
+
+	// Newer payloads should be decoded, ignoring unknown fields
+	decoded, err := codec.Decode([]byte(`{"s":2,"t":1,"a":{"vg1":{"v":"v1","new":1}},"new":"field"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), decoded.Timestamp)
+	assert.Equal(t, &VisitorCache{VariationID: "v1"}, decoded.Assignments["vg1"])
+
+	_, err = codec.Decode([]byte(`{"t":1,"a":{}}`))
+	assert.ErrorIs(t, err, InvalidPayloadError)
+}
+
+func TestProtobufCodecCompatibility(t *testing.T) {
+	codec := NewProtobufCodec()
+
+	data, _ := codec.Encode(createCodecAssignments())
+
+	// Newer payloads should be decoded, ignoring unknown fields
+	data = protowire.AppendTag(data, 99, protowire.BytesType)
+	data = protowire.AppendString(data, "new field")
+	decoded, err := codec.Decode(data)
+	assert.Nil(t, err)
+	assert.Equal(t, createCodecAssignments(), decoded)
+
+	_, err = codec.Decode(data[:len(data)-1])
+	assert.ErrorIs(t, err, InvalidPayloadError)
+
+	_, err = codec.Decode([]byte{})
+	assert.ErrorIs(t, err, InvalidPayloadError)
+}
+
+func TestCompressedCodec(t *testing.T) {
+	assignments := &VisitorAssignments{Assignments: map[string]*VisitorCache{}}
+	for i := 0; i < 1000; i++ {
+		assignments.Assignments[fmt.Sprintf("variation_group_%d", i)] = &VisitorCache{VariationID: fmt.Sprintf("variation_%d", i%3), Activated: true}
+	}
+
+	codec := NewCompressedCodec(NewJSONCodec())
+	compressed, err := codec.Encode(assignments)
+	assert.Nil(t, err)
+	uncompressed, _ := NewJSONCodec().Encode(assignments)
+	assert.Less(t, len(compressed), len(uncompressed)/4)
+
+	// Uncompressed payloads should still be decoded
+	decoded, err := codec.Decode(uncompressed)
+	assert.Nil(t, err)
+	assert.Len(t, decoded.Assignments, 1000)
+
+	_, err = codec.Decode(compressed[:len(compressed)/2])
+	assert.ErrorIs(t, err, InvalidPayloadError)
+}
@@ -1,8 +1,10 @@
 package decision
 
 import (
+	"context"
 	"encoding/base64"
 	"sync"
+	"time"
 
 	"github.com/flagship-io/flagship-proto/decision_response"
 	"google.golang.org/protobuf/types/known/wrapperspb"
@@ -15,120 +17,320 @@ func GetDecision(
 	options DecisionOptions,
 	handlers DecisionHandlers,
 ) (*decision_response.DecisionResponse, error) {
+	return GetDecisionContext(context.Background(), visitorInfos, environmentInfos, options, handlers)
+}
+
+// GetDecisionContext return a decision response from visitor & environment infos.
+// The context is passed to the decision handlers. When it is done, pending cache fetches are abandoned
+// and pending cache saves and activations are detached so that the decision returns without waiting for them.
+// Detached side effects receive a copy of the context that is not canceled with it, so they can complete
+func GetDecisionContext(
+	ctx context.Context,
+	visitorInfos Visitor,
+	environmentInfos Environment,
+	options DecisionOptions,
+	handlers DecisionHandlers,
+) (*decision_response.DecisionResponse, error) {
+	// 0. Deduplicate campaigns with the same ID and link variation groups to their campaign
+	return GetDecisionCompiled(ctx, visitorInfos, compileEnvironment(environmentInfos), options, handlers)
+}
 
+// GetDecisionCompiled return a decision response from visitor infos & a compiled environment.
+// The compiled environment is not modified, so it can be shared between concurrent decisions
+func GetDecisionCompiled(
+	ctx context.Context,
+	visitorInfos Visitor,
+	compiledEnvironment *CompiledEnvironment,
+	options DecisionOptions,
+	handlers DecisionHandlers,
+) (*decision_response.DecisionResponse, error) {
+
+	environmentInfos := compiledEnvironment.environment
 	envID := environmentInfos.ID
-	visitorID := visitorInfos.ID
-	anonymousID := visitorInfos.AnonymousID
-	visitorContext := visitorInfos.Context
-	decisionGroup := visitorInfos.DecisionGroup
 	tracker := options.Tracker
+	handlers = handlers.withAssignmentStore()
+
+	// 0. If the environment is in panic mode, return an empty decision without any side effect
+	if environmentInfos.IsPanic {
+		logger.Logf(InfoLevel, "environment %s is in panic mode, returning empty decision", envID)
+		options.Explanation.setPanic(environmentInfos.Campaigns)
+		return buildPanicResponse(visitorInfos.ID), nil
+	}
+
+	// 0.b Trace the decision if the visitor is in the environment troubleshooting session
+	startTime := time.Now()
+	var troubleshootingEvent *TroubleshootingEvent
+	if options.DryRun == nil && handlers.SendTroubleshooting != nil && isTroubleshootingActive(environmentInfos.Troubleshooting, visitorInfos.ID, startTime) {
+		logger.Logf(DebugLevel, "visitor ID %s is in troubleshooting session", visitorInfos.ID)
+		troubleshootingEvent = &TroubleshootingEvent{
+			EnvironmentID: envID,
+			VisitorID:     visitorInfos.ID,
+			AnonymousID:   visitorInfos.AnonymousID,
+			Timestamp:     startTime,
+		}
+		if options.Explanation == nil {
+			options.Explanation = &DecisionExplanation{}
+		}
+	}
+
+	// 1. & 2.a & 2.b Get the variation groups that target the visitor
+	vd := newVisitorDecision(visitorInfos, environmentInfos, options)
+	targetingDuration := time.Since(startTime)
+
+	// 2.c Load all cache in parallel
+	var err error
+	allCacheAssignments := &allVisitorAssignments{}
+	if vd.enableCache {
+		tracker.TimeTrack("start find existing vID in Cache DB")
+		logger.Logf(InfoLevel, "loading assignments cache from DB")
+		cacheStartTime := time.Now()
+		allCacheAssignments, err = getCache(ctx, envID, vd.visitorID, vd.anonymousID, vd.decisionGroup, vd.enableReconciliation, handlers.GetCache)
+		tracker.TimeTrack("end find existing vID in Cache DB")
+
+		if troubleshootingEvent != nil {
+			troubleshootingEvent.CacheDuration = time.Since(cacheStartTime)
+		}
+
+		if ctx.Err() != nil {
+			logger.Logf(ErrorLevel, "context done when getting cached assignments: %v", ctx.Err())
+			return vd.response, ctx.Err()
+		}
+
+		if err != nil {
+			if stop, stopErr := vd.handleCacheError(getCacheFailurePolicy(environmentInfos, options), err, allCacheAssignments); stop {
+				if troubleshootingEvent != nil {
+					troubleshootingEvent.complete(options.Explanation, allCacheAssignments, targetingDuration, startTime, err)
+					sendStoppedTroubleshooting(ctx, handlers.SendTroubleshooting, troubleshootingEvent)
+				}
+				return vd.response, stopErr
+			}
+		}
+	}
+
+	// 2.d & 2.e & 3. Compute or get from cache each variation group variation assignment
+	if err := vd.computeAssignments(environmentInfos, allCacheAssignments, options); err != nil {
+		if troubleshootingEvent != nil {
+			troubleshootingEvent.complete(options.Explanation, allCacheAssignments, targetingDuration, startTime, err)
+			sendStoppedTroubleshooting(ctx, handlers.SendTroubleshooting, troubleshootingEvent)
+		}
+		return vd.response, err
+	}
+
+	// 3.8 In dry run mode, report the side effects instead of handling them
+	if options.DryRun != nil {
+		logger.Logf(InfoLevel, "dry run decision, reporting side effects instead of handling them")
+		if vd.enableCache && (handlers.SaveCache != nil || handlers.CompareAndSaveCache != nil) {
+			now := time.Now()
+			options.DryRun.addSaves(now, vd.getSaveID(vd.visitorID, "standard"), vd.newVGAssignments)
+			options.DryRun.addSaves(now, vd.getSaveID(vd.anonymousID, "anonymous"), vd.newVGAssignmentsAnonymous)
+			options.DryRun.addSaves(now, vd.getSaveID(vd.decisionGroup, "decisionGroup"), vd.newVGAssignments)
+		}
+		if handlers.ActivateCampaigns != nil {
+			options.DryRun.addActivations(vd.campaignActivations)
+		}
+		return vd.response, nil
+	}
+
+	// 4. Handle all side effects in parallel, with a context that outlives the decision if they are detached
+	var wg sync.WaitGroup
+	sideEffectsCtx := context.WithoutCancel(ctx)
+
+	// 4.1 Saves all assignments
+	if vd.enableCache && (handlers.SaveCache != nil || handlers.CompareAndSaveCache != nil) {
+		saveCacheAssignments(sideEffectsCtx, &wg, handlers, &environmentInfos, vd.getSaveID(vd.visitorID, "standard"), "visitor ID", allCacheAssignments.Standard, vd.withServedAssignments(vd.newVGAssignments))
+		saveCacheAssignments(sideEffectsCtx, &wg, handlers, &environmentInfos, vd.getSaveID(vd.anonymousID, "anonymous"), "anonymous ID", allCacheAssignments.Anonymous, vd.withServedAssignments(vd.newVGAssignmentsAnonymous))
+		saveCacheAssignments(sideEffectsCtx, &wg, handlers, &environmentInfos, vd.getSaveID(vd.decisionGroup, "decisionGroup"), "decision group", allCacheAssignments.DecisionGroup, vd.withServedAssignments(vd.newVGAssignments))
+	}
+
+	// 4.2 Sends all activation events
+	if len(vd.campaignActivations) > 0 && handlers.ActivateCampaigns != nil {
+		activateCampaigns(sideEffectsCtx, &wg, tracker, handlers.ActivateCampaigns, vd.campaignActivations)
+	}
+
+	// 4.3 Sends the troubleshooting event
+	if troubleshootingEvent != nil {
+		troubleshootingEvent.complete(options.Explanation, allCacheAssignments, targetingDuration, startTime, nil)
+		sendTroubleshooting(sideEffectsCtx, &wg, handlers.SendTroubleshooting, troubleshootingEvent)
+	}
+	waitSideEffects(ctx, &wg)
+
+	return vd.response, nil
+}
+
+// visitorDecision stores the state of a single visitor decision between the decision steps
+type visitorDecision struct {
+	visitorID            string
+	anonymousID          string
+	decisionGroup        string
+	variationGroups      []*VariationGroup
+	enableReconciliation bool
+	enableCache          bool
+	// cacheError stores the ID types whose cached assignments failed to load, when deciding with partial cache
+	cacheError *CacheError
+
+	response                  *decision_response.DecisionResponse
+	newVGAssignments          map[string]*VisitorCache
+	newVGAssignmentsAnonymous map[string]*VisitorCache
+	// servedVGAssignments stores the variations served from the cached assignments when the history is enabled
+	servedVGAssignments map[string]*VisitorCache
+	campaignActivations []*VisitorActivation
+}
+
+// newVisitorDecision initializes the visitor decision and gets the variation groups that target the visitor
+func newVisitorDecision(visitorInfos Visitor, environmentInfos Environment, options DecisionOptions) *visitorDecision {
+	tracker := options.Tracker
+	vd := &visitorDecision{
+		visitorID:     visitorInfos.ID,
+		anonymousID:   visitorInfos.AnonymousID,
+		decisionGroup: visitorInfos.DecisionGroup,
+	}
 
-	if decisionGroup != "" {
+	if vd.decisionGroup != "" {
 		// encode decision group if set
-		decisionGroup = base64.StdEncoding.EncodeToString([]byte(decisionGroup))
+		vd.decisionGroup = base64.StdEncoding.EncodeToString([]byte(vd.decisionGroup))
 	}
 
 	// Initialize campaign response to be returned
-	decisionResponse := &decision_response.DecisionResponse{}
-	decisionResponse.VisitorId = wrapperspb.String(visitorID)
-	decisionResponse.Campaigns = []*decision_response.Campaign{}
+	vd.response = &decision_response.DecisionResponse{}
+	vd.response.VisitorId = wrapperspb.String(vd.visitorID)
+	vd.response.Campaigns = []*decision_response.Campaign{}
 
 	// Initialize future variation groups variation assignments
-	newVGAssignments := make(map[string]*VisitorCache)
-	newVGAssignmentsAnonymous := make(map[string]*VisitorCache)
+	vd.newVGAssignments = make(map[string]*VisitorCache)
+	vd.newVGAssignmentsAnonymous = make(map[string]*VisitorCache)
+	vd.servedVGAssignments = make(map[string]*VisitorCache)
 
 	// Initialize future campaign activations
-	campaignActivations := []*VisitorActivation{}
-
-	// Initialize has AB Test assigned
-	hasABCampaign := false
+	vd.campaignActivations = []*VisitorActivation{}
 
 	tracker.TimeTrack("start compute targetings")
 
-	// 0. Deduplicate campaigns with the same ID
-	logger.Logf(InfoLevel, "deduplicating campaigns by ID")
-	campaignsArray := deduplicateCampaigns(environmentInfos.Campaigns)
-
 	// 1. Get variation group for each campaign that matches visitor context
 	logger.Logf(InfoLevel, "getting variation groups that match visitor ID and context")
-	variationGroups := getCampaignsVG(campaignsArray, visitorID, visitorContext)
+	vd.variationGroups = getCampaignsVG(environmentInfos.Campaigns, vd.visitorID, visitorInfos.Context, options.Explanation)
 	tracker.TimeTrack("end compute targetings")
 
 	// 2.a Check if anonymous / visitor reconciliation is enabled and relevant here
-	enableReconciliation := environmentInfos.UseReconciliation && anonymousID != ""
+	vd.enableReconciliation = environmentInfos.UseReconciliation && vd.anonymousID != ""
 
 	// 2.b Check if cache is enabled
-	enableCache := isCacheEnabled(environmentInfos, variationGroups)
+	vd.enableCache = isCacheEnabled(environmentInfos, vd.variationGroups)
 
-	// 2.c Load all cache in parallel
-	var err error
-	allCacheAssignments := &allVisitorAssignments{}
-	if enableCache {
-		tracker.TimeTrack("start find existing vID in Cache DB")
-		logger.Logf(InfoLevel, "loading assignments cache from DB")
-		allCacheAssignments, err = getCache(environmentInfos.ID, visitorID, anonymousID, decisionGroup, enableReconciliation, handlers.GetCache)
-		tracker.TimeTrack("end find existing vID in Cache DB")
+	return vd
+}
 
-		if err != nil {
-			logger.Logf(ErrorLevel, "error occured when getting cached assignments: %v", err)
-			return decisionResponse, nil
-		}
-	}
+// computeAssignments chooses the variation of each variation group, and fills the response, new assignments and activations.
+// It returns an error only if the decision is for a single campaign and the variation assignment failed
+func (vd *visitorDecision) computeAssignments(environmentInfos Environment, allCacheAssignments *allVisitorAssignments, options DecisionOptions) error {
+	visitorID := vd.visitorID
+	decisionGroup := vd.decisionGroup
+
+	// Initialize has AB Test assigned
+	hasABCampaign := false
+
+	// Initialize layers in which the visitor already got a campaign
+	assignedLayers := map[string]bool{}
+
+	// 2.c bis Re-key the assignments of variation groups and variations whose ID changed
+	migratedCacheAssignments, migratedVGs, migratedVGsAnonymous := allCacheAssignments.migrate(environmentInfos.AssignmentMigration)
 
-	// 2.d Load previously assigned AB Tests to handle single assignment option
+	// 2.d Ignore expired assignments, so that visitors are allocated again
+	activeCacheAssignments := migratedCacheAssignments.removeExpired(environmentInfos.assignmentTTLPolicy, time.Now())
+
+	// 2.e Load previously assigned AB Tests to handle single assignment option
 	previousVisVGsAB := []string{}
 	if environmentInfos.SingleAssignment {
-		previousVisVGsAB = getActivatedABVGIds(variationGroups, allCacheAssignments.Standard.getAssignments())
+		previousVisVGsAB = getActivatedABVGIds(vd.variationGroups, activeCacheAssignments.Standard.getAssignments())
 	}
 
 	// 3. Compute or get from cache each variation group variation assignment
-	for _, vg := range variationGroups {
+	for _, vg := range vd.variationGroups {
 
 		// 3.1 Skip according to single assignment rule
 		if shouldSkipVG(environmentInfos, vg, previousVisVGsAB, hasABCampaign) {
 			logger.Logf(DebugLevel, "Campaign %s has been skipped because of single assignment rule", vg.Campaign.ID)
+			options.Explanation.skip(vg.Campaign.ID, SkipReasonSingleAssignment)
 			continue
 		}
 
 		// 3.2 Skip according to bucket allocation rule
 		if shouldSkipBucketVG(options.EnableBucketAllocation == nil || *options.EnableBucketAllocation, visitorID, vg.Campaign) {
 			logger.Logf(DebugLevel, "visitor ID %s does not fall into the campaign's buckets. Skipping campaign", visitorID)
+			options.Explanation.skip(vg.Campaign.ID, SkipReasonBucketMiss)
+			continue
+		}
+
+		// 3.2bis Skip according to the layers of the campaign
+		if shouldSkipLayerVG(visitorID, vg.Campaign, assignedLayers) {
+			options.Explanation.skip(vg.Campaign.ID, SkipReasonLayerMiss)
 			continue
 		}
 
+		if ce := options.Explanation.campaign(vg.Campaign.ID); ce != nil {
+			var err error
+			ce.HashValue, err = getAllocationHash(visitorID, decisionGroup, vg.ID)
+			ce.HasHash = err == nil
+		}
+
 		// 3.3 Choose the variation group assigned variation
 		// according to cache assignments, visitor ID and decision group and options
 		chosenVariationResult, err := chooseVariation(
 			visitorID,
 			decisionGroup,
 			vg,
-			*allCacheAssignments,
+			activeCacheAssignments,
 			options)
 
 		// If variation assignment failed, return the response for single campaign, other move to the next variation group
 		if err != nil {
+			options.Explanation.skip(vg.Campaign.ID, getSkipReason(err))
 			if options.CampaignID != "" {
-				return decisionResponse, err
+				return err
 			}
 			continue
 		}
 
+		if ce := options.Explanation.campaign(vg.Campaign.ID); ce != nil {
+			ce.VariationID = chosenVariationResult.chosenVariation.ID
+			ce.Source = chosenVariationResult.source
+		}
+
 		// 3.4 Add the new cache assignment for visitor and anonymous
 		if chosenVariationResult.newAssignment != nil {
-			newVGAssignments[vg.ID] = chosenVariationResult.newAssignment
+			vd.newVGAssignments[vg.ID] = chosenVariationResult.newAssignment
 		}
 		if chosenVariationResult.newAssignmentAnonymous != nil {
-			newVGAssignmentsAnonymous[vg.ID] = chosenVariationResult.newAssignmentAnonymous
+			vd.newVGAssignmentsAnonymous[vg.ID] = chosenVariationResult.newAssignmentAnonymous
+		}
+
+		// 3.4bis Save the re-keyed cache assignments with their new IDs
+		if _, ok := vd.newVGAssignments[vg.ID]; !ok && migratedVGs[vg.ID] {
+			existing, _ := activeCacheAssignments.Standard.getAssignment(vg.ID)
+			vd.newVGAssignments[vg.ID] = &VisitorCache{
+				VariationID: chosenVariationResult.chosenVariation.ID,
+				Activated:   existing != nil && existing.Activated,
+			}
+		}
+		if existing, ok := activeCacheAssignments.Anonymous.getAssignment(vg.ID); ok && existing != nil && migratedVGsAnonymous[vg.ID] {
+			if _, ok := vd.newVGAssignmentsAnonymous[vg.ID]; !ok {
+				copied := *existing
+				vd.newVGAssignmentsAnonymous[vg.ID] = &copied
+			}
+		}
+
+		// 3.4ter Remember the variations served from the cache, to update their history when the assignments are saved
+		if environmentInfos.AssignmentHistorySize > 0 && chosenVariationResult.source != VariationSourceAllocation {
+			vd.servedVGAssignments[vg.ID] = &VisitorCache{VariationID: chosenVariationResult.chosenVariation.ID, served: true}
 		}
 
 		// 3.5 If decision should trigger activation hit, add it to list of activations
 		if options.TriggerHit {
 			anonymousIDActivate := visitorID
-			if enableReconciliation {
-				anonymousIDActivate = anonymousID
+			if vd.enableReconciliation {
+				anonymousIDActivate = vd.anonymousID
 			}
-			campaignActivations = append(campaignActivations, &VisitorActivation{
-				EnvironmentID:    envID,
+			vd.campaignActivations = append(vd.campaignActivations, &VisitorActivation{
+				EnvironmentID:    environmentInfos.ID,
 				VisitorID:        visitorID,
 				AnonymousID:      anonymousIDActivate,
 				VariationGroupID: vg.ID,
@@ -137,41 +339,35 @@ func GetDecision(
 		}
 
 		// 3.6 Serialize campaign response and add it to the to global response campaign list
-		decisionResponse.Campaigns = append(
-			decisionResponse.Campaigns,
+		vd.response.Campaigns = append(
+			vd.response.Campaigns,
 			buildCampaignResponse(vg, chosenVariationResult.chosenVariation, options.ExposeAllKeys))
 
 		// 3.7 Remember if AB campaign for single assignment
 		if vg.Campaign.Type == "ab" {
 			hasABCampaign = true
 		}
-	}
 
-	// 4. Handle all side effects in parallel
-	var wg sync.WaitGroup
-
-	// 4.1 Saves all assignments
-	if enableCache && handlers.SaveCache != nil {
-		saveCacheAssignments(&wg, handlers, envID, visitorID, "visitor ID", newVGAssignments)
-		saveCacheAssignments(&wg, handlers, envID, anonymousID, "anonymous ID", newVGAssignmentsAnonymous)
-		saveCacheAssignments(&wg, handlers, envID, decisionGroup, "decision group", newVGAssignments)
+		// 3.7bis Remember the layers of the campaign for mutual exclusion
+		for _, cl := range vg.Campaign.layers {
+			assignedLayers[cl.layerID] = true
+		}
 	}
+	return nil
+}
 
-	// 4.2 Sends all activation events
-	if len(campaignActivations) > 0 && handlers.ActivateCampaigns != nil {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			tracker.TimeTrack("start activating campaigns hit")
-			logger.Logf(InfoLevel, "activating %d campaigns and variations", len(campaignActivations))
-			err := handlers.ActivateCampaigns(campaignActivations)
-			if err != nil {
-				logger.Logf(ErrorLevel, "error occured on campaign activation: %v", err)
-			}
-			tracker.TimeTrack("end activating campaigns hit")
-		}()
+// withServedAssignments returns the new assignments with the variations served from the cache that are not assigned again,
+// so that the last seen timestamp of their history is updated whenever the assignments are saved
+func (vd *visitorDecision) withServedAssignments(assignments map[string]*VisitorCache) map[string]*VisitorCache {
+	if len(assignments) == 0 || len(vd.servedVGAssignments) == 0 {
+		return assignments
 	}
-	wg.Wait()
-
-	return decisionResponse, nil
+	withServed := make(map[string]*VisitorCache, len(assignments)+len(vd.servedVGAssignments))
+	for vgID, a := range vd.servedVGAssignments {
+		withServed[vgID] = a
+	}
+	for vgID, a := range assignments {
+		withServed[vgID] = a
+	}
+	return withServed
 }
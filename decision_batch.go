@@ -0,0 +1,292 @@
+package decision
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// GetDecisions return the decision responses of many visitors for the same environment
+func GetDecisions(
+	visitors []Visitor,
+	environmentInfos Environment,
+	options DecisionOptions,
+	handlers BatchDecisionHandlers,
+) ([]*VisitorDecision, error) {
+	return GetDecisionsContext(context.Background(), visitors, environmentInfos, options, handlers)
+}
+
+// GetDecisionsContext return the decision responses of many visitors for the same environment.
+// The context is passed to the batch decision handlers. Side effects detached when it is done
+// receive a copy of the context that is not canceled with it
+func GetDecisionsContext(
+	ctx context.Context,
+	visitors []Visitor,
+	environmentInfos Environment,
+	options DecisionOptions,
+	handlers BatchDecisionHandlers,
+) ([]*VisitorDecision, error) {
+	return GetDecisionsCompiled(ctx, visitors, compileEnvironment(environmentInfos), options, handlers)
+}
+
+// GetDecisionsCompiled return the decision responses of many visitors for the same compiled environment.
+// Assignments of all visitors are loaded and saved with a single call to the batch cache handlers,
+// and all activations are sent with a single call to the activation handler.
+// Decisions are returned in the visitors order, with their own error.
+// If the decision option Explanation is set, each visitor decision gets its own explanation
+func GetDecisionsCompiled(
+	ctx context.Context,
+	visitors []Visitor,
+	compiledEnvironment *CompiledEnvironment,
+	options DecisionOptions,
+	handlers BatchDecisionHandlers,
+) ([]*VisitorDecision, error) {
+	environmentInfos := compiledEnvironment.environment
+	envID := environmentInfos.ID
+	tracker := options.Tracker
+	handlers = handlers.withAssignmentStore()
+
+	results := make([]*VisitorDecision, len(visitors))
+
+	// 0. If the environment is in panic mode, return empty decisions without any side effect
+	if environmentInfos.IsPanic {
+		logger.Logf(InfoLevel, "environment %s is in panic mode, returning empty decisions", envID)
+		for i, visitorInfos := range visitors {
+			results[i] = &VisitorDecision{
+				Response: buildPanicResponse(visitorInfos.ID),
+			}
+			if options.Explanation != nil {
+				results[i].Explanation = &DecisionExplanation{}
+				results[i].Explanation.setPanic(environmentInfos.Campaigns)
+			}
+		}
+		return results, nil
+	}
+
+	decisions := make([]*visitorDecision, len(visitors))
+	visitorsOptions := make([]DecisionOptions, len(visitors))
+
+	// 0.b Trace the decisions of the visitors that are in the environment troubleshooting session
+	startTime := time.Now()
+	troubleshootingEvents := make([]*TroubleshootingEvent, len(visitors))
+	targetingDurations := make([]time.Duration, len(visitors))
+
+	// 1. & 2.a & 2.b Get the variation groups that target each visitor and the IDs to load from cache
+	cacheIDs := []string{}
+	addedIDs := map[string]bool{}
+	addCacheID := func(id string) {
+		if id != "" && !addedIDs[id] {
+			cacheIDs = append(cacheIDs, id)
+			addedIDs[id] = true
+		}
+	}
+	for i, visitorInfos := range visitors {
+		results[i] = &VisitorDecision{}
+		visitorsOptions[i] = options
+		if options.Explanation != nil {
+			results[i].Explanation = &DecisionExplanation{}
+			visitorsOptions[i].Explanation = results[i].Explanation
+		}
+		visitorStartTime := time.Now()
+		if options.DryRun == nil && handlers.SendTroubleshooting != nil && isTroubleshootingActive(environmentInfos.Troubleshooting, visitorInfos.ID, visitorStartTime) {
+			logger.Logf(DebugLevel, "visitor ID %s is in troubleshooting session", visitorInfos.ID)
+			troubleshootingEvents[i] = &TroubleshootingEvent{
+				EnvironmentID: envID,
+				VisitorID:     visitorInfos.ID,
+				AnonymousID:   visitorInfos.AnonymousID,
+				Timestamp:     visitorStartTime,
+			}
+			if visitorsOptions[i].Explanation == nil {
+				visitorsOptions[i].Explanation = &DecisionExplanation{}
+			}
+		}
+
+		vd := newVisitorDecision(visitorInfos, environmentInfos, visitorsOptions[i])
+		targetingDurations[i] = time.Since(visitorStartTime)
+		decisions[i] = vd
+		results[i].Response = vd.response
+
+		if vd.enableCache {
+			addCacheID(vd.visitorID)
+			if vd.enableReconciliation {
+				addCacheID(vd.anonymousID)
+			}
+			addCacheID(vd.decisionGroup)
+		}
+	}
+
+	// 2.c Load all cache in a single call
+	var cacheErr error
+	var cacheDuration time.Duration
+	cacheAssignments := map[string]*VisitorAssignments{}
+	if len(cacheIDs) > 0 && handlers.BatchGetCache != nil {
+		tracker.TimeTrack("start find existing IDs in Cache DB")
+		logger.Logf(InfoLevel, "loading assignments cache from DB for %d IDs", len(cacheIDs))
+		cacheStartTime := time.Now()
+		cacheAssignments, cacheErr = handlers.BatchGetCache(ctx, envID, cacheIDs)
+		cacheDuration = time.Since(cacheStartTime)
+		tracker.TimeTrack("end find existing IDs in Cache DB")
+
+		if ctx.Err() != nil {
+			logger.Logf(ErrorLevel, "context done when getting cached assignments: %v", ctx.Err())
+			return results, ctx.Err()
+		}
+
+		if cacheErr != nil {
+			logger.Logf(ErrorLevel, "error occured when getting cached assignments: %v", cacheErr)
+		}
+	}
+
+	// 2.d & 2.e & 3. Compute or get from cache each visitor variation group variation assignment
+	saves := map[string]*VisitorAssignments{}
+	campaignActivations := []*VisitorActivation{}
+	now := time.Now()
+	cacheFailurePolicy := getCacheFailurePolicy(environmentInfos, options)
+	for i, vd := range decisions {
+		allCacheAssignments := &allVisitorAssignments{}
+		if vd.enableCache {
+			allCacheAssignments.Standard = cacheAssignments[vd.visitorID]
+			if vd.enableReconciliation {
+				allCacheAssignments.Anonymous = cacheAssignments[vd.anonymousID]
+			}
+			if vd.decisionGroup != "" {
+				allCacheAssignments.DecisionGroup = cacheAssignments[vd.decisionGroup]
+			}
+		}
+
+		// As for a single decision, apply the cache failure policy to the visitors that need the cache.
+		// By default, they get an empty decision if it failed to load
+		if vd.enableCache && cacheErr != nil {
+			visitorCacheErr := getBatchCacheError(vd, cacheAssignments, cacheErr)
+			if cacheFailurePolicy == CacheFailureEmpty || visitorCacheErr.hasError() {
+				if stop, err := vd.handleCacheError(cacheFailurePolicy, visitorCacheErr, allCacheAssignments); stop {
+					results[i].Err = err
+					troubleshootingEvents[i].completeBatch(visitorsOptions[i].Explanation, allCacheAssignments, targetingDurations[i], cacheDuration, startTime, cacheErr)
+					continue
+				}
+			}
+		}
+
+		if err := vd.computeAssignments(environmentInfos, allCacheAssignments, visitorsOptions[i]); err != nil {
+			results[i].Err = err
+			troubleshootingEvents[i].completeBatch(visitorsOptions[i].Explanation, allCacheAssignments, targetingDurations[i], cacheDuration, startTime, err)
+			continue
+		}
+		troubleshootingEvents[i].completeBatch(visitorsOptions[i].Explanation, allCacheAssignments, targetingDurations[i], cacheDuration, startTime, nil)
+
+		if vd.enableCache {
+			addAssignmentsToSave(saves, now, vd.getSaveID(vd.visitorID, "standard"), vd.withServedAssignments(vd.newVGAssignments))
+			addAssignmentsToSave(saves, now, vd.getSaveID(vd.anonymousID, "anonymous"), vd.withServedAssignments(vd.newVGAssignmentsAnonymous))
+			addAssignmentsToSave(saves, now, vd.getSaveID(vd.decisionGroup, "decisionGroup"), vd.withServedAssignments(vd.newVGAssignments))
+		}
+		campaignActivations = append(campaignActivations, vd.campaignActivations...)
+	}
+
+	// 3.8 In dry run mode, report the side effects instead of handling them
+	if options.DryRun != nil {
+		logger.Logf(InfoLevel, "dry run decisions, reporting side effects instead of handling them")
+		if handlers.BatchSaveCache != nil || handlers.CompareAndSaveCache != nil {
+			for id, a := range saves {
+				options.DryRun.addSaves(now, id, a.Assignments)
+			}
+		}
+		if handlers.ActivateCampaigns != nil {
+			options.DryRun.addActivations(campaignActivations)
+		}
+		return results, nil
+	}
+
+	// 4. Handle all side effects in parallel, with a context that outlives the decisions if they are detached
+	var wg sync.WaitGroup
+	sideEffectsCtx := context.WithoutCancel(ctx)
+
+	// 4.1 Saves all assignments, merged into the existing ones
+	if len(saves) > 0 && handlers.CompareAndSaveCache != nil {
+		var getCacheHandler func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error)
+		if handlers.BatchGetCache != nil {
+			getCacheHandler = func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+				assignments, err := handlers.BatchGetCache(ctx, environmentID, []string{id})
+				return assignments[id], err
+			}
+		}
+		for id, a := range saves {
+			wg.Add(1)
+			go func(id string, assignments map[string]*VisitorCache) {
+				defer wg.Done()
+				logger.Logf(InfoLevel, "saving assignments cache for ID: %s", id)
+				err := compareAndSaveAssignments(sideEffectsCtx, &environmentInfos, id, cacheAssignments[id], assignments, now, getCacheHandler, handlers.CompareAndSaveCache)
+				if err != nil {
+					logger.Logf(ErrorLevel, "error occurred on cache saving for %s: %v", id, err)
+				}
+			}(id, a.Assignments)
+		}
+	} else if len(saves) > 0 && handlers.BatchSaveCache != nil {
+		for id, a := range saves {
+			saves[id] = mergeAssignments(cacheAssignments[id], a.Assignments, now, &environmentInfos)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logger.Logf(InfoLevel, "saving assignments cache for %d IDs", len(saves))
+			err := handlers.BatchSaveCache(sideEffectsCtx, envID, saves)
+			if err != nil {
+				logger.Logf(ErrorLevel, "error occurred on batch cache saving: %v", err)
+			}
+		}()
+	}
+
+	// 4.2 Sends all activation events
+	if len(campaignActivations) > 0 && handlers.ActivateCampaigns != nil {
+		activateCampaigns(sideEffectsCtx, &wg, tracker, handlers.ActivateCampaigns, campaignActivations)
+	}
+
+	// 4.3 Sends the troubleshooting events, including the ones of failed decisions
+	for _, event := range troubleshootingEvents {
+		if event != nil {
+			sendTroubleshooting(sideEffectsCtx, &wg, handlers.SendTroubleshooting, event)
+		}
+	}
+	waitSideEffects(ctx, &wg)
+
+	return results, nil
+}
+
+// addAssignmentsToSave adds the new assignments of an ID to the assignments to save,
+// merging them if the ID is already there, for instance when it is shared between visitors
+func addAssignmentsToSave(saves map[string]*VisitorAssignments, now time.Time, id string, assignments map[string]*VisitorCache) {
+	if len(assignments) == 0 || id == "" {
+		return
+	}
+
+	existing, ok := saves[id]
+	if !ok {
+		existing = &VisitorAssignments{
+			Timestamp:   now.Unix(),
+			Assignments: map[string]*VisitorCache{},
+		}
+		saves[id] = existing
+	}
+	for vgID, a := range assignments {
+		// Served variations never replace the ones assigned by another decision of the batch
+		if previous := existing.Assignments[vgID]; a != nil && a.served && previous != nil {
+			continue
+		}
+		existing.Assignments[vgID] = a
+	}
+}
+
+// getBatchCacheError returns the cache error of a visitor when the batch cache loading failed.
+// As the batch error does not tell which IDs failed, the visitor IDs missing from the loaded assignments are considered failed
+func getBatchCacheError(vd *visitorDecision, cacheAssignments map[string]*VisitorAssignments, err error) *CacheError {
+	cacheErr := &CacheError{}
+	if _, ok := cacheAssignments[vd.visitorID]; !ok {
+		cacheErr.Standard = err
+	}
+	if _, ok := cacheAssignments[vd.anonymousID]; vd.enableReconciliation && !ok {
+		cacheErr.Anonymous = err
+	}
+	if _, ok := cacheAssignments[vd.decisionGroup]; vd.decisionGroup != "" && !ok {
+		cacheErr.DecisionGroup = err
+	}
+	return cacheErr
+}
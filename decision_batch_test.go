@@ -0,0 +1,196 @@
+package decision
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flagship-io/flagship-common/targeting"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func createBatchEnvironment() Environment {
+	return Environment{
+		ID:                "env_id",
+		CacheEnabled:      true,
+		UseReconciliation: true,
+		Campaigns: []*Campaign{
+			{
+				ID:           "c1",
+				Type:         "ab",
+				BucketRanges: [][]float64{{0., 100.}},
+				VariationGroups: []*VariationGroup{
+					{
+						ID:         "vg1",
+						Targetings: createBoolTargeting(),
+						Variations: []*Variation{{ID: "v1", Allocation: 50}, {ID: "v2", Allocation: 50}},
+					},
+				},
+			},
+		},
+	}
+}
+
+func createBatchVisitor(id string, isVIP bool) Visitor {
+	return Visitor{
+		ID: id,
+		Context: &targeting.Context{
+			Standard: targeting.ContextMap{
+				"isVIP": structpb.NewBoolValue(isVIP),
+			},
+		},
+	}
+}
+
+func TestGetDecisions(t *testing.T) {
+	visitors := []Visitor{
+		createBatchVisitor("vis1", true),
+		createBatchVisitor("vis2", false),
+		createBatchVisitor("vis3", true),
+	}
+	visitors[2].AnonymousID = "anon3"
+	visitors[2].DecisionGroup = "dg"
+
+	var mu sync.Mutex
+	getCalls := [][]string{}
+	saveCalls := []map[string]*VisitorAssignments{}
+	activateCalls := [][]*VisitorActivation{}
+
+	handlers := BatchDecisionHandlers{
+		BatchGetCache: func(ctx context.Context, environmentID string, ids []string) (map[string]*VisitorAssignments, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			getCalls = append(getCalls, ids)
+			return map[string]*VisitorAssignments{
+				"vis1": {Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v2", Activated: true}}},
+			}, nil
+		},
+		BatchSaveCache: func(ctx context.Context, environmentID string, assignments map[string]*VisitorAssignments) error {
+			mu.Lock()
+			defer mu.Unlock()
+			saveCalls = append(saveCalls, assignments)
+			return nil
+		},
+		ActivateCampaigns: func(ctx context.Context, activations []*VisitorActivation) error {
+			mu.Lock()
+			defer mu.Unlock()
+			activateCalls = append(activateCalls, activations)
+			return nil
+		},
+	}
+
+	results, err := GetDecisions(visitors, createBatchEnvironment(), DecisionOptions{TriggerHit: true}, handlers)
+	assert.Nil(t, err)
+	assert.Len(t, results, 3)
+
+	assert.Equal(t, "vis1", results[0].Response.VisitorId.Value)
+	assert.Len(t, results[0].Response.Campaigns, 1)
+	assert.Equal(t, "v2", results[0].Response.Campaigns[0].Variation.Id.Value)
+
+	assert.Equal(t, "vis2", results[1].Response.VisitorId.Value)
+	assert.Len(t, results[1].Response.Campaigns, 0)
+
+	assert.Equal(t, "vis3", results[2].Response.VisitorId.Value)
+	assert.Len(t, results[2].Response.Campaigns, 1)
+
+	for _, r := range results {
+		assert.Nil(t, r.Err)
+		assert.Nil(t, r.Explanation)
+	}
+
+	// All IDs are loaded in a single call, anonymous ID only if reconciliation is relevant
+	assert.Len(t, getCalls, 1)
+	assert.ElementsMatch(t, []string{"vis1", "vis2", "vis3", "anon3", "ZGc="}, getCalls[0])
+
+	// vis1 is already activated, only vis3 assignments are saved
+	assert.Len(t, saveCalls, 1)
+	assert.Len(t, saveCalls[0], 3)
+	assert.Contains(t, saveCalls[0], "vis3")
+	assert.Contains(t, saveCalls[0], "anon3")
+	assert.Contains(t, saveCalls[0], "ZGc=")
+
+	assert.Len(t, activateCalls, 1)
+	assert.Len(t, activateCalls[0], 2)
+	assert.Equal(t, "vis1", activateCalls[0][0].VisitorID)
+	assert.Equal(t, "vis3", activateCalls[0][1].VisitorID)
+	assert.Equal(t, "anon3", activateCalls[0][1].AnonymousID)
+}
+
+func TestGetDecisionsErrors(t *testing.T) {
+	visitors := []Visitor{
+		createBatchVisitor("vis1", true),
+		createBatchVisitor("vis2", true),
+	}
+
+	handlers := BatchDecisionHandlers{
+		BatchGetCache: func(ctx context.Context, environmentID string, ids []string) (map[string]*VisitorAssignments, error) {
+			return nil, errors.New("cache error")
+		},
+	}
+
+	results, err := GetDecisions(visitors, createBatchEnvironment(), DecisionOptions{}, handlers)
+	assert.Nil(t, err)
+	for _, r := range results {
+		assert.Nil(t, r.Err)
+		assert.Len(t, r.Response.Campaigns, 0)
+	}
+
+	// Untracked visitors should return an error for single campaign decisions
+	env := createBatchEnvironment()
+	env.CacheEnabled = false
+	env.Campaigns[0].VariationGroups[0].Variations[0].Allocation = 0
+	env.Campaigns[0].VariationGroups[0].Variations[1].Allocation = 0
+
+	results, err = GetDecisions(visitors, env, DecisionOptions{CampaignID: "c1", Explanation: &DecisionExplanation{}}, BatchDecisionHandlers{})
+	assert.Nil(t, err)
+	for _, r := range results {
+		assert.Equal(t, VisitorNotTrackedError, r.Err)
+		ce, ok := r.Explanation.Campaign("c1")
+		assert.True(t, ok)
+		assert.Equal(t, SkipReasonVisitorNotTracked, ce.SkipReason)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	handlers.BatchGetCache = func(ctx context.Context, environmentID string, ids []string) (map[string]*VisitorAssignments, error) {
+		return nil, ctx.Err()
+	}
+	_, err = GetDecisionsContext(ctx, visitors, createBatchEnvironment(), DecisionOptions{}, handlers)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestAddBatchAssignments(t *testing.T) {
+	now := time.Now()
+	saves := map[string]*VisitorAssignments{}
+	addAssignmentsToSave(saves, now, "", map[string]*VisitorCache{"vg1": {VariationID: "v1"}})
+	addAssignmentsToSave(saves, now, "dg", map[string]*VisitorCache{})
+	assert.Len(t, saves, 0)
+
+	addAssignmentsToSave(saves, now, "dg", map[string]*VisitorCache{"vg1": {VariationID: "v1"}})
+	addAssignmentsToSave(saves, now, "dg", map[string]*VisitorCache{"vg2": {VariationID: "v2"}})
+	assert.Len(t, saves, 1)
+	assert.Len(t, saves["dg"].Assignments, 2)
+	assert.Equal(t, now.Unix(), saves["dg"].Timestamp)
+}
+
+func TestGetDecisionsPanic(t *testing.T) {
+	env := createBatchEnvironment()
+	env.IsPanic = true
+
+	handlers := BatchDecisionHandlers{
+		BatchGetCache: func(ctx context.Context, environmentID string, ids []string) (map[string]*VisitorAssignments, error) {
+			t.Error("cache should not be read in panic mode")
+			return nil, nil
+		},
+	}
+
+	results, err := GetDecisions([]Visitor{createBatchVisitor("vis1", true)}, env, DecisionOptions{Explanation: &DecisionExplanation{}}, handlers)
+	assert.Nil(t, err)
+	assert.Len(t, results, 1)
+	assert.True(t, IsPanicResponse(results[0].Response))
+	assert.Equal(t, "vis1", results[0].Response.VisitorId.Value)
+	assert.True(t, results[0].Explanation.Panic)
+}
@@ -1,6 +1,8 @@
 package decision
 
 import (
+	"context"
+	"errors"
 	"sync"
 	"time"
 )
@@ -17,27 +19,32 @@ type allVisitorAssignments struct {
 	DecisionGroup *VisitorAssignments
 }
 
+// getCache loads in parallel the cached assignments of the visitor, anonymous and decision group IDs.
+// It returns a *CacheError with the error of each failed ID type, whose assignments are left nil,
+// or the context error if the context is done before all the fetches are finished
 func getCache(
+	ctx context.Context,
 	environmentID string,
 	visitorID string,
 	anonymousID string,
 	decisionGroup string,
 	enableReconciliation bool,
-	getCacheHandler func(environmentID string, id string) (*VisitorAssignments, error)) (*allVisitorAssignments, error) {
+	getCacheHandler func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error)) (*allVisitorAssignments, error) {
 
-	cacheChan := make(chan (*assignmentResult))
+	// Buffer the channel so that abandoned fetches do not leak their goroutine
+	cacheChan := make(chan (*assignmentResult), 3)
 	allAssignments := &allVisitorAssignments{
 		Standard: &VisitorAssignments{
 			Assignments: map[string]*VisitorCache{},
 		},
 	}
 
-	var err error
+	cacheErr := &CacheError{}
 	var nbRoutines = 1
 
 	fetchCacheForID := func(c chan (*assignmentResult), id string, idType string) {
 		logger.Logf(InfoLevel, "getting assignment cache for %s: %s", idType, id)
-		newAssignments, err := getCacheHandler(environmentID, id)
+		newAssignments, err := getCacheHandler(ctx, environmentID, id)
 		c <- &assignmentResult{
 			result: newAssignments,
 			idType: idType,
@@ -56,7 +63,18 @@ func getCache(
 	}
 
 	for i := 0; i < nbRoutines; i++ {
-		r := <-cacheChan
+		var r *assignmentResult
+		select {
+		case r = <-cacheChan:
+		case <-ctx.Done():
+			logger.Logf(WarnLevel, "abandoning assignment cache fetch: %v", ctx.Err())
+			return allAssignments, ctx.Err()
+		}
+		if r.err != nil {
+			logger.Logf(WarnLevel, "error when getting assignment cache for %s: %v", r.idType, r.err)
+			r.result = nil
+			cacheErr.setError(r.idType, r.err)
+		}
 		switch r.idType {
 		case "standard":
 			allAssignments.Standard = r.result
@@ -65,19 +83,27 @@ func getCache(
 		case "decisionGroup":
 			allAssignments.DecisionGroup = r.result
 		}
-		err = r.err
 	}
 
-	return allAssignments, err
+	if cacheErr.hasError() {
+		return allAssignments, cacheErr
+	}
+	return allAssignments, nil
 }
 
-// Saves a set of cache assignments for a specific id type and using cache handlers
+// maxCompareAndSaveAttempts is the number of times the assignments are reloaded and merged again on version conflict
+const maxCompareAndSaveAttempts = 5
+
+// Saves a set of cache assignments for a specific id type and using cache handlers.
+// The new assignments are merged into the existing ones, so that previous assignments are never dropped
 func saveCacheAssignments(
+	ctx context.Context,
 	wg *sync.WaitGroup,
 	handlers DecisionHandlers,
-	envID string,
+	environmentInfos *Environment,
 	id string,
 	idType string,
+	existing *VisitorAssignments,
 	assignments map[string]*VisitorCache,
 ) {
 	if len(assignments) == 0 || id == "" {
@@ -89,12 +115,104 @@ func saveCacheAssignments(
 	go func() {
 		defer wg.Done()
 		logger.Logf(InfoLevel, "saving assignments cache for %s: %s", idType, id)
-		err := handlers.SaveCache(envID, id, &VisitorAssignments{
-			Timestamp:   now.Unix(),
-			Assignments: assignments,
-		})
+		var err error
+		if handlers.CompareAndSaveCache != nil {
+			err = compareAndSaveAssignments(ctx, environmentInfos, id, existing, assignments, now, handlers.GetCache, handlers.CompareAndSaveCache)
+		} else {
+			err = handlers.SaveCache(ctx, environmentInfos.ID, id, mergeAssignments(existing, assignments, now, environmentInfos))
+		}
 		if err != nil {
 			logger.Logf(ErrorLevel, "error occurred on cache saving for %s: %v", id, err)
 		}
 	}()
 }
+
+// mergeAssignments returns a copy of the existing assignments updated with the new ones.
+// Expired existing assignments are dropped, as well as the ones of deleted variation groups if pruning is enabled,
+// and the TTL of the merged assignments is set according to the environment TTL policy.
+// Each assignment keeps the timestamp of its first save, so that its TTL is not extended by the saves of other assignments.
+// The new variations are recorded in the history if it is enabled, and the served ones update the history of the stored ones.
+// The existing assignments and history are re-keyed with the environment migration first, so that the old variation group IDs are not saved.
+// The existing version is kept as the compare and save token
+func mergeAssignments(existing *VisitorAssignments, assignments map[string]*VisitorCache, now time.Time, environmentInfos *Environment) *VisitorAssignments {
+	ttlPolicy := environmentInfos.assignmentTTLPolicy
+	existing, _ = environmentInfos.AssignmentMigration.apply(existing)
+	merged := &VisitorAssignments{
+		Timestamp:   now.Unix(),
+		Assignments: make(map[string]*VisitorCache, len(existing.getAssignments())+len(assignments)),
+	}
+	if existing != nil {
+		merged.Version = existing.Version
+	}
+	for vgID, a := range existing.getAssignments() {
+		if ttlPolicy.IsExpired(existing, vgID, now) || environmentInfos.isPrunedVariationGroup(vgID) {
+			continue
+		}
+		merged.Assignments[vgID] = withAssignedAt(a, existing.assignedAt(vgID), now)
+	}
+	for vgID, a := range assignments {
+		if a != nil && a.served {
+			continue
+		}
+		assignedAt := now.Unix()
+		if previous := merged.Assignments[vgID]; previous != nil && a != nil && previous.VariationID == a.VariationID {
+			assignedAt = previous.AssignedAt
+		}
+		merged.Assignments[vgID] = withAssignedAt(a, assignedAt, now)
+	}
+	merged.TTL = ttlPolicy.AssignmentsTTL(merged.Assignments, now)
+	recordHistory(merged, existing, assignments, merged.Timestamp, environmentInfos.AssignmentHistorySize)
+	for vgID := range merged.History {
+		if environmentInfos.isPrunedVariationGroup(vgID) {
+			delete(merged.History, vgID)
+		}
+	}
+	return merged
+}
+
+// withAssignedAt returns the assignment with its AssignedAt timestamp set to the given one if it is unknown,
+// or to now if both are unknown. The assignment is copied if it is updated
+func withAssignedAt(a *VisitorCache, assignedAt int64, now time.Time) *VisitorCache {
+	if a == nil || a.AssignedAt > 0 {
+		return a
+	}
+	if assignedAt <= 0 {
+		assignedAt = now.Unix()
+	}
+	copied := *a
+	copied.AssignedAt = assignedAt
+	return &copied
+}
+
+// compareAndSaveAssignments merges the new assignments into the existing ones and saves them with optimistic concurrency.
+// On version conflict, the assignments are reloaded and merged again, so that concurrent saves never drop each other's assignments
+func compareAndSaveAssignments(
+	ctx context.Context,
+	environmentInfos *Environment,
+	id string,
+	existing *VisitorAssignments,
+	assignments map[string]*VisitorCache,
+	now time.Time,
+	getCacheHandler func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error),
+	compareAndSaveHandler func(ctx context.Context, environmentID string, id string, assignment *VisitorAssignments) error,
+) error {
+	var err error
+	for i := 0; i < maxCompareAndSaveAttempts; i++ {
+		if i > 0 {
+			if getCacheHandler == nil {
+				return err
+			}
+			logger.Logf(DebugLevel, "assignments version conflict for %s, reloading assignments", id)
+			existing, err = getCacheHandler(ctx, environmentInfos.ID, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = compareAndSaveHandler(ctx, environmentInfos.ID, id, mergeAssignments(existing, assignments, now, environmentInfos))
+		if !errors.Is(err, VersionConflictError) {
+			return err
+		}
+	}
+	return err
+}
@@ -1,10 +1,13 @@
 package decision
 
 import (
+	"context"
 	"fmt"
 	"maps"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/flagship-io/flagship-common/targeting"
 	"github.com/flagship-io/flagship-proto/decision_response"
@@ -64,24 +67,24 @@ var campaigns = []*Campaign{
 	},
 }
 
-func mockGetCache(environmentID string, id string) (*VisitorAssignments, error) {
+func mockGetCache(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
 	vi := VisitorAssignments{}
 	return &vi, nil
 }
 
-func mockSaveCache(environmentID string, id string, assignment *VisitorAssignments) error {
+func mockSaveCache(ctx context.Context, environmentID string, id string, assignment *VisitorAssignments) error {
 	fmt.Println("Save cache environment", environmentID, "id", id, "assignments", assignment)
 	return nil
 }
 
-func mockActivateCampaigns(activations []*VisitorActivation) error {
+func mockActivateCampaigns(ctx context.Context, activations []*VisitorActivation) error {
 	fmt.Println("Activate campaigns", activations)
 	return nil
 }
 
 var cache = map[string]*VisitorAssignments{}
 
-func localGetCache(environmentID string, id string) (*VisitorAssignments, error) {
+func localGetCache(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
 	mu.Lock()
 	defer func() {
 		mu.Unlock()
@@ -89,7 +92,7 @@ func localGetCache(environmentID string, id string) (*VisitorAssignments, error)
 	return cache[environmentID+id], nil
 }
 
-func localSetCache(environmentID string, id string, assignment *VisitorAssignments) error {
+func localSetCache(ctx context.Context, environmentID string, id string, assignment *VisitorAssignments) error {
 	mu.Lock()
 	cache[environmentID+id] = assignment
 	mu.Unlock()
@@ -102,7 +105,7 @@ func TestGetCache(t *testing.T) {
 	anonymousID := "anonymous_id"
 	decisionGroup := "decisionGroup"
 
-	assignments, err := getCache(envID, visitorID, anonymousID, decisionGroup, false, localGetCache)
+	assignments, err := getCache(context.Background(), envID, visitorID, anonymousID, decisionGroup, false, localGetCache)
 	assert.Nil(t, err)
 	assert.Nil(t, assignments.Standard)
 	assert.Nil(t, assignments.Anonymous)
@@ -132,7 +135,7 @@ func TestGetCache(t *testing.T) {
 		Assignments: newAssignmentsDG,
 	}
 
-	assignments, err = getCache(envID, visitorID, anonymousID, decisionGroup, false, localGetCache)
+	assignments, err = getCache(context.Background(), envID, visitorID, anonymousID, decisionGroup, false, localGetCache)
 	assert.Nil(t, err)
 	assert.EqualValues(t, newAssignmentsDG, assignments.DecisionGroup.getAssignments())
 	assert.Nil(t, assignments.Standard)
@@ -142,7 +145,7 @@ func TestGetCache(t *testing.T) {
 		Assignments: maps.Clone(newAssignments),
 	}
 
-	assignments, err = getCache(envID, visitorID, anonymousID, decisionGroup, false, localGetCache)
+	assignments, err = getCache(context.Background(), envID, visitorID, anonymousID, decisionGroup, false, localGetCache)
 	assert.Nil(t, err)
 	assert.EqualValues(t, newAssignmentsDG, assignments.DecisionGroup.getAssignments())
 	assert.EqualValues(t, newAssignments, assignments.Standard.getAssignments())
@@ -152,7 +155,7 @@ func TestGetCache(t *testing.T) {
 		Assignments: maps.Clone(newAssignments),
 	}
 
-	assignments, err = getCache(envID, visitorID, anonymousID, decisionGroup, true, localGetCache)
+	assignments, err = getCache(context.Background(), envID, visitorID, anonymousID, decisionGroup, true, localGetCache)
 	assert.Nil(t, err)
 	assert.EqualValues(t, newAssignmentsDG, assignments.DecisionGroup.getAssignments())
 	assert.EqualValues(t, newAssignments, assignments.Standard.getAssignments())
@@ -308,3 +311,339 @@ func TestVisitorShouldNotBeAssignedWhenVariationDeleted(t *testing.T) {
 
 	assert.Len(t, decision.Campaigns, 0)
 }
+
+func TestGetCacheContextDone(t *testing.T) {
+	blockingGetCache := func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := getCache(ctx, "env_id", "visitor_id", "anonymous_id", "decisionGroup", true, blockingGetCache)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestGetDecisionContextDeadline(t *testing.T) {
+	vi := Visitor{
+		ID: "v1",
+		Context: &targeting.Context{
+			Standard: targeting.ContextMap{
+				"isVIP": structpb.NewBoolValue(true),
+			},
+		},
+	}
+
+	ei := Environment{
+		ID:           "e123",
+		CacheEnabled: true,
+		Campaigns: []*Campaign{
+			{
+				ID:           "c1",
+				BucketRanges: [][]float64{{0., 100.}},
+				VariationGroups: []*VariationGroup{
+					{
+						ID:         "vg1",
+						Targetings: createBoolTargeting(),
+						Variations: []*Variation{{ID: "v1", Allocation: 50}, {ID: "v2", Allocation: 50}},
+					},
+				},
+			},
+		},
+	}
+
+	// Cache fetches that outlive the context are abandoned
+	releaseGet := make(chan struct{})
+	blockingGetCache := func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+		<-releaseGet
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	decision, err := GetDecisionContext(ctx, vi, ei, DecisionOptions{}, DecisionHandlers{
+		GetCache: blockingGetCache,
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Len(t, decision.Campaigns, 0)
+	close(releaseGet)
+
+	// Blocked saves and activations are detached when the context is done,
+	// and complete with a context that is not canceled
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	saved := make(chan error, 1)
+	blockingSaveCache := func(ctx context.Context, environmentID string, id string, assignment *VisitorAssignments) error {
+		started <- struct{}{}
+		<-release
+		saved <- ctx.Err()
+		return nil
+	}
+	activated := make(chan error, 1)
+	blockingActivate := func(ctx context.Context, activations []*VisitorActivation) error {
+		started <- struct{}{}
+		<-release
+		activated <- ctx.Err()
+		return nil
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	type decisionResult struct {
+		campaigns int
+		err       error
+	}
+	decided := make(chan decisionResult, 1)
+	go func() {
+		decision, err := GetDecisionContext(ctx, vi, ei, DecisionOptions{TriggerHit: true}, DecisionHandlers{
+			GetCache:          mockGetCache,
+			SaveCache:         blockingSaveCache,
+			ActivateCampaigns: blockingActivate,
+		})
+		decided <- decisionResult{campaigns: len(decision.Campaigns), err: err}
+	}()
+
+	<-started
+	<-started
+	cancel()
+	result := <-decided
+	assert.Nil(t, result.err)
+	assert.Equal(t, 1, result.campaigns)
+
+	close(release)
+	assert.Nil(t, <-saved)
+	assert.Nil(t, <-activated)
+}
+
+func TestDecisionPanic(t *testing.T) {
+	vi := Visitor{
+		ID: "v1",
+		Context: &targeting.Context{
+			Standard: targeting.ContextMap{
+				"isVIP": structpb.NewBoolValue(true),
+			},
+		},
+	}
+
+	ei := Environment{
+		ID:           "e123",
+		IsPanic:      true,
+		CacheEnabled: true,
+		Campaigns: []*Campaign{
+			{
+				ID:           "c1",
+				BucketRanges: [][]float64{{0., 100.}},
+				VariationGroups: []*VariationGroup{
+					{
+						ID:         "vg1",
+						Targetings: createBoolTargeting(),
+						Variations: []*Variation{{ID: "v1", Allocation: 50}, {ID: "v2", Allocation: 50}},
+					},
+				},
+			},
+		},
+	}
+
+	failHandler := func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+		t.Error("cache should not be read in panic mode")
+		return nil, nil
+	}
+	handlers := DecisionHandlers{
+		GetCache: failHandler,
+		SaveCache: func(ctx context.Context, environmentID string, id string, assignment *VisitorAssignments) error {
+			t.Error("cache should not be saved in panic mode")
+			return nil
+		},
+		ActivateCampaigns: func(ctx context.Context, activations []*VisitorActivation) error {
+			t.Error("campaigns should not be activated in panic mode")
+			return nil
+		},
+	}
+
+	explanation := &DecisionExplanation{}
+	decision, err := GetDecision(vi, ei, DecisionOptions{TriggerHit: true, Explanation: explanation}, handlers)
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", decision.VisitorId.Value)
+	assert.Len(t, decision.Campaigns, 0)
+	assert.True(t, IsPanicResponse(decision))
+	assert.True(t, explanation.Panic)
+	ce, _ := explanation.Campaign("c1")
+	assert.Equal(t, SkipReasonPanic, ce.SkipReason)
+
+	ei.IsPanic = false
+	handlers.GetCache = mockGetCache
+	handlers.SaveCache = nil
+	handlers.ActivateCampaigns = nil
+	decision, err = GetDecision(vi, ei, DecisionOptions{}, handlers)
+	assert.Nil(t, err)
+	assert.Len(t, decision.Campaigns, 1)
+	assert.False(t, IsPanicResponse(decision))
+}
+
+func TestDecisionPriority(t *testing.T) {
+	vi := Visitor{
+		ID: "v1",
+		Context: &targeting.Context{
+			Standard: targeting.ContextMap{
+				"isVIP": structpb.NewBoolValue(true),
+			},
+		},
+	}
+
+	createABCampaign := func(id string, priority int) *Campaign {
+		return &Campaign{
+			ID:           id,
+			Type:         "ab",
+			Priority:     priority,
+			BucketRanges: [][]float64{{0., 100.}},
+			VariationGroups: []*VariationGroup{
+				{
+					ID:         "vg_" + id,
+					Targetings: createBoolTargeting(),
+					Variations: []*Variation{{ID: "v_" + id, Allocation: 100}},
+				},
+			},
+		}
+	}
+
+	ei := Environment{
+		ID:               "e123",
+		SingleAssignment: true,
+		Campaigns:        []*Campaign{createABCampaign("c1", 0), createABCampaign("c2", 1)},
+	}
+
+	// Single assignment should assign the campaign with the highest priority, whatever the slice order
+	decision, err := GetDecision(vi, ei, DecisionOptions{}, DecisionHandlers{})
+	assert.Nil(t, err)
+	assert.Len(t, decision.Campaigns, 1)
+	assert.Equal(t, "c2", decision.Campaigns[0].Id.Value)
+
+	ei.Campaigns = []*Campaign{ei.Campaigns[1], ei.Campaigns[0]}
+	decision, err = GetDecision(vi, ei, DecisionOptions{}, DecisionHandlers{})
+	assert.Nil(t, err)
+	assert.Len(t, decision.Campaigns, 1)
+	assert.Equal(t, "c2", decision.Campaigns[0].Id.Value)
+
+	// Campaigns should be returned in priority order
+	ei.SingleAssignment = false
+	ei.Campaigns = []*Campaign{createABCampaign("c1", 0), createABCampaign("c3", 0), createABCampaign("c2", 1)}
+	decision, err = GetDecision(vi, ei, DecisionOptions{}, DecisionHandlers{})
+	assert.Nil(t, err)
+	assert.Len(t, decision.Campaigns, 3)
+	assert.Equal(t, "c2", decision.Campaigns[0].Id.Value)
+	assert.Equal(t, "c1", decision.Campaigns[1].Id.Value)
+	assert.Equal(t, "c3", decision.Campaigns[2].Id.Value)
+}
+
+func TestMergeAssignments(t *testing.T) {
+	now := time.Now()
+	existing := &VisitorAssignments{
+		Timestamp: 1,
+		Version:   3,
+		Assignments: map[string]*VisitorCache{
+			"vg1": {VariationID: "v1", Activated: false},
+			"vg2": {VariationID: "v2", Activated: true},
+		},
+	}
+
+	merged := mergeAssignments(existing, map[string]*VisitorCache{
+		"vg1": {VariationID: "v1", Activated: true},
+		"vg3": {VariationID: "v3"},
+	}, now, &Environment{})
+	assert.Equal(t, now.Unix(), merged.Timestamp)
+	assert.Equal(t, int64(3), merged.Version)
+	assert.Len(t, merged.Assignments, 3)
+	assert.True(t, merged.Assignments["vg1"].Activated)
+	assert.Equal(t, "v2", merged.Assignments["vg2"].VariationID)
+
+	// The existing assignments should not be modified
+	assert.Len(t, existing.Assignments, 2)
+	assert.False(t, existing.Assignments["vg1"].Activated)
+
+	merged = mergeAssignments(nil, map[string]*VisitorCache{"vg1": {VariationID: "v1"}}, now, &Environment{})
+	assert.Equal(t, int64(0), merged.Version)
+	assert.Len(t, merged.Assignments, 1)
+}
+
+func TestCompareAndSaveAssignments(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryAssignmentStore(0)
+	assert.Nil(t, store.Save(ctx, "env", "vis1", &VisitorAssignments{Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1"}}}))
+
+	// The outdated existing assignments should be reloaded on conflict
+	err := compareAndSaveAssignments(ctx, &Environment{ID: "env"}, "vis1", nil, map[string]*VisitorCache{"vg2": {VariationID: "v2"}}, time.Now(), store.Get, store.CompareAndSave)
+	assert.Nil(t, err)
+	a, _ := store.Get(ctx, "env", "vis1")
+	assert.Len(t, a.Assignments, 2)
+	assert.Equal(t, int64(2), a.Version)
+
+	alwaysConflicting := func(ctx context.Context, environmentID string, id string, assignment *VisitorAssignments) error {
+		return VersionConflictError
+	}
+	err = compareAndSaveAssignments(ctx, &Environment{ID: "env"}, "vis1", nil, map[string]*VisitorCache{"vg2": {VariationID: "v2"}}, time.Now(), store.Get, alwaysConflicting)
+	assert.Equal(t, VersionConflictError, err)
+	err = compareAndSaveAssignments(ctx, &Environment{ID: "env"}, "vis1", nil, map[string]*VisitorCache{"vg2": {VariationID: "v2"}}, time.Now(), nil, alwaysConflicting)
+	assert.Equal(t, VersionConflictError, err)
+}
+
+func TestGetDecisionConcurrentSaves(t *testing.T) {
+	createEnvironment := func(vgID string) Environment {
+		return Environment{
+			ID:           "env_id",
+			CacheEnabled: true,
+			Campaigns: []*Campaign{
+				{
+					ID:           "c_" + vgID,
+					BucketRanges: [][]float64{{0., 100.}},
+					VariationGroups: []*VariationGroup{
+						{
+							ID:         vgID,
+							Targetings: createBoolTargeting(),
+							Variations: []*Variation{{ID: "v1", Allocation: 50}, {ID: "v2", Allocation: 50}},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	store := NewMemoryAssignmentStore(0)
+
+	// Both decisions load the assignments before any of them saves, so that one of the saves conflicts
+	var loaded sync.WaitGroup
+	var nbLoads int32
+	loaded.Add(2)
+	handlers := DecisionHandlers{
+		GetCache: func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+			assignments, err := store.Get(ctx, environmentID, id)
+			if atomic.AddInt32(&nbLoads, 1) <= 2 {
+				loaded.Done()
+				loaded.Wait()
+			}
+			return assignments, err
+		},
+		CompareAndSaveCache: store.CompareAndSave,
+	}
+
+	var wg sync.WaitGroup
+	for _, vgID := range []string{"vg1", "vg2"} {
+		wg.Add(1)
+		go func(vgID string) {
+			defer wg.Done()
+			decision, err := GetDecision(createBatchVisitor("vis1", true), createEnvironment(vgID), DecisionOptions{}, handlers)
+			assert.Nil(t, err)
+			assert.Len(t, decision.Campaigns, 1)
+		}(vgID)
+	}
+	wg.Wait()
+
+	a, _ := store.Get(context.Background(), "env_id", "vis1")
+	assert.Len(t, a.Assignments, 2)
+	assert.Contains(t, a.Assignments, "vg1")
+	assert.Contains(t, a.Assignments, "vg2")
+	assert.Equal(t, int64(2), a.Version)
+
+	// The conflicting save should have reloaded the assignments
+	assert.Equal(t, int32(3), atomic.LoadInt32(&nbLoads))
+}
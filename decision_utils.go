@@ -1,17 +1,29 @@
 package decision
 
 import (
+	"context"
 	"errors"
+	"sort"
+	"sync"
 
 	"github.com/flagship-io/flagship-common/internal/utils"
 	"github.com/flagship-io/flagship-common/targeting"
 	"github.com/flagship-io/flagship-proto/decision_response"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/structpb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
+// PanicExtraKey is the decision response extra key that marks a decision made in panic mode
+const PanicExtraKey = "panic"
+
+// DeletedVariationError is returned when the visitor is assigned to a variation that does not exist anymore
+var DeletedVariationError = errors.New("visitor ID assigned to deleted variation")
+
 type ChosenVariationResult struct {
 	chosenVariation        *Variation
+	source                 VariationSource
 	newAssignment          *VisitorCache
 	newAssignmentAnonymous *VisitorCache
 }
@@ -46,10 +58,30 @@ func deduplicateCampaigns(campaigns []*Campaign) []*Campaign {
 	return cArray
 }
 
+// sortCampaignsByPriority sorts the campaigns by descending priority, then by ascending creation date, then by ascending ID
+func sortCampaignsByPriority(campaigns []*Campaign) {
+	sort.SliceStable(campaigns, func(i, j int) bool {
+		ci, cj := campaigns[i], campaigns[j]
+		if ci.Priority != cj.Priority {
+			return ci.Priority > cj.Priority
+		}
+		if !ci.CreatedAt.Equal(cj.CreatedAt) {
+			return ci.CreatedAt.Before(cj.CreatedAt)
+		}
+		return ci.ID < cj.ID
+	})
+}
+
 // getVariationGroup returns the first variationGroup that matches the visitorId and context
 func getVariationGroup(variationGroups []*VariationGroup, visitorID string, context *targeting.Context) *VariationGroup {
 	for _, variationGroup := range variationGroups {
-		match, err := targetingMatch(variationGroup.Targetings, visitorID, context)
+		var match bool
+		var err error
+		if variationGroup.compiledTargetings != nil {
+			match, err = variationGroup.compiledTargetings.match(visitorID, context)
+		} else {
+			match, err = targetingMatch(variationGroup.Targetings, visitorID, context)
+		}
 		if err != nil {
 			logger.Logf(WarnLevel, "targeting match error variationGroupId %s, user %s: %s", variationGroup.ID, visitorID, err)
 		}
@@ -61,7 +93,7 @@ func getVariationGroup(variationGroups []*VariationGroup, visitorID string, cont
 }
 
 // getCampaignsVG returns the variation groups that target visitor
-func getCampaignsVG(campaigns []*Campaign, visitorID string, context *targeting.Context) []*VariationGroup {
+func getCampaignsVG(campaigns []*Campaign, visitorID string, context *targeting.Context, explanation *DecisionExplanation) []*VariationGroup {
 	campaignVG := []*VariationGroup{}
 	existingCampaignVG := make(map[string]bool)
 	for _, campaign := range campaigns {
@@ -74,9 +106,12 @@ func getCampaignsVG(campaigns []*Campaign, visitorID string, context *targeting.
 		vg := getVariationGroup(campaign.VariationGroups, visitorID, context)
 
 		if vg == nil {
+			explanation.skip(campaign.ID, SkipReasonNoTargetingMatch)
 			continue
 		}
-		vg.Campaign = campaign
+		if ce := explanation.campaign(campaign.ID); ce != nil {
+			ce.VariationGroupID = vg.ID
+		}
 		existingCampaignVG[campaign.ID] = true
 		campaignVG = append(campaignVG, vg)
 	}
@@ -176,22 +211,28 @@ func chooseVariation(
 		// Variation has been deleted
 		if existingVariation == nil && existingAnonymousVariation == nil {
 			logger.Logf(DebugLevel, "visitor ID %s was already assigned to deleted variation ID %s", visitorID, existingAssignment.VariationID)
-			return nil, errors.New("visitor ID assigned to deleted variation")
+			return nil, DeletedVariationError
 		}
 	}
 
 	var isNew, isNewAnonymous bool
 	var chosenVariation *Variation
+	var source VariationSource
 	var err error
 
 	// If already has variation && assigned variation ID  exist, visitor should not be re-assigned
 	if existingVariation != nil {
 		logger.Logf(DebugLevel, "visitor already assigned to variation ID %s", existingVariation.ID)
 		chosenVariation = existingVariation
+		source = VariationSourceCache
+		if existingVariation == existingDecisionGroupVariation {
+			source = VariationSourceDecisionGroupCache
+		}
 	} else if existingAnonymousVariation != nil {
 		// If reconciliation is on, find anonymous variation as set vid to that variation ID
 		logger.Logf(DebugLevel, "anonymous ID already assigned to variation ID %s", existingAnonymousVariation.ID)
 		chosenVariation = existingAnonymousVariation
+		source = VariationSourceAnonymousCache
 		isNew = true
 	} else {
 		// Else compute new allocation
@@ -201,6 +242,7 @@ func chooseVariation(
 			return nil, err
 		}
 		logger.Logf(DebugLevel, "visitor ID %s got assigned to variation ID %s", visitorID, chosenVariation.ID)
+		source = VariationSourceAllocation
 		isNew = true
 		isNewAnonymous = true
 	}
@@ -227,6 +269,7 @@ func chooseVariation(
 
 	return &ChosenVariationResult{
 		chosenVariation:        chosenVariation,
+		source:                 source,
 		newAssignment:          newAssignment,
 		newAssignmentAnonymous: newAssignmentAnonymous,
 	}, nil
@@ -244,34 +287,32 @@ func buildCampaignResponse(vg *VariationGroup, variation *Variation, exposeAllKe
 		campaignResponse.Slug = wrapperspb.String(*vg.Campaign.Slug)
 	}
 
+	// Variation modifications are shared between decisions, so they are cloned before being modified
+	modifications := variation.Modifications
 	if exposeAllKeys {
 		logger.Logf(DebugLevel, "filling non existant keys in variation with null value")
-		if variation.Modifications == nil {
-			variation.Modifications = &decision_response.Modifications{}
-		}
-		if variation.Modifications.Value == nil {
-			variation.Modifications.Value = &structpb.Struct{}
+		modifications = cloneModifications(modifications)
+		if modifications.Value == nil {
+			modifications.Value = &structpb.Struct{}
 		}
-		if variation.Modifications.Value.Fields == nil {
-			variation.Modifications.Value.Fields = map[string]*structpb.Value{}
+		if modifications.Value.Fields == nil {
+			modifications.Value.Fields = map[string]*structpb.Value{}
 		}
 		for _, v := range vg.Variations {
 			if v.Modifications != nil && v.Modifications.Value != nil && v.Modifications.Value.Fields != nil {
 				for key := range v.Modifications.Value.Fields {
-					if _, ok := variation.Modifications.Value.Fields[key]; !ok {
-						variation.Modifications.Value.Fields[key] = &structpb.Value{Kind: &structpb.Value_NullValue{}}
+					if _, ok := modifications.Value.Fields[key]; !ok {
+						modifications.Value.Fields[key] = &structpb.Value{Kind: &structpb.Value_NullValue{}}
 					}
 				}
 			}
 		}
-	} else {
-		if variation.Modifications != nil && variation.Modifications.Value != nil {
-			for key, val := range variation.Modifications.Value.Fields {
-				_, okCast := val.GetKind().(*structpb.Value_NullValue)
-				if okCast {
-					// Remove nil value keys if shouldFillKeys is false
-					delete(variation.Modifications.Value.Fields, key)
-				}
+	} else if hasNullValue(modifications) {
+		// Remove nil value keys if shouldFillKeys is false
+		modifications = cloneModifications(modifications)
+		for key, val := range modifications.Value.Fields {
+			if _, okCast := val.GetKind().(*structpb.Value_NullValue); okCast {
+				delete(modifications.Value.Fields, key)
 			}
 		}
 	}
@@ -279,7 +320,7 @@ func buildCampaignResponse(vg *VariationGroup, variation *Variation, exposeAllKe
 	protoModif := &decision_response.Variation{
 		Id:            wrapperspb.String(variation.ID),
 		Name:          wrapperspb.String(variation.Name),
-		Modifications: variation.Modifications,
+		Modifications: modifications,
 		Reference:     variation.Reference,
 	}
 
@@ -287,3 +328,88 @@ func buildCampaignResponse(vg *VariationGroup, variation *Variation, exposeAllKe
 	campaignResponse.Type = wrapperspb.String(vg.Campaign.Type)
 	return &campaignResponse
 }
+
+// activateCampaigns sends the activations in a new goroutine
+func activateCampaigns(
+	ctx context.Context,
+	wg *sync.WaitGroup,
+	tracker *Tracker,
+	activateHandler func(ctx context.Context, activations []*VisitorActivation) error,
+	activations []*VisitorActivation,
+) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		tracker.TimeTrack("start activating campaigns hit")
+		logger.Logf(InfoLevel, "activating %d campaigns and variations", len(activations))
+		err := activateHandler(ctx, activations)
+		if err != nil {
+			logger.Logf(ErrorLevel, "error occured on campaign activation: %v", err)
+		}
+		tracker.TimeTrack("end activating campaigns hit")
+	}()
+}
+
+// waitSideEffects waits for the side effects to finish, or detaches them if the context is done before
+func waitSideEffects(ctx context.Context, wg *sync.WaitGroup) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logger.Logf(WarnLevel, "context done before side effects completed, detaching them: %v", ctx.Err())
+	}
+}
+
+// buildPanicResponse creates an empty decision response marked as made in panic mode
+func buildPanicResponse(visitorID string) *decision_response.DecisionResponse {
+	decisionResponse := &decision_response.DecisionResponse{
+		VisitorId: wrapperspb.String(visitorID),
+		Campaigns: []*decision_response.Campaign{},
+	}
+
+	panicMarker, err := anypb.New(wrapperspb.Bool(true))
+	if err != nil {
+		logger.Logf(ErrorLevel, "error occured when building panic marker: %v", err)
+		return decisionResponse
+	}
+	decisionResponse.Extras = map[string]*anypb.Any{
+		PanicExtraKey: panicMarker,
+	}
+	return decisionResponse
+}
+
+// IsPanicResponse returns true if the decision response has been made in panic mode
+func IsPanicResponse(decisionResponse *decision_response.DecisionResponse) bool {
+	panicMarker, ok := decisionResponse.GetExtras()[PanicExtraKey]
+	if !ok {
+		return false
+	}
+	value := &wrapperspb.BoolValue{}
+	if err := panicMarker.UnmarshalTo(value); err != nil {
+		return false
+	}
+	return value.GetValue()
+}
+
+// cloneModifications returns a deep copy of the modifications, or empty modifications if nil
+func cloneModifications(modifications *decision_response.Modifications) *decision_response.Modifications {
+	if modifications == nil {
+		return &decision_response.Modifications{}
+	}
+	return proto.Clone(modifications).(*decision_response.Modifications)
+}
+
+// hasNullValue returns true if at least one of the modifications keys has a null value
+func hasNullValue(modifications *decision_response.Modifications) bool {
+	for _, val := range modifications.GetValue().GetFields() {
+		if _, okCast := val.GetKind().(*structpb.Value_NullValue); okCast {
+			return true
+		}
+	}
+	return false
+}
@@ -9,7 +9,9 @@ import (
 	protoTargeting "github.com/flagship-io/flagship-proto/targeting"
 	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 func createNumberTargeting() *protoTargeting.Targeting {
@@ -159,7 +161,7 @@ func TestGetCampaignsVG(t *testing.T) {
 			VariationGroups: vgsNotTargeted,
 		},
 	}
-	vgsResp := getCampaignsVG(campaignInfos, "testVID", context)
+	vgsResp := getCampaignsVG(campaignInfos, "testVID", context, nil)
 	assert.Equal(t, vg1, vgsResp[0])
 	assert.Equal(t, 1, len(vgsResp))
 }
@@ -244,3 +246,37 @@ func TestBuildCampaignResponse(t *testing.T) {
 		"bool2": true,
 	}, resp.Variation.Modifications.Value.AsMap())
 }
+
+func TestIsPanicResponse(t *testing.T) {
+	assert.False(t, IsPanicResponse(nil))
+	assert.False(t, IsPanicResponse(&decision_response.DecisionResponse{}))
+
+	resp := buildPanicResponse("vid")
+	assert.Equal(t, "vid", resp.VisitorId.Value)
+	assert.Len(t, resp.Campaigns, 0)
+	assert.True(t, IsPanicResponse(resp))
+
+	notBool, _ := anypb.New(wrapperspb.String("true"))
+	resp.Extras[PanicExtraKey] = notBool
+	assert.False(t, IsPanicResponse(resp))
+}
+
+func TestSortCampaignsByPriority(t *testing.T) {
+	now := time.Now()
+	campaignsArray := []*Campaign{
+		{ID: "c_old_low", CreatedAt: now.Add(-time.Hour)},
+		{ID: "c_new_high", CreatedAt: now, Priority: 10},
+		{ID: "c_b_new", CreatedAt: now},
+		{ID: "c_a_new", CreatedAt: now},
+		{ID: "c_old_high", CreatedAt: now.Add(-time.Hour), Priority: 10},
+		{ID: "c_negative", CreatedAt: now.Add(-2 * time.Hour), Priority: -1},
+	}
+
+	sortCampaignsByPriority(campaignsArray)
+
+	ids := []string{}
+	for _, c := range campaignsArray {
+		ids = append(ids, c.ID)
+	}
+	assert.Equal(t, []string{"c_old_high", "c_new_high", "c_old_low", "c_a_new", "c_b_new", "c_negative"}, ids)
+}
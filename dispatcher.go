@@ -0,0 +1,428 @@
+package decision
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DispatcherClosedError is returned when enqueuing side effects in a closed dispatcher
+var DispatcherClosedError = errors.New("dispatcher closed")
+
+// DispatcherQueueFullError is returned when side effects are dropped because the dispatcher queue is full
+var DispatcherQueueFullError = errors.New("dispatcher queue full")
+
+// DropPolicy defines how the dispatcher behaves when its queue is full
+type DropPolicy int
+
+const (
+	// DropPolicyBlock blocks the caller until there is room in the queue or its context is done. It is the default policy
+	DropPolicyBlock DropPolicy = iota
+	// DropPolicyDropNewest drops the side effects being enqueued
+	DropPolicyDropNewest
+	// DropPolicyDropOldest drops the oldest queued side effects to make room for the new ones
+	DropPolicyDropOldest
+)
+
+const (
+	defaultDispatcherQueueSize     = 10000
+	defaultDispatcherBatchSize     = 100
+	defaultDispatcherFlushInterval = 100 * time.Millisecond
+)
+
+// DispatcherOptions configures the dispatcher queue and batches
+type DispatcherOptions struct {
+	// QueueSize is the maximum number of queued assignments saves and activations. Defaults to 10000
+	QueueSize int
+	// BatchSize is the maximum number of queued items written at once. Defaults to 100
+	BatchSize int
+	// FlushInterval is the maximum time an item stays in the queue before being written. Defaults to 100ms
+	FlushInterval time.Duration
+	// DropPolicy defines the behaviour when the queue is full
+	DropPolicy DropPolicy
+}
+
+// Dispatcher writes the assignments saves and campaign activations in the background, batching them across decisions.
+// Use its SaveCache, BatchSaveCache and ActivateCampaigns methods as decision handlers,
+// so that decisions only enqueue their side effects and return without waiting for the writes.
+// When the CompareAndSaveCache handler is set, or the AssignmentStore supports it, the assignments of each ID are saved
+// with optimistic concurrency and merged into the stored ones on version conflict, so that queued saves never drop each other's assignments
+type Dispatcher struct {
+	handlers BatchDecisionHandlers
+	options  DispatcherOptions
+
+	mu     sync.Mutex
+	queue  []*dispatchItem
+	closed bool
+
+	// slots bounds the number of queued and in-flight items
+	slots   chan struct{}
+	wake    chan struct{}
+	flushes chan chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	dropped int64
+}
+
+type dispatchItem struct {
+	environmentID string
+	id            string
+	assignments   *VisitorAssignments
+	activation    *VisitorActivation
+}
+
+// NewDispatcher creates and starts a dispatcher writing with the BatchSaveCache, or the AssignmentStore,
+// and ActivateCampaigns handlers
+func NewDispatcher(handlers BatchDecisionHandlers, options DispatcherOptions) *Dispatcher {
+	if options.QueueSize <= 0 {
+		options.QueueSize = defaultDispatcherQueueSize
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaultDispatcherBatchSize
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = defaultDispatcherFlushInterval
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{
+		handlers: handlers.withAssignmentStore(),
+		options:  options,
+		slots:    make(chan struct{}, options.QueueSize),
+		wake:     make(chan struct{}, 1),
+		flushes:  make(chan chan struct{}),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	go d.run()
+	return d
+}
+
+// SaveCache enqueues the assignments save of the ID
+func (d *Dispatcher) SaveCache(ctx context.Context, environmentID string, id string, assignments *VisitorAssignments) error {
+	return d.enqueue(ctx, &dispatchItem{
+		environmentID: environmentID,
+		id:            id,
+		assignments:   assignments.clone(),
+	})
+}
+
+// BatchSaveCache enqueues the assignments saves of the IDs
+func (d *Dispatcher) BatchSaveCache(ctx context.Context, environmentID string, assignments map[string]*VisitorAssignments) error {
+	var errs []error
+	for id, a := range assignments {
+		if err := d.SaveCache(ctx, environmentID, id, a); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ActivateCampaigns enqueues the campaign activations
+func (d *Dispatcher) ActivateCampaigns(ctx context.Context, activations []*VisitorActivation) error {
+	var errs []error
+	for _, a := range activations {
+		if err := d.enqueue(ctx, &dispatchItem{activation: a}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Dropped returns the number of side effects dropped because the queue was full
+func (d *Dispatcher) Dropped() int64 {
+	return atomic.LoadInt64(&d.dropped)
+}
+
+// Len returns the number of queued side effects
+func (d *Dispatcher) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.queue)
+}
+
+// Flush writes all the queued side effects and waits for them to be written or for the context to be done
+func (d *Dispatcher) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case d.flushes <- flushed:
+	case <-d.done:
+		return DispatcherClosedError
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting side effects, writes the queued ones and stops the dispatcher.
+// If the context is done before, the context of the pending writes is cancelled and the context error is returned
+func (d *Dispatcher) Close(ctx context.Context) error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closed = true
+	d.mu.Unlock()
+
+	close(d.stop)
+
+	select {
+	case <-d.done:
+		d.cancel()
+		return nil
+	case <-ctx.Done():
+		d.cancel()
+		return ctx.Err()
+	}
+}
+
+// enqueue adds the item to the queue according to the drop policy
+func (d *Dispatcher) enqueue(ctx context.Context, item *dispatchItem) error {
+	d.mu.Lock()
+	closed := d.closed
+	d.mu.Unlock()
+	if closed {
+		return DispatcherClosedError
+	}
+
+	select {
+	case d.slots <- struct{}{}:
+	default:
+		switch d.options.DropPolicy {
+		case DropPolicyDropNewest:
+			atomic.AddInt64(&d.dropped, 1)
+			logger.Logf(WarnLevel, "dispatcher queue full, dropping new item")
+			return DispatcherQueueFullError
+		case DropPolicyDropOldest:
+			if d.replaceOldest(item) {
+				return nil
+			}
+			// All the slots are used by in-flight items, so the new item is dropped
+			atomic.AddInt64(&d.dropped, 1)
+			logger.Logf(WarnLevel, "dispatcher queue full, dropping new item")
+			return DispatcherQueueFullError
+		default:
+			select {
+			case d.slots <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		<-d.slots
+		return DispatcherClosedError
+	}
+	d.queue = append(d.queue, item)
+	shouldWake := len(d.queue) >= d.options.BatchSize
+	d.mu.Unlock()
+
+	if shouldWake {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// replaceOldest drops the oldest queued item and enqueues the new one in its slot.
+// It returns false if the queue is empty
+func (d *Dispatcher) replaceOldest(item *dispatchItem) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed || len(d.queue) == 0 {
+		return false
+	}
+	d.queue = append(d.queue[1:], item)
+	atomic.AddInt64(&d.dropped, 1)
+	logger.Logf(WarnLevel, "dispatcher queue full, dropping oldest item")
+	return true
+}
+
+// run writes the queued items when a batch is full, on each flush interval, on flush and on close
+func (d *Dispatcher) run() {
+	defer close(d.done)
+
+	ticker := time.NewTicker(d.options.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.wake:
+			d.dispatch(false)
+		case <-ticker.C:
+			d.dispatch(true)
+		case flushed := <-d.flushes:
+			d.dispatch(true)
+			close(flushed)
+		case <-d.stop:
+			d.dispatch(true)
+			return
+		}
+	}
+}
+
+// dispatch writes the queued items by batches, all of them or only the full batches
+func (d *Dispatcher) dispatch(all bool) {
+	for {
+		d.mu.Lock()
+		n := len(d.queue)
+		if n > d.options.BatchSize {
+			n = d.options.BatchSize
+		}
+		if n == 0 || (!all && n < d.options.BatchSize) {
+			d.mu.Unlock()
+			return
+		}
+		batch := d.queue[:n:n]
+		d.queue = d.queue[n:]
+		d.mu.Unlock()
+
+		d.write(batch)
+		for range batch {
+			<-d.slots
+		}
+	}
+}
+
+// write saves the assignments of the batch, merging the ones of the same ID, and sends its activations
+func (d *Dispatcher) write(batch []*dispatchItem) {
+	saves := map[string]map[string]*VisitorAssignments{}
+	activations := []*VisitorActivation{}
+	for _, item := range batch {
+		if item.activation != nil {
+			activations = append(activations, item.activation)
+			continue
+		}
+		envSaves, ok := saves[item.environmentID]
+		if !ok {
+			envSaves = map[string]*VisitorAssignments{}
+			saves[item.environmentID] = envSaves
+		}
+		if existing, ok := envSaves[item.id]; ok && existing != nil && item.assignments != nil {
+			envSaves[item.id] = mergeQueuedAssignments(existing, item.assignments)
+			continue
+		}
+		envSaves[item.id] = item.assignments
+	}
+
+	for envID, envSaves := range saves {
+		logger.Logf(InfoLevel, "dispatching assignments cache for %d IDs", len(envSaves))
+		if d.handlers.CompareAndSaveCache != nil {
+			d.compareAndSave(envID, envSaves)
+		} else if d.handlers.BatchSaveCache != nil {
+			if err := d.handlers.BatchSaveCache(d.ctx, envID, envSaves); err != nil {
+				logger.Logf(ErrorLevel, "error occurred on dispatched cache saving: %v", err)
+			}
+		}
+	}
+
+	if len(activations) > 0 && d.handlers.ActivateCampaigns != nil {
+		logger.Logf(InfoLevel, "dispatching %d campaign activations", len(activations))
+		if err := d.handlers.ActivateCampaigns(d.ctx, activations); err != nil {
+			logger.Logf(ErrorLevel, "error occurred on dispatched campaign activation: %v", err)
+		}
+	}
+}
+
+// compareAndSave saves the assignments of each ID in parallel with optimistic concurrency.
+// On version conflict, the assignments are merged into the reloaded ones and saved again
+func (d *Dispatcher) compareAndSave(environmentID string, saves map[string]*VisitorAssignments) {
+	var wg sync.WaitGroup
+	for id, assignments := range saves {
+		wg.Add(1)
+		go func(id string, assignments *VisitorAssignments) {
+			defer wg.Done()
+			if err := d.compareAndSaveID(environmentID, id, assignments); err != nil {
+				logger.Logf(ErrorLevel, "error occurred on dispatched cache saving for %s: %v", id, err)
+			}
+		}(id, assignments)
+	}
+	wg.Wait()
+}
+
+// compareAndSaveID saves the assignments of the ID if the stored version is the one they were merged with.
+// Otherwise, the stored assignments are reloaded and the queued ones are merged into them
+func (d *Dispatcher) compareAndSaveID(environmentID string, id string, assignments *VisitorAssignments) error {
+	if assignments == nil {
+		return nil
+	}
+
+	toSave := assignments
+	var err error
+	for i := 0; i < maxCompareAndSaveAttempts; i++ {
+		if i > 0 {
+			if d.handlers.BatchGetCache == nil {
+				return err
+			}
+			logger.Logf(DebugLevel, "assignments version conflict for %s, reloading assignments", id)
+			stored, getErr := d.handlers.BatchGetCache(d.ctx, environmentID, []string{id})
+			if getErr != nil {
+				return getErr
+			}
+			toSave = mergeQueuedAssignments(stored[id], assignments)
+		}
+
+		err = d.handlers.CompareAndSaveCache(d.ctx, environmentID, id, toSave)
+		if !errors.Is(err, VersionConflictError) {
+			return err
+		}
+	}
+	return err
+}
+
+// mergeQueuedAssignments returns a copy of the queued assignments merged into the existing ones, with the existing version.
+// The queued assignments take precedence, and the existing ones of other variation groups are kept.
+// The TTL is extended to the latest expiry of both, and never expires if any of them never does
+func mergeQueuedAssignments(existing *VisitorAssignments, queued *VisitorAssignments) *VisitorAssignments {
+	merged := queued.clone()
+	merged.Version = 0
+	if existing == nil {
+		return merged
+	}
+
+	merged.Version = existing.Version
+	if merged.Assignments == nil {
+		merged.Assignments = make(map[string]*VisitorCache, len(existing.Assignments))
+	}
+	for vgID, a := range existing.Assignments {
+		if _, ok := merged.Assignments[vgID]; !ok {
+			merged.Assignments[vgID] = a
+		}
+	}
+	merged.History = mergeHistory(existing.History, queued.History)
+
+	if existing.Timestamp > merged.Timestamp {
+		merged.Timestamp = existing.Timestamp
+	}
+	if existing.TTL <= 0 || queued.TTL <= 0 {
+		merged.TTL = 0
+	} else {
+		expiry := time.Unix(existing.Timestamp, 0).Add(existing.TTL)
+		if queuedExpiry := time.Unix(queued.Timestamp, 0).Add(queued.TTL); queuedExpiry.After(expiry) {
+			expiry = queuedExpiry
+		}
+		merged.TTL = expiry.Sub(time.Unix(merged.Timestamp, 0))
+	}
+	return merged
+}
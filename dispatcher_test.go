@@ -0,0 +1,240 @@
+package decision
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type dispatcherRecorder struct {
+	mu          sync.Mutex
+	saves       []map[string]*VisitorAssignments
+	activations [][]*VisitorActivation
+}
+
+func (r *dispatcherRecorder) handlers() BatchDecisionHandlers {
+	return BatchDecisionHandlers{
+		BatchSaveCache: func(ctx context.Context, environmentID string, assignments map[string]*VisitorAssignments) error {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.saves = append(r.saves, assignments)
+			return nil
+		},
+		ActivateCampaigns: func(ctx context.Context, activations []*VisitorActivation) error {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.activations = append(r.activations, activations)
+			return nil
+		},
+	}
+}
+
+func (r *dispatcherRecorder) counts() (int, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.saves), len(r.activations)
+}
+
+func createActivation(id string) []*VisitorActivation {
+	return []*VisitorActivation{{EnvironmentID: "env_id", VisitorID: id, VariationGroupID: "vg1", VariationID: "v1"}}
+}
+
+func TestDispatcherDecisions(t *testing.T) {
+	recorder := &dispatcherRecorder{}
+	dispatcher := NewDispatcher(recorder.handlers(), DispatcherOptions{FlushInterval: time.Hour})
+	handlers := DecisionHandlers{
+		GetCache: func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+			return nil, nil
+		},
+		SaveCache:         dispatcher.SaveCache,
+		ActivateCampaigns: dispatcher.ActivateCampaigns,
+	}
+
+	for i := 0; i < 3; i++ {
+		decision, err := GetDecision(createBatchVisitor(fmt.Sprintf("vis%d", i), true), createBatchEnvironment(), DecisionOptions{TriggerHit: true}, handlers)
+		assert.Nil(t, err)
+		assert.Len(t, decision.Campaigns, 1)
+	}
+
+	// Decisions return without waiting for the writes, that are batched across decisions
+	nbSaves, nbActivations := recorder.counts()
+	assert.Equal(t, 0, nbSaves)
+	assert.Equal(t, 0, nbActivations)
+	assert.Equal(t, 6, dispatcher.Len())
+
+	assert.Nil(t, dispatcher.Flush(context.Background()))
+	assert.Equal(t, 0, dispatcher.Len())
+	assert.Len(t, recorder.saves, 1)
+	assert.Len(t, recorder.saves[0], 3)
+	assert.Len(t, recorder.activations, 1)
+	assert.Len(t, recorder.activations[0], 3)
+
+	assert.Nil(t, dispatcher.Close(context.Background()))
+}
+
+func TestDispatcherBatches(t *testing.T) {
+	recorder := &dispatcherRecorder{}
+	dispatcher := NewDispatcher(recorder.handlers(), DispatcherOptions{BatchSize: 2, FlushInterval: time.Hour})
+	defer dispatcher.Close(context.Background())
+
+	ctx := context.Background()
+	assert.Nil(t, dispatcher.ActivateCampaigns(ctx, createActivation("vis1")))
+	assert.Nil(t, dispatcher.SaveCache(ctx, "env_id", "vis1", &VisitorAssignments{Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1"}}}))
+
+	// A full batch is written without waiting for the flush interval
+	assert.Eventually(t, func() bool {
+		nbSaves, nbActivations := recorder.counts()
+		return nbSaves == 1 && nbActivations == 1
+	}, time.Second, time.Millisecond)
+
+	// Saves of the same ID are merged
+	assert.Nil(t, dispatcher.SaveCache(ctx, "env_id", "vis2", &VisitorAssignments{Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1"}}}))
+	assert.Nil(t, dispatcher.SaveCache(ctx, "env_id", "vis2", &VisitorAssignments{Timestamp: 2, Assignments: map[string]*VisitorCache{"vg2": {VariationID: "v2"}}}))
+	assert.Eventually(t, func() bool {
+		nbSaves, _ := recorder.counts()
+		return nbSaves == 2
+	}, time.Second, time.Millisecond)
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	assert.Len(t, recorder.saves[1]["vis2"].Assignments, 2)
+	assert.Equal(t, int64(2), recorder.saves[1]["vis2"].Timestamp)
+}
+
+func TestDispatcherCompareAndSave(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryAssignmentStore(0)
+	dispatcher := NewDispatcher(BatchDecisionHandlers{AssignmentStore: store}, DispatcherOptions{FlushInterval: time.Hour})
+	defer dispatcher.Close(ctx)
+
+	assert.Nil(t, store.Save(ctx, "env_id", "vis1", &VisitorAssignments{Assignments: map[string]*VisitorCache{"vg0": {VariationID: "v0"}}}))
+	stored, _ := store.Get(ctx, "env_id", "vis1")
+
+	// Both saves were merged with the same stored version by concurrent decisions, and are written in different batches
+	first := &VisitorAssignments{Timestamp: 1, Version: stored.Version, Assignments: map[string]*VisitorCache{"vg0": {VariationID: "v0"}, "vg1": {VariationID: "v1"}}}
+	second := &VisitorAssignments{Timestamp: 2, Version: stored.Version, Assignments: map[string]*VisitorCache{"vg0": {VariationID: "v0"}, "vg2": {VariationID: "v2"}}}
+	assert.Nil(t, dispatcher.SaveCache(ctx, "env_id", "vis1", first))
+	assert.Nil(t, dispatcher.Flush(ctx))
+	assert.Nil(t, dispatcher.SaveCache(ctx, "env_id", "vis1", second))
+	assert.Nil(t, dispatcher.Flush(ctx))
+
+	stored, _ = store.Get(ctx, "env_id", "vis1")
+	assert.Equal(t, map[string]*VisitorCache{"vg0": {VariationID: "v0"}, "vg1": {VariationID: "v1"}, "vg2": {VariationID: "v2"}}, stored.Assignments)
+	assert.Equal(t, int64(3), stored.Version)
+	assert.Equal(t, int64(2), stored.Timestamp)
+
+	// Without version conflict, the saved assignments replace the stored ones
+	assert.Nil(t, dispatcher.SaveCache(ctx, "env_id", "vis1", &VisitorAssignments{Timestamp: 3, Version: stored.Version, Assignments: map[string]*VisitorCache{"vg2": {VariationID: "v2"}}}))
+	assert.Nil(t, dispatcher.Flush(ctx))
+	stored, _ = store.Get(ctx, "env_id", "vis1")
+	assert.Equal(t, map[string]*VisitorCache{"vg2": {VariationID: "v2"}}, stored.Assignments)
+}
+
+func TestMergeQueuedAssignments(t *testing.T) {
+	existing := &VisitorAssignments{Timestamp: 100, Version: 2, TTL: time.Hour, Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1"}, "vg2": {VariationID: "v2"}}}
+	queued := &VisitorAssignments{Timestamp: 200, Version: 1, TTL: time.Minute, Assignments: map[string]*VisitorCache{"vg2": {VariationID: "v3"}}}
+
+	merged := mergeQueuedAssignments(existing, queued)
+	assert.Equal(t, map[string]*VisitorCache{"vg1": {VariationID: "v1"}, "vg2": {VariationID: "v3"}}, merged.Assignments)
+	assert.Equal(t, int64(2), merged.Version)
+	assert.Equal(t, int64(200), merged.Timestamp)
+	assert.Equal(t, time.Hour-100*time.Second, merged.TTL)
+	assert.Len(t, queued.Assignments, 1)
+
+	existing.TTL = 0
+	assert.Equal(t, time.Duration(0), mergeQueuedAssignments(existing, queued).TTL)
+	assert.Equal(t, int64(0), mergeQueuedAssignments(nil, queued).Version)
+}
+
+func TestDispatcherFlushInterval(t *testing.T) {
+	recorder := &dispatcherRecorder{}
+	dispatcher := NewDispatcher(recorder.handlers(), DispatcherOptions{FlushInterval: time.Millisecond})
+	defer dispatcher.Close(context.Background())
+
+	assert.Nil(t, dispatcher.ActivateCampaigns(context.Background(), createActivation("vis1")))
+	assert.Eventually(t, func() bool {
+		_, nbActivations := recorder.counts()
+		return nbActivations == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestDispatcherDropPolicies(t *testing.T) {
+	ctx := context.Background()
+
+	recorder := &dispatcherRecorder{}
+	dispatcher := NewDispatcher(recorder.handlers(), DispatcherOptions{QueueSize: 2, FlushInterval: time.Hour, DropPolicy: DropPolicyDropNewest})
+	assert.Nil(t, dispatcher.ActivateCampaigns(ctx, createActivation("vis1")))
+	assert.Nil(t, dispatcher.ActivateCampaigns(ctx, createActivation("vis2")))
+	assert.ErrorIs(t, dispatcher.ActivateCampaigns(ctx, createActivation("vis3")), DispatcherQueueFullError)
+	assert.Equal(t, int64(1), dispatcher.Dropped())
+	assert.Nil(t, dispatcher.Close(ctx))
+	assert.Len(t, recorder.activations, 1)
+	assert.Equal(t, "vis1", recorder.activations[0][0].VisitorID)
+	assert.Equal(t, "vis2", recorder.activations[0][1].VisitorID)
+
+	recorder = &dispatcherRecorder{}
+	dispatcher = NewDispatcher(recorder.handlers(), DispatcherOptions{QueueSize: 2, FlushInterval: time.Hour, DropPolicy: DropPolicyDropOldest})
+	assert.Nil(t, dispatcher.ActivateCampaigns(ctx, createActivation("vis1")))
+	assert.Nil(t, dispatcher.ActivateCampaigns(ctx, createActivation("vis2")))
+	assert.Nil(t, dispatcher.ActivateCampaigns(ctx, createActivation("vis3")))
+	assert.Equal(t, int64(1), dispatcher.Dropped())
+	assert.Nil(t, dispatcher.Close(ctx))
+	assert.Len(t, recorder.activations, 1)
+	assert.Equal(t, "vis2", recorder.activations[0][0].VisitorID)
+	assert.Equal(t, "vis3", recorder.activations[0][1].VisitorID)
+
+	// The default policy blocks until there is room in the queue
+	recorder = &dispatcherRecorder{}
+	dispatcher = NewDispatcher(recorder.handlers(), DispatcherOptions{QueueSize: 1, FlushInterval: time.Hour})
+	assert.Nil(t, dispatcher.ActivateCampaigns(ctx, createActivation("vis1")))
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, dispatcher.ActivateCampaigns(timeoutCtx, createActivation("vis2")), context.DeadlineExceeded)
+
+	done := make(chan error)
+	go func() {
+		done <- dispatcher.ActivateCampaigns(ctx, createActivation("vis3"))
+	}()
+	assert.Nil(t, dispatcher.Flush(ctx))
+	assert.Nil(t, <-done)
+	assert.Nil(t, dispatcher.Close(ctx))
+	assert.Equal(t, int64(0), dispatcher.Dropped())
+	nbActivations := 0
+	for _, a := range recorder.activations {
+		nbActivations += len(a)
+	}
+	assert.Equal(t, 2, nbActivations)
+}
+
+func TestDispatcherClose(t *testing.T) {
+	ctx := context.Background()
+	recorder := &dispatcherRecorder{}
+	dispatcher := NewDispatcher(recorder.handlers(), DispatcherOptions{FlushInterval: time.Hour})
+
+	assert.Nil(t, dispatcher.BatchSaveCache(ctx, "env_id", map[string]*VisitorAssignments{"vis1": {}, "vis2": {}}))
+	assert.Nil(t, dispatcher.Close(ctx))
+	assert.Len(t, recorder.saves, 1)
+	assert.Len(t, recorder.saves[0], 2)
+
+	assert.ErrorIs(t, dispatcher.ActivateCampaigns(ctx, createActivation("vis1")), DispatcherClosedError)
+	assert.Equal(t, DispatcherClosedError, dispatcher.Flush(ctx))
+	assert.Nil(t, dispatcher.Close(ctx))
+
+	// Close returns when its context is done, cancelling the pending writes
+	blocking := BatchDecisionHandlers{
+		ActivateCampaigns: func(ctx context.Context, activations []*VisitorActivation) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	dispatcher = NewDispatcher(blocking, DispatcherOptions{FlushInterval: time.Hour})
+	assert.Nil(t, dispatcher.ActivateCampaigns(ctx, createActivation("vis1")))
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, dispatcher.Close(timeoutCtx))
+	<-dispatcher.done
+}
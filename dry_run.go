@@ -0,0 +1,36 @@
+package decision
+
+import (
+	"time"
+)
+
+// DryRunReport stores the side effects that a dry run decision would have made.
+// Set a new DryRunReport in the decision options to run the decision without any side effect:
+// existing assignments are still read, but assignments are never saved, campaigns are never activated
+// and no troubleshooting event is sent
+type DryRunReport struct {
+	// Saves stores the assignments that would have been saved, by visitor ID, anonymous ID or decision group
+	Saves map[string]*VisitorAssignments
+	// Activations stores the campaign activations that would have been sent
+	Activations []*VisitorActivation
+}
+
+// addSaves reports the new assignments that would have been saved for the ID.
+// Served variations are not reported, as they only update the history of the stored ones
+func (r *DryRunReport) addSaves(now time.Time, id string, assignments map[string]*VisitorCache) {
+	if r.Saves == nil {
+		r.Saves = map[string]*VisitorAssignments{}
+	}
+	newAssignments := make(map[string]*VisitorCache, len(assignments))
+	for vgID, a := range assignments {
+		if a != nil && !a.served {
+			newAssignments[vgID] = a
+		}
+	}
+	addAssignmentsToSave(r.Saves, now, id, newAssignments)
+}
+
+// addActivations reports the campaign activations that would have been sent
+func (r *DryRunReport) addActivations(activations []*VisitorActivation) {
+	r.Activations = append(r.Activations, activations...)
+}
@@ -0,0 +1,87 @@
+package decision
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecisionDryRun(t *testing.T) {
+	vi := createBatchVisitor("vis1", true)
+	vi.AnonymousID = "anon1"
+	ei := createBatchEnvironment()
+
+	var getCacheCalls int32
+	handlers := DecisionHandlers{
+		GetCache: func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+			atomic.AddInt32(&getCacheCalls, 1)
+			return nil, nil
+		},
+		SaveCache: func(ctx context.Context, environmentID string, id string, assignment *VisitorAssignments) error {
+			t.Error("cache should not be saved in dry run mode")
+			return nil
+		},
+		ActivateCampaigns: func(ctx context.Context, activations []*VisitorActivation) error {
+			t.Error("campaigns should not be activated in dry run mode")
+			return nil
+		},
+		SendTroubleshooting: func(ctx context.Context, event *TroubleshootingEvent) error {
+			t.Error("troubleshooting should not be sent in dry run mode")
+			return nil
+		},
+	}
+
+	report := &DryRunReport{}
+	decision, err := GetDecision(vi, ei, DecisionOptions{TriggerHit: true, DryRun: report}, handlers)
+	assert.Nil(t, err)
+	assert.Len(t, decision.Campaigns, 1)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&getCacheCalls))
+
+	variationID := decision.Campaigns[0].Variation.Id.Value
+	assert.Len(t, report.Saves, 2)
+	assert.Equal(t, &VisitorCache{VariationID: variationID, Activated: true}, report.Saves["vis1"].Assignments["vg1"])
+	assert.Equal(t, &VisitorCache{VariationID: variationID, Activated: true}, report.Saves["anon1"].Assignments["vg1"])
+	assert.Len(t, report.Activations, 1)
+	assert.Equal(t, "vg1", report.Activations[0].VariationGroupID)
+
+	// Nothing would have been written without handlers
+	report = &DryRunReport{}
+	handlers.SaveCache = nil
+	handlers.ActivateCampaigns = nil
+	_, err = GetDecision(vi, ei, DecisionOptions{TriggerHit: true, DryRun: report}, handlers)
+	assert.Nil(t, err)
+	assert.Len(t, report.Saves, 0)
+	assert.Len(t, report.Activations, 0)
+}
+
+func TestGetDecisionsDryRun(t *testing.T) {
+	visitors := []Visitor{
+		createBatchVisitor("vis1", true),
+		createBatchVisitor("vis2", true),
+	}
+
+	handlers := BatchDecisionHandlers{
+		BatchGetCache: func(ctx context.Context, environmentID string, ids []string) (map[string]*VisitorAssignments, error) {
+			return map[string]*VisitorAssignments{}, nil
+		},
+		BatchSaveCache: func(ctx context.Context, environmentID string, assignments map[string]*VisitorAssignments) error {
+			t.Error("cache should not be saved in dry run mode")
+			return nil
+		},
+		ActivateCampaigns: func(ctx context.Context, activations []*VisitorActivation) error {
+			t.Error("campaigns should not be activated in dry run mode")
+			return nil
+		},
+	}
+
+	report := &DryRunReport{}
+	results, err := GetDecisions(visitors, createBatchEnvironment(), DecisionOptions{TriggerHit: true, DryRun: report}, handlers)
+	assert.Nil(t, err)
+	assert.Len(t, results, 2)
+	assert.Len(t, report.Saves, 2)
+	assert.Contains(t, report.Saves, "vis1")
+	assert.Contains(t, report.Saves, "vis2")
+	assert.Len(t, report.Activations, 2)
+}
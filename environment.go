@@ -0,0 +1,183 @@
+package decision
+
+import (
+	"fmt"
+	"maps"
+
+	"github.com/flagship-io/flagship-proto/decision_response"
+	targetingProto "github.com/flagship-io/flagship-proto/targeting"
+	troubleshootingProto "github.com/flagship-io/flagship-proto/troubleshooting"
+	"google.golang.org/protobuf/proto"
+)
+
+// CompiledEnvironment is a read-only snapshot of an environment prepared for repeated decisions.
+// Campaigns are deduplicated and sorted by priority, variation groups are linked to their campaign,
+// and targetings, layers and assignment TTLs are preprocessed once.
+// It is never mutated by the decision, so it can be shared between goroutines
+type CompiledEnvironment struct {
+	environment Environment
+}
+
+// CompileEnvironment validates and compiles the environment into a snapshot to pass to GetDecisionCompiled.
+// The environment campaigns are copied, so the given environment is left untouched
+func CompileEnvironment(environmentInfos Environment) (*CompiledEnvironment, error) {
+	for _, c := range environmentInfos.Campaigns {
+		if err := validateCampaign(c); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := validateLayers(environmentInfos.Layers); err != nil {
+		return nil, err
+	}
+
+	return compileEnvironment(environmentInfos), nil
+}
+
+// ID returns the ID of the compiled environment
+func (ce *CompiledEnvironment) ID() string {
+	return ce.environment.ID
+}
+
+// AssignmentTTLPolicy returns the assignment TTL policy of the compiled environment
+func (ce *CompiledEnvironment) AssignmentTTLPolicy() *AssignmentTTLPolicy {
+	return ce.environment.assignmentTTLPolicy
+}
+
+// Environment returns a deep copy of the compiled environment. Changing it does not affect the compiled environment
+func (ce *CompiledEnvironment) Environment() Environment {
+	env := ce.environment
+	env.Campaigns = make([]*Campaign, 0, len(ce.environment.Campaigns))
+	for _, c := range ce.environment.Campaigns {
+		env.Campaigns = append(env.Campaigns, copyCampaign(c))
+	}
+	env.Layers = copyLayers(ce.environment.Layers)
+	if env.Troubleshooting != nil {
+		env.Troubleshooting = proto.Clone(env.Troubleshooting).(*troubleshootingProto.Troubleshooting)
+	}
+	if env.AssignmentMigration != nil {
+		env.AssignmentMigration = &AssignmentMigration{
+			VariationGroupIDs: maps.Clone(env.AssignmentMigration.VariationGroupIDs),
+			VariationIDs:      maps.Clone(env.AssignmentMigration.VariationIDs),
+		}
+	}
+	return env
+}
+
+// copyCampaign deep copies a compiled campaign with its variation groups and variations
+func copyCampaign(c *Campaign) *Campaign {
+	copied := *c
+	if c.Slug != nil {
+		slug := *c.Slug
+		copied.Slug = &slug
+	}
+	copied.BucketRanges = make([][]float64, 0, len(c.BucketRanges))
+	for _, br := range c.BucketRanges {
+		copied.BucketRanges = append(copied.BucketRanges, append([]float64{}, br...))
+	}
+	copied.VariationGroups = make([]*VariationGroup, 0, len(c.VariationGroups))
+	for _, vg := range c.VariationGroups {
+		copiedVG := *vg
+		copiedVG.Campaign = &copied
+		if vg.Targetings != nil {
+			copiedVG.Targetings = proto.Clone(vg.Targetings).(*targetingProto.Targeting)
+		}
+		copiedVG.Variations = make([]*Variation, 0, len(vg.Variations))
+		for _, v := range vg.Variations {
+			copiedV := *v
+			if v.Modifications != nil {
+				copiedV.Modifications = proto.Clone(v.Modifications).(*decision_response.Modifications)
+			}
+			copiedVG.Variations = append(copiedVG.Variations, &copiedV)
+		}
+		copied.VariationGroups = append(copied.VariationGroups, &copiedVG)
+	}
+	return &copied
+}
+
+// copyLayers deep copies the layers with their slices
+func copyLayers(layers []*Layer) []*Layer {
+	if layers == nil {
+		return nil
+	}
+	copied := make([]*Layer, 0, len(layers))
+	for _, l := range layers {
+		if l == nil {
+			copied = append(copied, nil)
+			continue
+		}
+		copiedLayer := *l
+		copiedLayer.Slices = make([]*LayerSlice, 0, len(l.Slices))
+		for _, s := range l.Slices {
+			if s == nil {
+				copiedLayer.Slices = append(copiedLayer.Slices, nil)
+				continue
+			}
+			copiedSlice := *s
+			copiedLayer.Slices = append(copiedLayer.Slices, &copiedSlice)
+		}
+		copied = append(copied, &copiedLayer)
+	}
+	return copied
+}
+
+// compileEnvironment compiles the environment without validating it. The campaigns of invalid layers are logged and skipped
+func compileEnvironment(environmentInfos Environment) *CompiledEnvironment {
+	logger.Logf(InfoLevel, "deduplicating campaigns by ID")
+	campaigns := deduplicateCampaigns(environmentInfos.Campaigns)
+
+	campaignsLayers := getCampaignsLayers(environmentInfos.Layers)
+	compiledCampaigns := make([]*Campaign, 0, len(campaigns))
+	for _, c := range campaigns {
+		compiled := compileCampaign(c)
+		compiled.layers = campaignsLayers[c.ID]
+		compiledCampaigns = append(compiledCampaigns, compiled)
+	}
+	sortCampaignsByPriority(compiledCampaigns)
+
+	env := environmentInfos
+	env.Campaigns = compiledCampaigns
+	env.assignmentTTLPolicy = newAssignmentTTLPolicy(env)
+	env.variationGroupIDs = getVariationGroupIDs(env.Campaigns)
+	return &CompiledEnvironment{
+		environment: env,
+	}
+}
+
+// compileCampaign copies the campaign and its variation groups, linking them together and preprocessing targetings
+func compileCampaign(c *Campaign) *Campaign {
+	compiled := *c
+	compiled.VariationGroups = make([]*VariationGroup, 0, len(c.VariationGroups))
+	for _, vg := range c.VariationGroups {
+		compiledVG := *vg
+		compiledVG.Campaign = &compiled
+		compiledVG.compiledTargetings = compileTargeting(vg.Targetings)
+		compiled.VariationGroups = append(compiled.VariationGroups, &compiledVG)
+	}
+	return &compiled
+}
+
+// validateCampaign returns an error if the campaign cannot be used for decision
+func validateCampaign(c *Campaign) error {
+	if c == nil {
+		return fmt.Errorf("campaign is null")
+	}
+
+	for _, br := range c.BucketRanges {
+		if len(br) != 2 || br[0] > br[1] {
+			return fmt.Errorf("invalid bucket range %v for campaign %s", br, c.ID)
+		}
+	}
+
+	for _, vg := range c.VariationGroups {
+		if vg == nil {
+			return fmt.Errorf("variation group is null for campaign %s", c.ID)
+		}
+		for _, v := range vg.Variations {
+			if v == nil {
+				return fmt.Errorf("variation is null for variation group %s", vg.ID)
+			}
+		}
+	}
+	return nil
+}
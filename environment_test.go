@@ -0,0 +1,131 @@
+package decision
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/flagship-io/flagship-common/targeting"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestCompileEnvironment(t *testing.T) {
+	vg := &VariationGroup{
+		ID:         "vg1",
+		Targetings: createBoolTargeting(),
+		Variations: []*Variation{{ID: "v1", Allocation: 50}, {ID: "v2", Allocation: 50}},
+	}
+	env := Environment{
+		ID: "env_id",
+		Campaigns: []*Campaign{
+			{ID: "c1", BucketRanges: [][]float64{{0., 100.}}, VariationGroups: []*VariationGroup{vg}},
+			{ID: "c1"},
+		},
+	}
+
+	compiled, err := CompileEnvironment(env)
+	assert.Nil(t, err)
+	assert.Equal(t, "env_id", compiled.ID())
+
+	compiledEnv := compiled.Environment()
+	assert.Len(t, compiledEnv.Campaigns, 1)
+	assert.Equal(t, compiledEnv.Campaigns[0], compiledEnv.Campaigns[0].VariationGroups[0].Campaign)
+	assert.NotNil(t, compiledEnv.Campaigns[0].VariationGroups[0].compiledTargetings)
+
+	// The original environment should be left untouched
+	assert.Len(t, env.Campaigns, 2)
+	assert.Nil(t, vg.Campaign)
+	assert.Nil(t, vg.compiledTargetings)
+
+	// Changing the returned environment should not change the compiled one
+	compiledEnv.Campaigns[0].ID = "changed"
+	compiledEnv.Campaigns[0].BucketRanges[0][1] = 0.
+	compiledEnv.Campaigns[0].VariationGroups[0].Variations[0].Allocation = 100
+	compiledEnv.Campaigns[0].VariationGroups[0].Targetings.TargetingGroups = nil
+	compiledEnv = compiled.Environment()
+	assert.Equal(t, "c1", compiledEnv.Campaigns[0].ID)
+	assert.Equal(t, 100., compiledEnv.Campaigns[0].BucketRanges[0][1])
+	assert.Equal(t, float32(50), compiledEnv.Campaigns[0].VariationGroups[0].Variations[0].Allocation)
+	assert.NotEmpty(t, compiledEnv.Campaigns[0].VariationGroups[0].Targetings.TargetingGroups)
+
+	_, err = CompileEnvironment(Environment{Campaigns: []*Campaign{nil}})
+	assert.NotNil(t, err)
+
+	_, err = CompileEnvironment(Environment{Campaigns: []*Campaign{{ID: "c1", BucketRanges: [][]float64{{0.}}}}})
+	assert.NotNil(t, err)
+
+	_, err = CompileEnvironment(Environment{Campaigns: []*Campaign{{ID: "c1", BucketRanges: [][]float64{{50., 10.}}}}})
+	assert.NotNil(t, err)
+
+	_, err = CompileEnvironment(Environment{Campaigns: []*Campaign{{ID: "c1", VariationGroups: []*VariationGroup{nil}}}})
+	assert.NotNil(t, err)
+
+	_, err = CompileEnvironment(Environment{Campaigns: []*Campaign{{ID: "c1", VariationGroups: []*VariationGroup{{ID: "vg1", Variations: []*Variation{nil}}}}}})
+	assert.NotNil(t, err)
+}
+
+func TestGetDecisionCompiledConcurrent(t *testing.T) {
+	compiled, err := CompileEnvironment(Environment{
+		ID: "env_id",
+		Campaigns: []*Campaign{
+			{
+				ID:           "c1",
+				BucketRanges: [][]float64{{0., 100.}},
+				VariationGroups: []*VariationGroup{
+					{
+						ID:         "vg1",
+						Targetings: createBoolTargeting(),
+						Variations: []*Variation{{ID: "v1", Allocation: 50}, {ID: "v2", Allocation: 50}},
+					},
+				},
+			},
+		},
+	})
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			decision, err := GetDecisionCompiled(context.Background(), Visitor{
+				ID: strconv.Itoa(i),
+				Context: &targeting.Context{
+					Standard: targeting.ContextMap{
+						"isVIP": structpb.NewBoolValue(true),
+					},
+				},
+			}, compiled, DecisionOptions{ExposeAllKeys: i%2 == 0}, DecisionHandlers{})
+			assert.Nil(t, err)
+			assert.Len(t, decision.Campaigns, 1)
+		}(i)
+	}
+	wg.Wait()
+
+	// Exposing all keys should not modify the shared variations
+	for _, v := range compiled.Environment().Campaigns[0].VariationGroups[0].Variations {
+		assert.Nil(t, v.Modifications)
+	}
+}
+
+func TestCompiledTargetingMatch(t *testing.T) {
+	context := &targeting.Context{
+		Standard: targeting.ContextMap{
+			"age": structpb.NewNumberValue(30),
+		},
+	}
+
+	match, err := compileTargeting(createNumberTargeting()).match("vid", context)
+	assert.Nil(t, err)
+	assert.True(t, match)
+
+	match, err = compileTargeting(createBoolTargeting()).match("vid", context)
+	assert.Nil(t, err)
+	assert.False(t, match)
+
+	match, err = compileTargeting(nil).match("vid", context)
+	assert.Nil(t, err)
+	assert.False(t, match)
+}
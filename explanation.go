@@ -0,0 +1,121 @@
+package decision
+
+// SkipReason explains why a campaign has not been returned by the decision
+type SkipReason string
+
+const (
+	// SkipReasonNoTargetingMatch is set when no variation group of the campaign matches the visitor context
+	SkipReasonNoTargetingMatch SkipReason = "no_targeting_match"
+	// SkipReasonBucketMiss is set when the visitor does not fall into the campaign's buckets
+	SkipReasonBucketMiss SkipReason = "bucket_miss"
+	// SkipReasonLayerMiss is set when the visitor does not fall into the campaign's layer slices,
+	// or already got another campaign of the layer
+	SkipReasonLayerMiss SkipReason = "layer_miss"
+	// SkipReasonSingleAssignment is set when the campaign is skipped because of the single assignment rule
+	SkipReasonSingleAssignment SkipReason = "single_assignment"
+	// SkipReasonVisitorNotTracked is set when the visitor does not fall into any variation allocation
+	SkipReasonVisitorNotTracked SkipReason = "visitor_not_tracked"
+	// SkipReasonDeletedVariation is set when the visitor was assigned to a variation that does not exist anymore
+	SkipReasonDeletedVariation SkipReason = "deleted_variation"
+	// SkipReasonAllocationError is set when the variation allocation failed unexpectedly
+	SkipReasonAllocationError SkipReason = "allocation_error"
+	// SkipReasonPanic is set when the environment is in panic mode
+	SkipReasonPanic SkipReason = "panic"
+)
+
+// VariationSource explains where the variation of a returned campaign comes from
+type VariationSource string
+
+const (
+	// VariationSourceAllocation is set when the variation has been freshly allocated
+	VariationSourceAllocation VariationSource = "allocation"
+	// VariationSourceCache is set when the variation comes from the visitor ID assignments cache
+	VariationSourceCache VariationSource = "cache"
+	// VariationSourceAnonymousCache is set when the variation comes from the anonymous ID assignments cache
+	VariationSourceAnonymousCache VariationSource = "anonymous_cache"
+	// VariationSourceDecisionGroupCache is set when the variation comes from the decision group assignments cache
+	VariationSourceDecisionGroupCache VariationSource = "decision_group_cache"
+)
+
+// CampaignExplanation stores the trace of the decision for a single campaign
+type CampaignExplanation struct {
+	CampaignID       string
+	VariationGroupID string
+	HashValue        float32
+	HasHash          bool
+	VariationID      string
+	Source           VariationSource
+	SkipReason       SkipReason
+}
+
+// Returned is true if the campaign has been returned in the decision response
+func (ce *CampaignExplanation) Returned() bool {
+	return ce.SkipReason == "" && ce.VariationID != ""
+}
+
+// DecisionExplanation stores the trace of each campaign evaluated by a decision.
+// Set a new DecisionExplanation in the decision options to enable it
+type DecisionExplanation struct {
+	Campaigns []*CampaignExplanation
+	// Panic is true if the decision has been skipped because the environment is in panic mode
+	Panic bool
+
+	campaignsByID map[string]*CampaignExplanation
+}
+
+// Campaign returns the explanation of the campaign ID, if it has been evaluated
+func (e *DecisionExplanation) Campaign(campaignID string) (*CampaignExplanation, bool) {
+	if e == nil {
+		return nil, false
+	}
+	ce, ok := e.campaignsByID[campaignID]
+	return ce, ok
+}
+
+// campaign returns the explanation of the campaign ID, creating it if needed.
+// It returns nil if the explanation is disabled
+func (e *DecisionExplanation) campaign(campaignID string) *CampaignExplanation {
+	if e == nil {
+		return nil
+	}
+	if e.campaignsByID == nil {
+		e.campaignsByID = map[string]*CampaignExplanation{}
+	}
+	ce, ok := e.campaignsByID[campaignID]
+	if !ok {
+		ce = &CampaignExplanation{CampaignID: campaignID}
+		e.campaignsByID[campaignID] = ce
+		e.Campaigns = append(e.Campaigns, ce)
+	}
+	return ce
+}
+
+// skip sets the skip reason of the campaign ID
+func (e *DecisionExplanation) skip(campaignID string, reason SkipReason) {
+	if ce := e.campaign(campaignID); ce != nil {
+		ce.SkipReason = reason
+	}
+}
+
+// setPanic marks the decision and all the campaigns as skipped because of panic mode
+func (e *DecisionExplanation) setPanic(campaigns []*Campaign) {
+	if e == nil {
+		return
+	}
+	e.Panic = true
+	for _, c := range campaigns {
+		e.skip(c.ID, SkipReasonPanic)
+	}
+}
+
+// getSkipReason returns the skip reason matching a variation assignment error
+func getSkipReason(err error) SkipReason {
+	switch err {
+	case VisitorNotTrackedError:
+		return SkipReasonVisitorNotTracked
+	case DeletedVariationError:
+		return SkipReasonDeletedVariation
+	default:
+		return SkipReasonAllocationError
+	}
+}
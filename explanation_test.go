@@ -0,0 +1,198 @@
+package decision
+
+import (
+	"context"
+	"testing"
+
+	"github.com/flagship-io/flagship-common/targeting"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// createExplanationCampaigns returns campaigns evaluated in the slice order thanks to their priority
+func createExplanationCampaigns() []*Campaign {
+	return []*Campaign{
+		{
+			ID:           "c_no_match",
+			Priority:     5,
+			Type:         "ab",
+			BucketRanges: [][]float64{{0., 100.}},
+			VariationGroups: []*VariationGroup{
+				{
+					ID:         "vg_no_match",
+					Targetings: createNumberTargeting(),
+					Variations: []*Variation{{ID: "v1", Allocation: 100}},
+				},
+			},
+		},
+		{
+			ID:           "c_bucket_miss",
+			Priority:     4,
+			Type:         "ab",
+			BucketRanges: [][]float64{{0., 0.}},
+			VariationGroups: []*VariationGroup{
+				{
+					ID:         "vg_bucket_miss",
+					Targetings: createBoolTargeting(),
+					Variations: []*Variation{{ID: "v1", Allocation: 100}},
+				},
+			},
+		},
+		{
+			ID:           "c_ab",
+			Priority:     3,
+			Type:         "ab",
+			BucketRanges: [][]float64{{0., 100.}},
+			VariationGroups: []*VariationGroup{
+				{
+					ID:         "vg_ab",
+					Targetings: createBoolTargeting(),
+					Variations: []*Variation{{ID: "v1", Allocation: 50}, {ID: "v2", Allocation: 50}},
+				},
+			},
+		},
+		{
+			ID:           "c_ab_single",
+			Priority:     2,
+			Type:         "ab",
+			BucketRanges: [][]float64{{0., 100.}},
+			VariationGroups: []*VariationGroup{
+				{
+					ID:         "vg_ab_single",
+					Targetings: createBoolTargeting(),
+					Variations: []*Variation{{ID: "v1", Allocation: 50}, {ID: "v2", Allocation: 50}},
+				},
+			},
+		},
+		{
+			ID:           "c_untracked",
+			Priority:     1,
+			Type:         "toggle",
+			BucketRanges: [][]float64{{0., 100.}},
+			VariationGroups: []*VariationGroup{
+				{
+					ID:         "vg_untracked",
+					Targetings: createBoolTargeting(),
+					Variations: []*Variation{{ID: "v1", Allocation: 0}, {ID: "v2", Allocation: 0}},
+				},
+			},
+		},
+	}
+}
+
+func TestDecisionExplanation(t *testing.T) {
+	vi := Visitor{
+		ID: "v1",
+		Context: &targeting.Context{
+			Standard: targeting.ContextMap{
+				"isVIP": structpb.NewBoolValue(true),
+			},
+		},
+	}
+
+	ei := Environment{
+		ID:               "e123",
+		Campaigns:        createExplanationCampaigns(),
+		SingleAssignment: true,
+	}
+
+	explanation := &DecisionExplanation{}
+	decision, err := GetDecision(vi, ei, DecisionOptions{Explanation: explanation}, DecisionHandlers{})
+	assert.Nil(t, err)
+	assert.Len(t, decision.Campaigns, 1)
+	assert.Len(t, explanation.Campaigns, 5)
+
+	ce, ok := explanation.Campaign("c_no_match")
+	assert.True(t, ok)
+	assert.Equal(t, SkipReasonNoTargetingMatch, ce.SkipReason)
+	assert.Equal(t, "", ce.VariationGroupID)
+	assert.False(t, ce.Returned())
+
+	ce, _ = explanation.Campaign("c_bucket_miss")
+	assert.Equal(t, SkipReasonBucketMiss, ce.SkipReason)
+	assert.Equal(t, "vg_bucket_miss", ce.VariationGroupID)
+
+	ce, _ = explanation.Campaign("c_ab")
+	assert.True(t, ce.Returned())
+	assert.Equal(t, "vg_ab", ce.VariationGroupID)
+	assert.Equal(t, decision.Campaigns[0].Variation.Id.Value, ce.VariationID)
+	assert.Equal(t, VariationSourceAllocation, ce.Source)
+	assert.True(t, ce.HasHash)
+	hash, _ := getAllocationHash("v1", "", "vg_ab")
+	assert.Equal(t, hash, ce.HashValue)
+
+	ce, _ = explanation.Campaign("c_ab_single")
+	assert.Equal(t, SkipReasonSingleAssignment, ce.SkipReason)
+
+	ce, _ = explanation.Campaign("c_untracked")
+	assert.Equal(t, SkipReasonVisitorNotTracked, ce.SkipReason)
+
+	_, ok = explanation.Campaign("unknown")
+	assert.False(t, ok)
+}
+
+func TestDecisionExplanationCache(t *testing.T) {
+	vi := Visitor{
+		ID: "v1",
+		Context: &targeting.Context{
+			Standard: targeting.ContextMap{
+				"isVIP": structpb.NewBoolValue(true),
+			},
+		},
+	}
+
+	ei := Environment{
+		ID:           "e123",
+		Campaigns:    createExplanationCampaigns()[2:3],
+		CacheEnabled: true,
+	}
+
+	handlers := DecisionHandlers{
+		GetCache: func(ctx context.Context, environmentID, id string) (*VisitorAssignments, error) {
+			return &VisitorAssignments{
+				Assignments: map[string]*VisitorCache{
+					"vg_ab": {VariationID: "v2"},
+				},
+			}, nil
+		},
+	}
+
+	explanation := &DecisionExplanation{}
+	decision, err := GetDecision(vi, ei, DecisionOptions{Explanation: explanation}, handlers)
+	assert.Nil(t, err)
+	assert.Len(t, decision.Campaigns, 1)
+
+	ce, _ := explanation.Campaign("c_ab")
+	assert.Equal(t, "v2", ce.VariationID)
+	assert.Equal(t, VariationSourceCache, ce.Source)
+
+	handlers.GetCache = func(ctx context.Context, environmentID, id string) (*VisitorAssignments, error) {
+		return &VisitorAssignments{
+			Assignments: map[string]*VisitorCache{
+				"vg_ab": {VariationID: "deleted"},
+			},
+		}, nil
+	}
+
+	explanation = &DecisionExplanation{}
+	decision, err = GetDecision(vi, ei, DecisionOptions{Explanation: explanation}, handlers)
+	assert.Nil(t, err)
+	assert.Len(t, decision.Campaigns, 0)
+
+	ce, _ = explanation.Campaign("c_ab")
+	assert.Equal(t, SkipReasonDeletedVariation, ce.SkipReason)
+}
+
+func TestGetSkipReason(t *testing.T) {
+	assert.Equal(t, SkipReasonVisitorNotTracked, getSkipReason(VisitorNotTrackedError))
+	assert.Equal(t, SkipReasonDeletedVariation, getSkipReason(DeletedVariationError))
+	assert.Equal(t, SkipReasonAllocationError, getSkipReason(assert.AnError))
+}
+
+func TestNilDecisionExplanation(t *testing.T) {
+	var explanation *DecisionExplanation
+	assert.Nil(t, explanation.campaign("c1"))
+	explanation.skip("c1", SkipReasonBucketMiss)
+	_, ok := explanation.Campaign("c1")
+	assert.False(t, ok)
+}
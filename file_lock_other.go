@@ -0,0 +1,18 @@
+//go:build !unix
+
+package decision
+
+import (
+	"os"
+)
+
+// lockFile creates the lock file if needed. Locks between processes are not supported on this platform,
+// so writes are only serialized inside the process
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return func() {}, nil
+}
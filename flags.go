@@ -0,0 +1,140 @@
+package decision
+
+import (
+	"reflect"
+
+	"github.com/flagship-io/flagship-proto/decision_response"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// FlagReason explains how a flag value has been evaluated
+type FlagReason string
+
+const (
+	// FlagReasonMatch is set when the flag value comes from a campaign variation
+	FlagReasonMatch FlagReason = "match"
+	// FlagReasonMissingKey is set when no campaign variation sets the flag key, so the default value is used
+	FlagReasonMissingKey FlagReason = "missing_key"
+	// FlagReasonTypeMismatch is set when the flag value type differs from the default value type, so the default value is used
+	FlagReasonTypeMismatch FlagReason = "type_mismatch"
+)
+
+// FlagMetadata stores the campaign, variation group and variation that produced a flag value
+type FlagMetadata struct {
+	Key                string
+	CampaignID         string
+	CampaignName       string
+	CampaignType       string
+	CampaignSlug       string
+	VariationGroupID   string
+	VariationGroupName string
+	VariationID        string
+	VariationName      string
+	Reference          bool
+	Reason             FlagReason
+}
+
+// IsDefault returns true if the default value has been used
+func (m FlagMetadata) IsDefault() bool {
+	return m.Reason != FlagReasonMatch
+}
+
+// Flags evaluates the flags of a decision response.
+// When many campaigns set the same flag key, the first campaign of the response wins, i.e. the one with the highest priority
+type Flags struct {
+	decisionResponse *decision_response.DecisionResponse
+}
+
+// NewFlags creates the flags evaluator of a decision response
+func NewFlags(decisionResponse *decision_response.DecisionResponse) *Flags {
+	return &Flags{
+		decisionResponse: decisionResponse,
+	}
+}
+
+// EvaluateFlag returns the value of the flag key and its metadata.
+// If the key is missing, or if the value kind differs from the default value kind, the default value is returned.
+// A nil default value accepts any value kind
+func (f *Flags) EvaluateFlag(key string, defaultValue *structpb.Value) (*structpb.Value, FlagMetadata) {
+	metadata := FlagMetadata{
+		Key:    key,
+		Reason: FlagReasonMissingKey,
+	}
+
+	for _, c := range f.decisionResponse.GetCampaigns() {
+		value, ok := c.GetVariation().GetModifications().GetValue().GetFields()[key]
+		if !ok || isNullValue(value) {
+			continue
+		}
+
+		metadata = buildFlagMetadata(key, c)
+		if defaultValue != nil && reflect.TypeOf(value.GetKind()) != reflect.TypeOf(defaultValue.GetKind()) {
+			logger.Logf(DebugLevel, "flag %s value kind does not match default value kind, using default value", key)
+			metadata.Reason = FlagReasonTypeMismatch
+			return defaultValue, metadata
+		}
+		return value, metadata
+	}
+
+	logger.Logf(DebugLevel, "flag %s not found, using default value", key)
+	return defaultValue, metadata
+}
+
+// GetString returns the string value of the flag key and its metadata
+func (f *Flags) GetString(key string, defaultValue string) (string, FlagMetadata) {
+	value, metadata := f.EvaluateFlag(key, structpb.NewStringValue(defaultValue))
+	return value.GetStringValue(), metadata
+}
+
+// GetBool returns the boolean value of the flag key and its metadata
+func (f *Flags) GetBool(key string, defaultValue bool) (bool, FlagMetadata) {
+	value, metadata := f.EvaluateFlag(key, structpb.NewBoolValue(defaultValue))
+	return value.GetBoolValue(), metadata
+}
+
+// GetNumber returns the number value of the flag key and its metadata
+func (f *Flags) GetNumber(key string, defaultValue float64) (float64, FlagMetadata) {
+	value, metadata := f.EvaluateFlag(key, structpb.NewNumberValue(defaultValue))
+	return value.GetNumberValue(), metadata
+}
+
+// GetJSON returns the object or array value of the flag key and its metadata.
+// Objects are returned as map[string]interface{} and arrays as []interface{}
+func (f *Flags) GetJSON(key string, defaultValue interface{}) (interface{}, FlagMetadata) {
+	value, metadata := f.EvaluateFlag(key, nil)
+	if metadata.IsDefault() {
+		return defaultValue, metadata
+	}
+
+	switch value.GetKind().(type) {
+	case *structpb.Value_StructValue, *structpb.Value_ListValue:
+		return value.AsInterface(), metadata
+	default:
+		logger.Logf(DebugLevel, "flag %s value is not an object or an array, using default value", key)
+		metadata.Reason = FlagReasonTypeMismatch
+		return defaultValue, metadata
+	}
+}
+
+// buildFlagMetadata creates the metadata of a flag found in the campaign response
+func buildFlagMetadata(key string, c *decision_response.Campaign) FlagMetadata {
+	return FlagMetadata{
+		Key:                key,
+		CampaignID:         c.GetId().GetValue(),
+		CampaignName:       c.GetName().GetValue(),
+		CampaignType:       c.GetType().GetValue(),
+		CampaignSlug:       c.GetSlug().GetValue(),
+		VariationGroupID:   c.GetVariationGroupId().GetValue(),
+		VariationGroupName: c.GetVariationGroupName().GetValue(),
+		VariationID:        c.GetVariation().GetId().GetValue(),
+		VariationName:      c.GetVariation().GetName().GetValue(),
+		Reference:          c.GetVariation().GetReference(),
+		Reason:             FlagReasonMatch,
+	}
+}
+
+// isNullValue returns true if the value is null, as for keys filled when exposing all keys
+func isNullValue(value *structpb.Value) bool {
+	_, ok := value.GetKind().(*structpb.Value_NullValue)
+	return value == nil || ok
+}
@@ -0,0 +1,157 @@
+package decision
+
+import (
+	"testing"
+
+	"github.com/flagship-io/flagship-common/targeting"
+	"github.com/flagship-io/flagship-proto/decision_response"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func createFlagsDecision(t *testing.T) *decision_response.DecisionResponse {
+	value1, _ := structpb.NewStruct(map[string]interface{}{
+		"string": "high",
+		"bool":   true,
+		"number": 12.,
+		"object": map[string]interface{}{"key": "value"},
+		"array":  []interface{}{"a", "b"},
+	})
+	value2, _ := structpb.NewStruct(map[string]interface{}{
+		"string": "low",
+		"only":   "low",
+	})
+
+	slug := "high-slug"
+	ei := Environment{
+		ID: "e123",
+		Campaigns: []*Campaign{
+			{
+				ID:           "c_low",
+				Name:         "low",
+				Type:         "toggle",
+				BucketRanges: [][]float64{{0., 100.}},
+				VariationGroups: []*VariationGroup{
+					{
+						ID:         "vg_low",
+						Targetings: createBoolTargeting(),
+						Variations: []*Variation{{ID: "v_low", Allocation: 100, Modifications: &decision_response.Modifications{Value: value2}}},
+					},
+				},
+			},
+			{
+				ID:           "c_high",
+				Name:         "high",
+				Slug:         &slug,
+				Type:         "ab",
+				Priority:     1,
+				BucketRanges: [][]float64{{0., 100.}},
+				VariationGroups: []*VariationGroup{
+					{
+						ID:         "vg_high",
+						Name:       "vg high",
+						Targetings: createBoolTargeting(),
+						Variations: []*Variation{{ID: "v_high", Name: "variation high", Allocation: 100, Modifications: &decision_response.Modifications{Value: value1}}},
+					},
+				},
+			},
+		},
+	}
+
+	vi := Visitor{
+		ID: "v1",
+		Context: &targeting.Context{
+			Standard: targeting.ContextMap{
+				"isVIP": structpb.NewBoolValue(true),
+			},
+		},
+	}
+
+	decision, err := GetDecision(vi, ei, DecisionOptions{ExposeAllKeys: true}, DecisionHandlers{})
+	assert.Nil(t, err)
+	assert.Len(t, decision.Campaigns, 2)
+	return decision
+}
+
+func TestFlagsGetString(t *testing.T) {
+	flags := NewFlags(createFlagsDecision(t))
+
+	value, metadata := flags.GetString("string", "default")
+	assert.Equal(t, "high", value)
+	assert.False(t, metadata.IsDefault())
+	assert.Equal(t, FlagMetadata{
+		Key:                "string",
+		CampaignID:         "c_high",
+		CampaignName:       "high",
+		CampaignType:       "ab",
+		CampaignSlug:       "high-slug",
+		VariationGroupID:   "vg_high",
+		VariationGroupName: "vg high",
+		VariationID:        "v_high",
+		VariationName:      "variation high",
+		Reason:             FlagReasonMatch,
+	}, metadata)
+
+	// Keys filled with null values by the high priority campaign should not hide the other campaigns keys
+	value, metadata = flags.GetString("only", "default")
+	assert.Equal(t, "low", value)
+	assert.Equal(t, "c_low", metadata.CampaignID)
+
+	value, metadata = flags.GetString("missing", "default")
+	assert.Equal(t, "default", value)
+	assert.True(t, metadata.IsDefault())
+	assert.Equal(t, FlagReasonMissingKey, metadata.Reason)
+	assert.Equal(t, "", metadata.CampaignID)
+
+	value, metadata = flags.GetString("bool", "default")
+	assert.Equal(t, "default", value)
+	assert.Equal(t, FlagReasonTypeMismatch, metadata.Reason)
+	assert.Equal(t, "c_high", metadata.CampaignID)
+}
+
+func TestFlagsGetTypedValues(t *testing.T) {
+	flags := NewFlags(createFlagsDecision(t))
+
+	boolValue, metadata := flags.GetBool("bool", false)
+	assert.True(t, boolValue)
+	assert.Equal(t, FlagReasonMatch, metadata.Reason)
+
+	boolValue, metadata = flags.GetBool("number", false)
+	assert.False(t, boolValue)
+	assert.Equal(t, FlagReasonTypeMismatch, metadata.Reason)
+
+	numberValue, metadata := flags.GetNumber("number", 0)
+	assert.Equal(t, 12., numberValue)
+	assert.Equal(t, FlagReasonMatch, metadata.Reason)
+
+	numberValue, metadata = flags.GetNumber("missing", 3)
+	assert.Equal(t, 3., numberValue)
+	assert.Equal(t, FlagReasonMissingKey, metadata.Reason)
+
+	jsonValue, metadata := flags.GetJSON("object", nil)
+	assert.Equal(t, map[string]interface{}{"key": "value"}, jsonValue)
+	assert.Equal(t, FlagReasonMatch, metadata.Reason)
+
+	jsonValue, metadata = flags.GetJSON("array", nil)
+	assert.Equal(t, []interface{}{"a", "b"}, jsonValue)
+	assert.Equal(t, FlagReasonMatch, metadata.Reason)
+
+	jsonValue, metadata = flags.GetJSON("string", map[string]interface{}{})
+	assert.Equal(t, map[string]interface{}{}, jsonValue)
+	assert.Equal(t, FlagReasonTypeMismatch, metadata.Reason)
+
+	jsonValue, metadata = flags.GetJSON("missing", "default")
+	assert.Equal(t, "default", jsonValue)
+	assert.Equal(t, FlagReasonMissingKey, metadata.Reason)
+
+	value, metadata := flags.EvaluateFlag("number", nil)
+	assert.Equal(t, 12., value.GetNumberValue())
+	assert.Equal(t, FlagReasonMatch, metadata.Reason)
+}
+
+func TestFlagsEmptyDecision(t *testing.T) {
+	flags := NewFlags(nil)
+	value, metadata := flags.GetString("key", "default")
+	assert.Equal(t, "default", value)
+	assert.Equal(t, FlagReasonMissingKey, metadata.Reason)
+}
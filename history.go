@@ -0,0 +1,130 @@
+package decision
+
+import (
+	"sort"
+)
+
+// AssignmentHistoryEntry records a variation assigned to a visitor for a variation group
+type AssignmentHistoryEntry struct {
+	VariationID string
+	// FirstSeen is the timestamp, in seconds, of the first save of the variation assignment.
+	// For variations assigned before the history was enabled, it is the timestamp of their last save
+	FirstSeen int64
+	// LastSeen is the timestamp, in seconds, of the last decision that served the variation.
+	// Variations served from the cached assignments update it whenever the assignments are saved
+	LastSeen int64
+}
+
+// AssignmentHistory returns the variations assigned to the visitor for the variation group, from the oldest to the most recent.
+// The last one is the current variation, unless the assignment has been removed since
+func (va *VisitorAssignments) AssignmentHistory(vgID string) []AssignmentHistoryEntry {
+	if va == nil || len(va.History[vgID]) == 0 {
+		return nil
+	}
+	return append([]AssignmentHistoryEntry{}, va.History[vgID]...)
+}
+
+// PreviousVariations returns the variations assigned to the visitor for the variation group before the current one,
+// from the oldest to the most recent
+func (va *VisitorAssignments) PreviousVariations(vgID string) []AssignmentHistoryEntry {
+	if va == nil {
+		return nil
+	}
+
+	current, _ := va.getAssignment(vgID)
+	var previous []AssignmentHistoryEntry
+	for _, e := range va.History[vgID] {
+		if current == nil || e.VariationID != current.VariationID {
+			previous = append(previous, e)
+		}
+	}
+	return previous
+}
+
+// ChangedVariationGroups returns the sorted IDs of the variation groups for which the visitor has been assigned
+// several variations, whose experiment results may be contaminated
+func (va *VisitorAssignments) ChangedVariationGroups() []string {
+	if va == nil {
+		return nil
+	}
+
+	vgIDs := []string{}
+	for vgID := range va.History {
+		if len(va.PreviousVariations(vgID)) > 0 {
+			vgIDs = append(vgIDs, vgID)
+		}
+	}
+	sort.Strings(vgIDs)
+	return vgIDs
+}
+
+// cloneHistory returns a copy of the history
+func cloneHistory(history map[string][]AssignmentHistoryEntry) map[string][]AssignmentHistoryEntry {
+	if history == nil {
+		return nil
+	}
+
+	cloned := make(map[string][]AssignmentHistoryEntry, len(history))
+	for vgID, entries := range history {
+		cloned[vgID] = append([]AssignmentHistoryEntry{}, entries...)
+	}
+	return cloned
+}
+
+// mergeHistory returns a copy of the older history updated with the newer one, by variation group
+func mergeHistory(older map[string][]AssignmentHistoryEntry, newer map[string][]AssignmentHistoryEntry) map[string][]AssignmentHistoryEntry {
+	if len(newer) == 0 {
+		return cloneHistory(older)
+	}
+
+	merged := cloneHistory(older)
+	if merged == nil {
+		merged = make(map[string][]AssignmentHistoryEntry, len(newer))
+	}
+	for vgID, entries := range newer {
+		merged[vgID] = append([]AssignmentHistoryEntry{}, entries...)
+	}
+	return merged
+}
+
+// recordHistory records the variations of the new assignments in the history of the merged assignments,
+// keeping the most recent size entries by variation group. The existing history is kept as is if size is 0.
+// Variations assigned before the history was enabled are recorded with the timestamp of the existing assignments.
+// Served variations are recorded only if they are still the merged ones
+func recordHistory(merged *VisitorAssignments, existing *VisitorAssignments, assignments map[string]*VisitorCache, now int64, size int) {
+	if existing != nil {
+		merged.History = cloneHistory(existing.History)
+	}
+	if size <= 0 {
+		return
+	}
+
+	for vgID, a := range assignments {
+		if a == nil {
+			continue
+		}
+		if current := merged.Assignments[vgID]; a.served && (current == nil || current.VariationID != a.VariationID) {
+			continue
+		}
+		if merged.History == nil {
+			merged.History = map[string][]AssignmentHistoryEntry{}
+		}
+		entries := merged.History[vgID]
+		if previous, ok := existing.getAssignment(vgID); ok && previous != nil && len(entries) == 0 {
+			entries = append(entries, AssignmentHistoryEntry{VariationID: previous.VariationID, FirstSeen: existing.Timestamp, LastSeen: existing.Timestamp})
+		}
+
+		if last := len(entries) - 1; last >= 0 && entries[last].VariationID == a.VariationID {
+			entries[last].LastSeen = now
+		} else {
+			if last >= 0 {
+				logger.Logf(DebugLevel, "variation of variation group %s changed from %s to %s", vgID, entries[last].VariationID, a.VariationID)
+			}
+			entries = append(entries, AssignmentHistoryEntry{VariationID: a.VariationID, FirstSeen: now, LastSeen: now})
+		}
+		if len(entries) > size {
+			entries = append([]AssignmentHistoryEntry{}, entries[len(entries)-size:]...)
+		}
+		merged.History[vgID] = entries
+	}
+}
@@ -0,0 +1,174 @@
+package decision
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssignmentHistoryQueries(t *testing.T) {
+	assignments := &VisitorAssignments{
+		Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1"}, "vg2": {VariationID: "v2"}},
+		History: map[string][]AssignmentHistoryEntry{
+			"vg1": {{VariationID: "v2", FirstSeen: 1, LastSeen: 2}, {VariationID: "v1", FirstSeen: 3, LastSeen: 4}},
+			"vg2": {{VariationID: "v2", FirstSeen: 1, LastSeen: 4}},
+			"vg3": {{VariationID: "v3", FirstSeen: 1, LastSeen: 1}},
+		},
+	}
+
+	history := assignments.AssignmentHistory("vg1")
+	assert.Equal(t, []AssignmentHistoryEntry{{VariationID: "v2", FirstSeen: 1, LastSeen: 2}, {VariationID: "v1", FirstSeen: 3, LastSeen: 4}}, history)
+	history[0].VariationID = "modified"
+	assert.Equal(t, "v2", assignments.History["vg1"][0].VariationID)
+
+	assert.Equal(t, []AssignmentHistoryEntry{{VariationID: "v2", FirstSeen: 1, LastSeen: 2}}, assignments.PreviousVariations("vg1"))
+	assert.Nil(t, assignments.PreviousVariations("vg2"))
+	// Variation groups without current assignment only have previous variations
+	assert.Len(t, assignments.PreviousVariations("vg3"), 1)
+	assert.Equal(t, []string{"vg1", "vg3"}, assignments.ChangedVariationGroups())
+
+	var empty *VisitorAssignments
+	assert.Nil(t, empty.AssignmentHistory("vg1"))
+	assert.Nil(t, empty.PreviousVariations("vg1"))
+	assert.Nil(t, empty.ChangedVariationGroups())
+}
+
+func TestRecordHistory(t *testing.T) {
+	existing := &VisitorAssignments{
+		Timestamp:   10,
+		Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1"}, "vg2": {VariationID: "v2"}},
+	}
+
+	// Variations assigned before the history was enabled are recorded with the existing timestamp
+	merged := &VisitorAssignments{}
+	recordHistory(merged, existing, map[string]*VisitorCache{"vg1": {VariationID: "v2"}, "vg2": {VariationID: "v2", Activated: true}, "vg3": {VariationID: "v3"}}, 20, 2)
+	assert.Equal(t, map[string][]AssignmentHistoryEntry{
+		"vg1": {{VariationID: "v1", FirstSeen: 10, LastSeen: 10}, {VariationID: "v2", FirstSeen: 20, LastSeen: 20}},
+		"vg2": {{VariationID: "v2", FirstSeen: 10, LastSeen: 20}},
+		"vg3": {{VariationID: "v3", FirstSeen: 20, LastSeen: 20}},
+	}, merged.History)
+
+	// The most recent entries are kept
+	existing = &VisitorAssignments{Timestamp: 20, History: merged.History}
+	merged = &VisitorAssignments{}
+	recordHistory(merged, existing, map[string]*VisitorCache{"vg1": {VariationID: "v3"}}, 30, 2)
+	assert.Equal(t, []AssignmentHistoryEntry{{VariationID: "v2", FirstSeen: 20, LastSeen: 20}, {VariationID: "v3", FirstSeen: 30, LastSeen: 30}}, merged.History["vg1"])
+	assert.Len(t, existing.History["vg1"], 2)
+	assert.Equal(t, "v1", existing.History["vg1"][0].VariationID)
+
+	// Served variations are recorded only if they are still the merged ones
+	merged = &VisitorAssignments{Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v3"}, "vg2": {VariationID: "v2"}}}
+	recordHistory(merged, existing, map[string]*VisitorCache{"vg1": {VariationID: "v3", served: true}, "vg2": {VariationID: "v1", served: true}}, 40, 2)
+	assert.Equal(t, []AssignmentHistoryEntry{{VariationID: "v2", FirstSeen: 20, LastSeen: 20}, {VariationID: "v3", FirstSeen: 40, LastSeen: 40}}, merged.History["vg1"])
+	assert.Equal(t, []AssignmentHistoryEntry{{VariationID: "v2", FirstSeen: 10, LastSeen: 20}}, merged.History["vg2"])
+
+	// The existing history is kept when the history is disabled
+	merged = &VisitorAssignments{}
+	recordHistory(merged, existing, map[string]*VisitorCache{"vg1": {VariationID: "v3"}}, 30, 0)
+	assert.Equal(t, existing.History, merged.History)
+}
+
+func TestDecisionAssignmentHistory(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryAssignmentStore(0)
+	env := createBatchEnvironment()
+	env.AssignmentTTL = time.Hour
+	env.AssignmentHistorySize = 3
+	expired := time.Now().Add(-2 * time.Hour).Unix()
+
+	// The expired assignment is recorded when the visitor is allocated again
+	assert.Nil(t, store.Save(ctx, "env_id", "vis1", &VisitorAssignments{
+		Timestamp:   expired,
+		Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v_old"}},
+	}))
+	decision, err := GetDecision(createBatchVisitor("vis1", true), env, DecisionOptions{}, DecisionHandlers{AssignmentStore: store})
+	assert.Nil(t, err)
+	variationID := decision.Campaigns[0].Variation.Id.Value
+
+	a, _ := store.Get(ctx, "env_id", "vis1")
+	history := a.AssignmentHistory("vg1")
+	assert.Len(t, history, 2)
+	assert.Equal(t, AssignmentHistoryEntry{VariationID: "v_old", FirstSeen: expired, LastSeen: expired}, history[0])
+	assert.Equal(t, variationID, history[1].VariationID)
+	assert.Equal(t, a.Timestamp, history[1].FirstSeen)
+	assert.Equal(t, []AssignmentHistoryEntry{history[0]}, a.PreviousVariations("vg1"))
+	assert.Equal(t, []string{"vg1"}, a.ChangedVariationGroups())
+
+	// Saves of the same variation update its last seen timestamp
+	_, err = GetDecision(createBatchVisitor("vis1", true), env, DecisionOptions{TriggerHit: true}, DecisionHandlers{AssignmentStore: store})
+	assert.Nil(t, err)
+	a, _ = store.Get(ctx, "env_id", "vis1")
+	assert.Len(t, a.History["vg1"], 2)
+	assert.True(t, a.Assignments["vg1"].Activated)
+
+	// Batch decisions record the history too
+	assert.Nil(t, store.Save(ctx, "env_id", "vis2", &VisitorAssignments{
+		Timestamp:   expired,
+		Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v_old"}},
+	}))
+	_, err = GetDecisions([]Visitor{createBatchVisitor("vis2", true)}, env, DecisionOptions{}, BatchDecisionHandlers{AssignmentStore: store})
+	assert.Nil(t, err)
+	a, _ = store.Get(ctx, "env_id", "vis2")
+	assert.Equal(t, []string{"vg1"}, a.ChangedVariationGroups())
+
+	// Variations served from the cache update their last seen timestamp whenever the assignments are saved
+	seen := time.Now().Add(-time.Minute).Unix()
+	servedEnv := createBatchEnvironment()
+	servedEnv.AssignmentTTL = time.Hour
+	servedEnv.AssignmentHistorySize = 3
+	servedEnv.Campaigns = append(servedEnv.Campaigns, &Campaign{
+		ID:           "c2",
+		Type:         "ab",
+		BucketRanges: [][]float64{{0., 100.}},
+		VariationGroups: []*VariationGroup{
+			{ID: "vg2", Targetings: createBoolTargeting(), Variations: []*Variation{{ID: "v1", Allocation: 100}}},
+		},
+	})
+	served := &VisitorAssignments{
+		Timestamp:   seen,
+		Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v2", Activated: true}},
+		History:     map[string][]AssignmentHistoryEntry{"vg1": {{VariationID: "v2", FirstSeen: seen, LastSeen: seen}}},
+	}
+	assert.Nil(t, store.Save(ctx, "env_id", "vis4", served))
+	decision, err = GetDecision(createBatchVisitor("vis4", true), servedEnv, DecisionOptions{}, DecisionHandlers{AssignmentStore: store})
+	assert.Nil(t, err)
+	assert.Len(t, decision.Campaigns, 2)
+	a, _ = store.Get(ctx, "env_id", "vis4")
+	assert.Equal(t, []AssignmentHistoryEntry{{VariationID: "v2", FirstSeen: seen, LastSeen: a.Timestamp}}, a.History["vg1"])
+	assert.True(t, a.Assignments["vg1"].Activated)
+	assert.Equal(t, seen, a.Assignments["vg1"].AssignedAt)
+	assert.Contains(t, a.Assignments, "vg2")
+
+	// Served variations alone do not save the assignments
+	_, err = GetDecision(createBatchVisitor("vis4", true), servedEnv, DecisionOptions{}, DecisionHandlers{AssignmentStore: store})
+	assert.Nil(t, err)
+	saved, _ := store.Get(ctx, "env_id", "vis4")
+	assert.Equal(t, a.Version, saved.Version)
+
+	// Batch decisions update the last seen timestamp too, and dry runs do not report the served variations
+	assert.Nil(t, store.Save(ctx, "env_id", "vis5", served))
+	report := &DryRunReport{}
+	_, err = GetDecisions([]Visitor{createBatchVisitor("vis5", true)}, servedEnv, DecisionOptions{DryRun: report}, BatchDecisionHandlers{AssignmentStore: store})
+	assert.Nil(t, err)
+	assert.Len(t, report.Saves["vis5"].Assignments, 1)
+	assert.Contains(t, report.Saves["vis5"].Assignments, "vg2")
+	_, err = GetDecisions([]Visitor{createBatchVisitor("vis5", true)}, servedEnv, DecisionOptions{}, BatchDecisionHandlers{AssignmentStore: store})
+	assert.Nil(t, err)
+	a, _ = store.Get(ctx, "env_id", "vis5")
+	assert.Equal(t, []AssignmentHistoryEntry{{VariationID: "v2", FirstSeen: seen, LastSeen: a.Timestamp}}, a.History["vg1"])
+
+	// The history of deleted variation groups is pruned with their assignments
+	env.PruneDeletedAssignments = true
+	assert.Nil(t, store.Save(ctx, "env_id", "vis3", &VisitorAssignments{
+		Timestamp:   expired,
+		Assignments: map[string]*VisitorCache{"vg_deleted": {VariationID: "v1"}},
+		History:     map[string][]AssignmentHistoryEntry{"vg_deleted": {{VariationID: "v1"}}},
+	}))
+	_, err = GetDecision(createBatchVisitor("vis3", true), env, DecisionOptions{}, DecisionHandlers{AssignmentStore: store})
+	assert.Nil(t, err)
+	a, _ = store.Get(ctx, "env_id", "vis3")
+	assert.NotContains(t, a.History, "vg_deleted")
+	assert.Len(t, a.History["vg1"], 1)
+}
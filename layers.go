@@ -0,0 +1,145 @@
+package decision
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Layer groups mutually exclusive campaigns. The visitor is hashed with the layer salt,
+// and each campaign of the layer owns traffic slices of that hash, so a visitor gets at most one campaign per layer
+type Layer struct {
+	ID string
+	// Salt is added to the visitor ID to compute the layer hash. The layer ID is used if empty
+	Salt   string
+	Slices []*LayerSlice
+}
+
+// LayerSlice assigns the [Start, End) traffic range of the layer, between 0 and 100, to a campaign
+type LayerSlice struct {
+	CampaignID string
+	Start      float64
+	End        float64
+}
+
+// campaignLayer stores the slices of a campaign in a layer
+type campaignLayer struct {
+	layerID string
+	salt    string
+	slices  []*LayerSlice
+	// invalid is set if the layer is invalid, so that its campaigns are never returned
+	invalid bool
+}
+
+// getSalt returns the salt used to hash visitors in the layer
+func (l *Layer) getSalt() string {
+	if l.Salt != "" {
+		return l.Salt
+	}
+	return l.ID
+}
+
+// validateLayers returns an error if a layer is invalid or if the slices of a layer overlap
+func validateLayers(layers []*Layer) error {
+	layerIDs := map[string]bool{}
+	for _, l := range layers {
+		if err := validateLayer(l, layerIDs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateLayer returns an error if the layer is invalid, if its ID is in the already validated layer IDs,
+// or if its slices overlap. The layer ID is added to the validated layer IDs
+func validateLayer(l *Layer, layerIDs map[string]bool) error {
+	if l == nil {
+		return fmt.Errorf("layer is null")
+	}
+	if layerIDs[l.ID] {
+		return fmt.Errorf("duplicated layer ID %s", l.ID)
+	}
+
+	slices := make([]*LayerSlice, 0, len(l.Slices))
+	for _, s := range l.Slices {
+		if s == nil {
+			return fmt.Errorf("slice is null for layer %s", l.ID)
+		}
+		if s.Start < 0 || s.End > 100 || s.Start >= s.End {
+			return fmt.Errorf("invalid slice [%v, %v) for campaign %s in layer %s", s.Start, s.End, s.CampaignID, l.ID)
+		}
+		slices = append(slices, s)
+	}
+
+	sort.Slice(slices, func(i, j int) bool {
+		return slices[i].Start < slices[j].Start
+	})
+	for i := 1; i < len(slices); i++ {
+		if slices[i].Start < slices[i-1].End {
+			return fmt.Errorf(
+				"slice of campaign %s overlaps slice of campaign %s in layer %s",
+				slices[i].CampaignID, slices[i-1].CampaignID, l.ID)
+		}
+	}
+	layerIDs[l.ID] = true
+	return nil
+}
+
+// getCampaignsLayers returns the layers slices of each campaign, by campaign ID.
+// Invalid layers are logged and kept marked as invalid, so that decisions on environments that are not compiled
+// with CompileEnvironment skip their campaigns instead of returning them without exclusion
+func getCampaignsLayers(layers []*Layer) map[string][]*campaignLayer {
+	campaignsLayers := map[string][]*campaignLayer{}
+	layerIDs := map[string]bool{}
+	for _, l := range layers {
+		err := validateLayer(l, layerIDs)
+		if err != nil {
+			logger.Logf(ErrorLevel, "skipping the campaigns of invalid layer: %v", err)
+		}
+		if l == nil {
+			continue
+		}
+		layersByCampaign := map[string]*campaignLayer{}
+		for _, s := range l.Slices {
+			if s == nil {
+				continue
+			}
+			cl, ok := layersByCampaign[s.CampaignID]
+			if !ok {
+				cl = &campaignLayer{
+					layerID: l.ID,
+					salt:    l.getSalt(),
+					invalid: err != nil,
+				}
+				layersByCampaign[s.CampaignID] = cl
+				campaignsLayers[s.CampaignID] = append(campaignsLayers[s.CampaignID], cl)
+			}
+			cl.slices = append(cl.slices, s)
+		}
+	}
+	return campaignsLayers
+}
+
+// shouldSkipLayerVG returns true if the variation group should be skipped according to the layers of its campaign,
+// because the visitor does not fall into the campaign slices or already got a campaign in the layer
+func shouldSkipLayerVG(visitorID string, campaign *Campaign, assignedLayers map[string]bool) bool {
+	for _, cl := range campaign.layers {
+		if cl.invalid {
+			logger.Logf(DebugLevel, "campaign %s is in invalid layer %s", campaign.ID, cl.layerID)
+			return true
+		}
+		if assignedLayers[cl.layerID] {
+			logger.Logf(DebugLevel, "visitor ID %s already got a campaign in layer %s", visitorID, cl.layerID)
+			return true
+		}
+
+		isInSlice, err := isVisitorInLayerSlices(visitorID, cl)
+		if err != nil {
+			logger.Logf(WarnLevel, "error on layer allocation for campaign %v: %v", campaign.ID, err)
+		}
+		if !isInSlice {
+			logger.Logf(DebugLevel, "visitor ID %s does not fall into the campaign's slices of layer %s", visitorID, cl.layerID)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package decision
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/flagship-io/flagship-common/targeting"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestValidateLayers(t *testing.T) {
+	assert.Nil(t, validateLayers(nil))
+	assert.Nil(t, validateLayers([]*Layer{
+		{ID: "l1", Slices: []*LayerSlice{{CampaignID: "c2", Start: 50, End: 100}, {CampaignID: "c1", Start: 0, End: 50}}},
+		{ID: "l2", Slices: []*LayerSlice{{CampaignID: "c1", Start: 0, End: 100}}},
+	}))
+
+	assert.NotNil(t, validateLayers([]*Layer{nil}))
+	assert.NotNil(t, validateLayers([]*Layer{{ID: "l1"}, {ID: "l1"}}))
+	assert.NotNil(t, validateLayers([]*Layer{{ID: "l1", Slices: []*LayerSlice{nil}}}))
+	assert.NotNil(t, validateLayers([]*Layer{{ID: "l1", Slices: []*LayerSlice{{CampaignID: "c1", Start: -1, End: 50}}}}))
+	assert.NotNil(t, validateLayers([]*Layer{{ID: "l1", Slices: []*LayerSlice{{CampaignID: "c1", Start: 50, End: 101}}}}))
+	assert.NotNil(t, validateLayers([]*Layer{{ID: "l1", Slices: []*LayerSlice{{CampaignID: "c1", Start: 50, End: 50}}}}))
+
+	err := validateLayers([]*Layer{
+		{ID: "l1", Slices: []*LayerSlice{{CampaignID: "c1", Start: 0, End: 60}, {CampaignID: "c2", Start: 50, End: 100}}},
+	})
+	assert.EqualError(t, err, "slice of campaign c2 overlaps slice of campaign c1 in layer l1")
+}
+
+func TestGetCampaignsLayers(t *testing.T) {
+	campaignsLayers := getCampaignsLayers([]*Layer{
+		{ID: "l1", Salt: "salt", Slices: []*LayerSlice{{CampaignID: "c1", Start: 0, End: 10}, {CampaignID: "c1", Start: 50, End: 60}, {CampaignID: "c2", Start: 10, End: 50}}},
+		{ID: "l2", Slices: []*LayerSlice{{CampaignID: "c1", Start: 0, End: 100}}},
+	})
+
+	assert.Len(t, campaignsLayers, 2)
+	assert.Len(t, campaignsLayers["c1"], 2)
+	assert.Equal(t, "l1", campaignsLayers["c1"][0].layerID)
+	assert.Equal(t, "salt", campaignsLayers["c1"][0].salt)
+	assert.Len(t, campaignsLayers["c1"][0].slices, 2)
+	assert.Equal(t, "l2", campaignsLayers["c1"][1].layerID)
+	assert.Equal(t, "l2", campaignsLayers["c1"][1].salt)
+	assert.Len(t, campaignsLayers["c2"], 1)
+}
+
+func createLayerCampaign(id string) *Campaign {
+	return &Campaign{
+		ID:           id,
+		Type:         "ab",
+		BucketRanges: [][]float64{{0., 100.}},
+		VariationGroups: []*VariationGroup{
+			{
+				ID:         "vg_" + id,
+				Targetings: createBoolTargeting(),
+				Variations: []*Variation{{ID: "v_" + id, Allocation: 100}},
+			},
+		},
+	}
+}
+
+func TestDecisionLayers(t *testing.T) {
+	compiled, err := CompileEnvironment(Environment{
+		ID:        "e123",
+		Campaigns: []*Campaign{createLayerCampaign("c1"), createLayerCampaign("c2"), createLayerCampaign("c3"), createLayerCampaign("c_no_layer")},
+		Layers: []*Layer{
+			{ID: "l1", Slices: []*LayerSlice{{CampaignID: "c1", Start: 0, End: 50}, {CampaignID: "c2", Start: 50, End: 80}}},
+			{ID: "l2", Slices: []*LayerSlice{{CampaignID: "c3", Start: 0, End: 100}}},
+		},
+	})
+	assert.Nil(t, err)
+
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		decision, err := GetDecisionCompiled(context.Background(), Visitor{
+			ID: strconv.Itoa(i),
+			Context: &targeting.Context{
+				Standard: targeting.ContextMap{
+					"isVIP": structpb.NewBoolValue(true),
+				},
+			},
+		}, compiled, DecisionOptions{}, DecisionHandlers{})
+		assert.Nil(t, err)
+
+		layer1Campaigns := 0
+		for _, c := range decision.Campaigns {
+			counts[c.Id.Value]++
+			if c.Id.Value == "c1" || c.Id.Value == "c2" {
+				layer1Campaigns++
+			}
+		}
+		assert.LessOrEqual(t, layer1Campaigns, 1)
+	}
+
+	assert.InDelta(t, 5000, counts["c1"], 300)
+	assert.InDelta(t, 3000, counts["c2"], 300)
+	assert.Equal(t, 10000, counts["c3"])
+	assert.Equal(t, 10000, counts["c_no_layer"])
+
+	_, err = CompileEnvironment(Environment{
+		Layers: []*Layer{
+			{ID: "l1", Slices: []*LayerSlice{{CampaignID: "c1", Start: 0, End: 50}, {CampaignID: "c2", Start: 40, End: 80}}},
+		},
+	})
+	assert.NotNil(t, err)
+}
+
+func TestShouldSkipLayerVG(t *testing.T) {
+	campaign := &Campaign{
+		ID: "c1",
+		layers: []*campaignLayer{
+			{layerID: "l1", salt: "l1", slices: []*LayerSlice{{CampaignID: "c1", Start: 0, End: 100}}},
+		},
+	}
+	assert.False(t, shouldSkipLayerVG("vid", campaign, map[string]bool{}))
+	assert.True(t, shouldSkipLayerVG("vid", campaign, map[string]bool{"l1": true}))
+	assert.False(t, shouldSkipLayerVG("vid", &Campaign{ID: "c2"}, map[string]bool{"l1": true}))
+
+	campaign.layers[0].slices[0].End = 0.5
+	z, _ := genHashFloat("vid", "l1")
+	assert.Equal(t, z >= 0.5, shouldSkipLayerVG("vid", campaign, map[string]bool{}))
+}
+
+func TestDecisionInvalidLayers(t *testing.T) {
+	env := Environment{
+		ID:        "e123",
+		Campaigns: []*Campaign{createLayerCampaign("c1"), createLayerCampaign("c2"), createLayerCampaign("c3"), createLayerCampaign("c4")},
+		Layers: []*Layer{
+			{ID: "l1", Slices: []*LayerSlice{{CampaignID: "c1", Start: 0, End: 60}, {CampaignID: "c2", Start: 50, End: 100}}},
+			{ID: "l2", Slices: []*LayerSlice{{CampaignID: "c4", Start: 0, End: 50}}},
+			{ID: "l2", Slices: []*LayerSlice{{CampaignID: "c3", Start: 50, End: 200}}},
+		},
+	}
+
+	// The campaigns of invalid layers are never returned, so that at most one campaign of a layer is returned
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		decision, err := GetDecision(Visitor{
+			ID: strconv.Itoa(i),
+			Context: &targeting.Context{
+				Standard: targeting.ContextMap{
+					"isVIP": structpb.NewBoolValue(true),
+				},
+			},
+		}, env, DecisionOptions{}, DecisionHandlers{})
+		assert.Nil(t, err)
+		assert.LessOrEqual(t, len(decision.Campaigns), 1)
+		for _, c := range decision.Campaigns {
+			counts[c.Id.Value]++
+		}
+	}
+
+	assert.Equal(t, 0, counts["c1"])
+	assert.Equal(t, 0, counts["c2"])
+	assert.Equal(t, 0, counts["c3"])
+	assert.InDelta(t, 500, counts["c4"], 100)
+}
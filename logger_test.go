@@ -10,6 +10,9 @@ import (
 )
 
 func TestSetLogger(t *testing.T) {
+	previousLogger := logger
+	defer SetLogger(previousLogger)
+
 	newLogger := &DefaultLogger{}
 	SetLogger(newLogger)
 	assert.Equal(t, newLogger, logger)
@@ -0,0 +1,188 @@
+package decision
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// AssignmentMigration maps the old IDs of variation groups and variations to their new IDs,
+// for instance when a campaign is duplicated or rebuilt, so that visitors keep their assigned variation
+type AssignmentMigration struct {
+	// VariationGroupIDs maps old variation group IDs to new ones
+	VariationGroupIDs map[string]string
+	// VariationIDs maps old variation IDs to new ones
+	VariationIDs map[string]string
+}
+
+// MigrateAssignments returns a copy of the assignments re-keyed with the new variation group and variation IDs of the migration,
+// with the history of their variation groups.
+// If the new variation group already has an assignment, it is kept and the old assignment is dropped.
+// If several old variation groups are migrated to the same one, the first one in the ID order wins
+func MigrateAssignments(migration AssignmentMigration, assignments *VisitorAssignments) *VisitorAssignments {
+	migrated, _ := migration.apply(assignments)
+	if migrated == assignments {
+		return assignments.clone()
+	}
+	return migrated
+}
+
+// apply returns the re-keyed assignments and the new IDs of the re-keyed variation groups.
+// The assignments are copied only if some of them are re-keyed or dropped
+func (m *AssignmentMigration) apply(assignments *VisitorAssignments) (*VisitorAssignments, map[string]bool) {
+	if m == nil || assignments == nil {
+		return assignments, nil
+	}
+
+	// Sort the variation groups so that the first one wins when several are migrated to the same variation group
+	vgIDs := make([]string, 0, len(assignments.Assignments))
+	for vgID := range assignments.Assignments {
+		vgIDs = append(vgIDs, vgID)
+	}
+	sort.Strings(vgIDs)
+
+	var migrated *VisitorAssignments
+	var migratedVGs map[string]bool
+	for _, vgID := range vgIDs {
+		a := assignments.Assignments[vgID]
+		if a == nil {
+			continue
+		}
+		newVGID := vgID
+		if id := m.VariationGroupIDs[vgID]; id != "" {
+			newVGID = id
+		}
+		newVariationID := a.VariationID
+		if id := m.VariationIDs[a.VariationID]; id != "" {
+			newVariationID = id
+		}
+		if newVGID == vgID && newVariationID == a.VariationID {
+			continue
+		}
+		if migrated == nil {
+			migrated = assignments.clone()
+			migratedVGs = map[string]bool{}
+		}
+		_, exists := assignments.Assignments[newVGID]
+		if (exists && newVGID != vgID) || migratedVGs[newVGID] {
+			logger.Logf(DebugLevel, "variation group %s already has an assignment, dropping the one of variation group %s", newVGID, vgID)
+			delete(migrated.Assignments, vgID)
+			delete(migrated.History, vgID)
+			continue
+		}
+
+		logger.Logf(DebugLevel, "migrating assignment of variation group %s to variation group %s and variation %s", vgID, newVGID, newVariationID)
+		delete(migrated.Assignments, vgID)
+		migrated.Assignments[newVGID] = &VisitorCache{VariationID: newVariationID, Activated: a.Activated, AssignedAt: a.AssignedAt}
+		migratedVGs[newVGID] = true
+		if _, ok := assignments.History[newVGID]; ok && newVGID != vgID {
+			continue
+		}
+		if entries, ok := assignments.History[vgID]; ok {
+			delete(migrated.History, vgID)
+			migrated.History[newVGID] = m.applyHistory(entries)
+		}
+	}
+	if migrated == nil {
+		return assignments, nil
+	}
+	return migrated, migratedVGs
+}
+
+// applyHistory returns a copy of the history entries with the new variation IDs
+func (m *AssignmentMigration) applyHistory(entries []AssignmentHistoryEntry) []AssignmentHistoryEntry {
+	migrated := make([]AssignmentHistoryEntry, 0, len(entries))
+	for _, e := range entries {
+		if id := m.VariationIDs[e.VariationID]; id != "" {
+			e.VariationID = id
+		}
+		migrated = append(migrated, e)
+	}
+	return migrated
+}
+
+// migrate returns the re-keyed assignments of all the IDs, and the new IDs of the re-keyed variation groups
+// of the visitor and decision group assignments and of the anonymous assignments
+func (a allVisitorAssignments) migrate(m *AssignmentMigration) (allVisitorAssignments, map[string]bool, map[string]bool) {
+	standard, migratedVGs := m.apply(a.Standard)
+	anonymous, migratedVGsAnonymous := m.apply(a.Anonymous)
+	decisionGroup, migratedVGsDecisionGroup := m.apply(a.DecisionGroup)
+	for vgID := range migratedVGsDecisionGroup {
+		if migratedVGs == nil {
+			migratedVGs = map[string]bool{}
+		}
+		migratedVGs[vgID] = true
+	}
+	return allVisitorAssignments{
+		Standard:      standard,
+		Anonymous:     anonymous,
+		DecisionGroup: decisionGroup,
+	}, migratedVGs, migratedVGsAnonymous
+}
+
+// MigrateStoredAssignments re-keys the stored assignments of the IDs of the environment with the migration,
+// reading them with the GetCache handler and saving them with the CompareAndSaveCache or SaveCache handler, or the AssignmentStore.
+// IDs without assignments to migrate are skipped. Only the progress options are used.
+// If the IDs are nil, all the IDs of the environment are migrated if the AssignmentStore is a ScanStore
+func MigrateStoredAssignments(ctx context.Context, handlers DecisionHandlers, environmentID string, ids []string, migration AssignmentMigration, options TransferOptions) (TransferProgress, error) {
+	handlers = handlers.withAssignmentStore()
+	progress := TransferProgress{}
+	if handlers.GetCache == nil || (handlers.SaveCache == nil && handlers.CompareAndSaveCache == nil) {
+		return progress, OperationNotSupportedError
+	}
+
+	ids, err := handlers.storeIDs(ctx, environmentID, ids)
+	if err != nil {
+		return progress, err
+	}
+
+	reporter := newProgressReporter(options)
+	defer func() { reporter.done(progress) }()
+
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return progress, err
+		}
+
+		migrated, err := migrateStoredAssignments(ctx, handlers, environmentID, id, &migration)
+		if err != nil {
+			return progress, fmt.Errorf("error when migrating assignments of %s: %w", id, err)
+		}
+		progress.Processed++
+		if migrated {
+			progress.Transferred++
+		} else {
+			progress.Skipped++
+		}
+		reporter.report(progress)
+	}
+	return progress, nil
+}
+
+// migrateStoredAssignments re-keys the stored assignments of the ID, reloading them on version conflict.
+// It returns false if the ID has no assignments to migrate
+func migrateStoredAssignments(ctx context.Context, handlers DecisionHandlers, environmentID string, id string, migration *AssignmentMigration) (bool, error) {
+	var err error
+	for i := 0; i < maxCompareAndSaveAttempts; i++ {
+		var assignments *VisitorAssignments
+		assignments, err = handlers.GetCache(ctx, environmentID, id)
+		if err != nil {
+			return false, err
+		}
+		migrated, _ := migration.apply(assignments)
+		if migrated == assignments {
+			return false, nil
+		}
+
+		if handlers.CompareAndSaveCache == nil {
+			return true, handlers.SaveCache(ctx, environmentID, id, migrated)
+		}
+		err = handlers.CompareAndSaveCache(ctx, environmentID, id, migrated)
+		if !errors.Is(err, VersionConflictError) {
+			return err == nil, err
+		}
+		logger.Logf(DebugLevel, "assignments version conflict for %s, reloading assignments", id)
+	}
+	return false, err
+}
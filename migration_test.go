@@ -0,0 +1,193 @@
+package decision
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func createMigration() AssignmentMigration {
+	return AssignmentMigration{
+		VariationGroupIDs: map[string]string{"vg_old": "vg1", "vg_old2": "vg1", "vg_old3": "vg3"},
+		VariationIDs:      map[string]string{"v_old1": "v1", "v_old2": "v2"},
+	}
+}
+
+func TestMigrateAssignments(t *testing.T) {
+	assignments := &VisitorAssignments{
+		Timestamp: 1,
+		Version:   2,
+		Assignments: map[string]*VisitorCache{
+			"vg_old":  {VariationID: "v_old2", Activated: true},
+			"vg_old2": {VariationID: "v_old1"},
+			"vg2":     {VariationID: "v_old1"},
+			"vg4":     {VariationID: "v4"},
+		},
+	}
+
+	migrated := MigrateAssignments(createMigration(), assignments)
+	assert.Equal(t, &VisitorAssignments{
+		Timestamp: 1,
+		Version:   2,
+		Assignments: map[string]*VisitorCache{
+			"vg1": {VariationID: "v2", Activated: true},
+			"vg2": {VariationID: "v1"},
+			"vg4": {VariationID: "v4"},
+		},
+	}, migrated)
+
+	// The given assignments should not be modified
+	assert.Equal(t, "v_old2", assignments.Assignments["vg_old"].VariationID)
+	assert.Len(t, assignments.Assignments, 4)
+
+	// Assignments of the new variation groups are kept, and the old ones are dropped with their history
+	assignments.Assignments["vg1"] = &VisitorCache{VariationID: "v1"}
+	assignments.History = map[string][]AssignmentHistoryEntry{"vg_old": {{VariationID: "v_old2", FirstSeen: 1, LastSeen: 1}}}
+	migrated = MigrateAssignments(createMigration(), assignments)
+	assert.Equal(t, map[string]*VisitorCache{
+		"vg1": {VariationID: "v1"},
+		"vg2": {VariationID: "v1"},
+		"vg4": {VariationID: "v4"},
+	}, migrated.Assignments)
+	assert.Len(t, migrated.History, 0)
+	assert.Contains(t, assignments.Assignments, "vg_old")
+	assignments.History = nil
+
+	// The history of re-keyed variation groups is re-keyed as well
+	migrated = MigrateAssignments(createMigration(), &VisitorAssignments{
+		Assignments: map[string]*VisitorCache{"vg_old": {VariationID: "v_old2"}},
+		History:     map[string][]AssignmentHistoryEntry{"vg_old": {{VariationID: "v_old1", FirstSeen: 1, LastSeen: 2}, {VariationID: "v_old2", FirstSeen: 3, LastSeen: 3}}},
+	})
+	assert.Equal(t, map[string][]AssignmentHistoryEntry{"vg1": {{VariationID: "v1", FirstSeen: 1, LastSeen: 2}, {VariationID: "v2", FirstSeen: 3, LastSeen: 3}}}, migrated.History)
+
+	assert.Equal(t, assignments, MigrateAssignments(AssignmentMigration{}, assignments))
+	assert.Nil(t, MigrateAssignments(createMigration(), nil))
+}
+
+func TestDecisionMigrateAssignments(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryAssignmentStore(0)
+	existing := &VisitorAssignments{
+		Assignments: map[string]*VisitorCache{"vg_old": {VariationID: "v_old2", Activated: true}},
+		History:     map[string][]AssignmentHistoryEntry{"vg_old": {{VariationID: "v_old2", FirstSeen: 1, LastSeen: 1}}},
+	}
+	env := createBatchEnvironment()
+	env.AssignmentHistorySize = 5
+	migration := createMigration()
+	env.AssignmentMigration = &migration
+
+	// The visitor keeps the variation assigned before the campaign was rebuilt
+	for _, id := range []string{"vis1", "vis2", "vis3", "vis4"} {
+		assert.Nil(t, store.Save(ctx, "env_id", id, existing))
+		decision, err := GetDecision(createBatchVisitor(id, true), env, DecisionOptions{}, DecisionHandlers{AssignmentStore: store})
+		assert.Nil(t, err)
+		assert.Equal(t, "v2", decision.Campaigns[0].Variation.Id.Value)
+
+		// The re-keyed assignment is saved with its new IDs only, with its history
+		a, _ := store.Get(ctx, "env_id", id)
+		assert.Len(t, a.Assignments, 1)
+		assert.Equal(t, "v2", a.Assignments["vg1"].VariationID)
+		assert.True(t, a.Assignments["vg1"].Activated)
+		assert.NotContains(t, a.History, "vg_old")
+		assert.Equal(t, []AssignmentHistoryEntry{{VariationID: "v2", FirstSeen: 1, LastSeen: a.Timestamp}}, a.History["vg1"])
+	}
+
+	// Anonymous assignments are re-keyed as well
+	visitor := createBatchVisitor("vis5", true)
+	visitor.AnonymousID = "anon5"
+	assert.Nil(t, store.Save(ctx, "env_id", "anon5", existing))
+	decision, err := GetDecision(visitor, env, DecisionOptions{}, DecisionHandlers{AssignmentStore: store})
+	assert.Nil(t, err)
+	assert.Equal(t, "v2", decision.Campaigns[0].Variation.Id.Value)
+	a, _ := store.Get(ctx, "env_id", "anon5")
+	assert.Equal(t, "v2", a.Assignments["vg1"].VariationID)
+	assert.NotContains(t, a.Assignments, "vg_old")
+
+	// Batch decisions apply the migration too
+	assert.Nil(t, store.Save(ctx, "env_id", "vis6", existing))
+	decisions, err := GetDecisions([]Visitor{createBatchVisitor("vis6", true)}, env, DecisionOptions{}, BatchDecisionHandlers{AssignmentStore: store})
+	assert.Nil(t, err)
+	assert.Equal(t, "v2", decisions[0].Response.Campaigns[0].Variation.Id.Value)
+	a, _ = store.Get(ctx, "env_id", "vis6")
+	assert.Len(t, a.Assignments, 1)
+	assert.Equal(t, "v2", a.Assignments["vg1"].VariationID)
+
+	// Without migration, assignments of deleted variations are not served
+	env.AssignmentMigration = &AssignmentMigration{VariationGroupIDs: map[string]string{"vg_old": "vg1"}}
+	assert.Nil(t, store.Save(ctx, "env_id", "vis7", existing))
+	decision, err = GetDecision(createBatchVisitor("vis7", true), env, DecisionOptions{}, DecisionHandlers{AssignmentStore: store})
+	assert.Nil(t, err)
+	assert.Len(t, decision.Campaigns, 0)
+}
+
+func TestMigrateStoredAssignments(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryAssignmentStore(0)
+	assert.Nil(t, store.Save(ctx, "env_id", "vis1", &VisitorAssignments{
+		Assignments: map[string]*VisitorCache{"vg_old": {VariationID: "v_old2", Activated: true}},
+	}))
+	assert.Nil(t, store.Save(ctx, "env_id", "vis2", &VisitorAssignments{
+		Assignments: map[string]*VisitorCache{"vg4": {VariationID: "v4"}},
+	}))
+
+	progresses := []TransferProgress{}
+	progress, err := MigrateStoredAssignments(ctx, DecisionHandlers{AssignmentStore: store}, "env_id", []string{"vis1", "vis2", "vis3"}, createMigration(), TransferOptions{
+		OnProgress: func(progress TransferProgress) {
+			progresses = append(progresses, progress)
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, TransferProgress{Processed: 3, Transferred: 1, Skipped: 2}, progress)
+	assert.Equal(t, []TransferProgress{progress}, progresses)
+
+	a, _ := store.Get(ctx, "env_id", "vis1")
+	assert.Equal(t, map[string]*VisitorCache{"vg1": {VariationID: "v2", Activated: true}}, a.Assignments)
+	assert.Equal(t, int64(2), a.Version)
+
+	// Version conflicts reload the assignments
+	nbConflicts := 0
+	assert.Nil(t, store.Save(ctx, "env_id", "vis3", &VisitorAssignments{
+		Assignments: map[string]*VisitorCache{"vg_old3": {VariationID: "v3"}},
+	}))
+	progress, err = MigrateStoredAssignments(ctx, DecisionHandlers{
+		GetCache: store.Get,
+		CompareAndSaveCache: func(ctx context.Context, environmentID string, id string, assignments *VisitorAssignments) error {
+			if nbConflicts == 0 {
+				nbConflicts++
+				return VersionConflictError
+			}
+			return store.CompareAndSave(ctx, environmentID, id, assignments)
+		},
+	}, "env_id", []string{"vis3"}, createMigration(), TransferOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, progress.Transferred)
+	a, _ = store.Get(ctx, "env_id", "vis3")
+	assert.Equal(t, map[string]*VisitorCache{"vg3": {VariationID: "v3"}}, a.Assignments)
+
+	// Colliding assignments are dropped even if no assignment is re-keyed
+	assert.Nil(t, store.Save(ctx, "env_id", "vis5", &VisitorAssignments{
+		Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1"}, "vg_old": {VariationID: "v_old2"}},
+	}))
+	progress, err = MigrateStoredAssignments(ctx, DecisionHandlers{AssignmentStore: store}, "env_id", []string{"vis5"}, createMigration(), TransferOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, progress.Transferred)
+	a, _ = store.Get(ctx, "env_id", "vis5")
+	assert.Equal(t, map[string]*VisitorCache{"vg1": {VariationID: "v1"}}, a.Assignments)
+
+	_, err = MigrateStoredAssignments(ctx, DecisionHandlers{GetCache: store.Get}, "env_id", []string{"vis1"}, createMigration(), TransferOptions{})
+	assert.Equal(t, OperationNotSupportedError, err)
+
+	// Without IDs, all the IDs of the store are migrated
+	assert.Nil(t, store.Save(ctx, "env_id", "vis4", &VisitorAssignments{
+		Assignments: map[string]*VisitorCache{"vg_old3": {VariationID: "v3"}},
+	}))
+	progress, err = MigrateStoredAssignments(ctx, DecisionHandlers{AssignmentStore: store}, "env_id", nil, createMigration(), TransferOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, TransferProgress{Processed: 5, Transferred: 1, Skipped: 4}, progress)
+	a, _ = store.Get(ctx, "env_id", "vis4")
+	assert.Contains(t, a.Assignments, "vg3")
+
+	_, err = MigrateStoredAssignments(ctx, DecisionHandlers{GetCache: store.Get, SaveCache: store.Save}, "env_id", nil, createMigration(), TransferOptions{})
+	assert.Equal(t, OperationNotSupportedError, err)
+}
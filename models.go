@@ -1,6 +1,7 @@
 package decision
 
 import (
+	"context"
 	"time"
 
 	"github.com/flagship-io/flagship-common/targeting"
@@ -26,18 +27,36 @@ type VariationGroup struct {
 	CreatedAt  time.Time
 	Targetings *targetingProto.Targeting
 	Variations []*Variation
+
+	compiledTargetings *compiledTargeting
 }
 
 // VisitorCache represents a visitor variation group cache item for a variation group
 type VisitorCache struct {
 	VariationID string
 	Activated   bool
+	// AssignedAt is the unix timestamp of the first save of the variation assignment, 0 if unknown.
+	// The TTL of the assignment is counted from it, or from the assignments Timestamp if unknown
+	AssignedAt int64
+
+	// served marks a variation served from the cached assignments without being assigned again,
+	// saved only to update its history
+	served bool
 }
 
 // VisitorAssignments represents a visitor assignment for a variation group
 type VisitorAssignments struct {
 	Timestamp   int64
 	Assignments map[string]*VisitorCache
+	// Version is the optimistic concurrency token of the stored assignments, 0 if none are stored.
+	// Compare and save handlers only save the assignments if the stored version is unchanged, and increment it
+	Version int64
+	// TTL is set on save to the duration after which all the assignments are expired, 0 if any of them never expires.
+	// Stores can use it to set a native expiry
+	TTL time.Duration
+	// History stores by variation group the variations assigned to the visitor, from the oldest to the most recent,
+	// when the environment assignment history size is set
+	History map[string][]AssignmentHistoryEntry
 }
 
 type Visitor struct {
@@ -55,6 +74,25 @@ type Environment struct {
 	UseReconciliation bool
 	CacheEnabled      bool
 	Troubleshooting   *troubleshootingProto.Troubleshooting
+	// Layers groups mutually exclusive campaigns
+	Layers []*Layer
+	// CacheFailurePolicy defines how the decision behaves when the cached assignments fail to load
+	CacheFailurePolicy CacheFailurePolicy
+	// AssignmentTTL is the duration after which the visitors assignments expire and are allocated again.
+	// 0 means that assignments never expire
+	AssignmentTTL time.Duration
+	// PruneDeletedAssignments removes on save the assignments of variation groups that are not in the environment campaigns.
+	// Only enable it if the environment contains all its campaigns
+	PruneDeletedAssignments bool
+	// AssignmentMigration re-keys the cached assignments of variation groups and variations whose ID changed when set.
+	// Re-keyed assignments are saved with their new IDs
+	AssignmentMigration *AssignmentMigration
+	// AssignmentHistorySize is the maximum number of variations recorded by variation group in the history of the visitors assignments.
+	// 0 disables the history
+	AssignmentHistorySize int
+
+	assignmentTTLPolicy *AssignmentTTLPolicy
+	variationGroupIDs   map[string]bool
 }
 
 type DecisionOptions struct {
@@ -64,6 +102,12 @@ type DecisionOptions struct {
 	ExposeAllKeys          bool
 	IsCumulativeAlloc      bool
 	EnableBucketAllocation *bool
+	// Explanation is filled with the trace of each evaluated campaign when set
+	Explanation *DecisionExplanation
+	// DryRun disables all the decision side effects when set, and is filled with the side effects that would have been made
+	DryRun *DryRunReport
+	// CacheFailurePolicy overrides the environment cache failure policy when set
+	CacheFailurePolicy *CacheFailurePolicy
 }
 
 type VisitorActivation struct {
@@ -74,10 +118,40 @@ type VisitorActivation struct {
 	VariationID      string
 }
 
+// DecisionHandlers stores the side effect callbacks of the decision.
+// The context passed to each handler is the one given to GetDecisionContext
 type DecisionHandlers struct {
-	GetCache          func(environmentID string, id string) (*VisitorAssignments, error)
-	SaveCache         func(environmentID string, id string, assignment *VisitorAssignments) error
-	ActivateCampaigns func(activations []*VisitorActivation) error
+	GetCache  func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error)
+	SaveCache func(ctx context.Context, environmentID string, id string, assignment *VisitorAssignments) error
+	// CompareAndSaveCache replaces SaveCache when set. It must save the assignments only if the stored version equals
+	// the assignments version, incrementing it, and return VersionConflictError otherwise
+	CompareAndSaveCache func(ctx context.Context, environmentID string, id string, assignment *VisitorAssignments) error
+	ActivateCampaigns   func(ctx context.Context, activations []*VisitorActivation) error
+	// SendTroubleshooting receives the decision details of the visitors that are in the environment troubleshooting session
+	SendTroubleshooting func(ctx context.Context, event *TroubleshootingEvent) error
+	// AssignmentStore replaces the GetCache and SaveCache handlers when set
+	AssignmentStore AssignmentStore
+}
+
+// BatchDecisionHandlers stores the side effect callbacks of a batch decision.
+// Cache handlers load and save the assignments of all the IDs of the batch at once
+type BatchDecisionHandlers struct {
+	BatchGetCache  func(ctx context.Context, environmentID string, ids []string) (map[string]*VisitorAssignments, error)
+	BatchSaveCache func(ctx context.Context, environmentID string, assignments map[string]*VisitorAssignments) error
+	// CompareAndSaveCache replaces BatchSaveCache when set, saving the assignments of each ID with optimistic concurrency
+	CompareAndSaveCache func(ctx context.Context, environmentID string, id string, assignment *VisitorAssignments) error
+	ActivateCampaigns   func(ctx context.Context, activations []*VisitorActivation) error
+	// SendTroubleshooting receives the decision details of each visitor of the batch that is in the environment troubleshooting session
+	SendTroubleshooting func(ctx context.Context, event *TroubleshootingEvent) error
+	// AssignmentStore replaces the BatchGetCache and BatchSaveCache handlers when set
+	AssignmentStore AssignmentStore
+}
+
+// VisitorDecision stores the decision result of a visitor in a batch decision
+type VisitorDecision struct {
+	Response    *decision_response.DecisionResponse
+	Explanation *DecisionExplanation
+	Err         error
 }
 
 // Campaign stores the campaign information for decision making
@@ -89,6 +163,15 @@ type Campaign struct {
 	Type            string
 	CreatedAt       time.Time
 	BucketRanges    [][]float64
+	// Priority sets the campaign evaluation order. Campaigns are evaluated by descending priority,
+	// then by ascending creation date, then by ascending ID, whatever their order in the environment.
+	// The evaluation order decides which AB test is assigned with single assignment,
+	// and the decision response campaigns are returned in that order
+	Priority int
+	// AssignmentTTL overrides the environment assignment TTL for the campaign when greater than 0
+	AssignmentTTL time.Duration
+
+	layers []*campaignLayer
 }
 
 func (c *Campaign) HasIntegrationProviderTargeting() bool {
@@ -123,3 +206,28 @@ func (va *VisitorAssignments) getAssignment(vgID string) (*VisitorCache, bool) {
 	existing, ok := va.Assignments[vgID]
 	return existing, ok
 }
+
+// clone returns a deep copy of the assignments
+func (va *VisitorAssignments) clone() *VisitorAssignments {
+	if va == nil {
+		return nil
+	}
+
+	cloned := &VisitorAssignments{
+		Timestamp: va.Timestamp,
+		Version:   va.Version,
+		TTL:       va.TTL,
+		History:   cloneHistory(va.History),
+	}
+	if va.Assignments != nil {
+		cloned.Assignments = make(map[string]*VisitorCache, len(va.Assignments))
+		for vgID, a := range va.Assignments {
+			if a != nil {
+				copied := *a
+				a = &copied
+			}
+			cloned.Assignments[vgID] = a
+		}
+	}
+	return cloned
+}
@@ -86,3 +86,20 @@ func TestGetAssignment(t *testing.T) {
 	assert.True(t, ok)
 	assert.Equal(t, assignment, r)
 }
+
+func TestCloneAssignments(t *testing.T) {
+	var va *VisitorAssignments
+	assert.Nil(t, va.clone())
+
+	va = &VisitorAssignments{Timestamp: 1}
+	assert.Equal(t, va, va.clone())
+
+	va.Assignments = map[string]*VisitorCache{
+		"vg1": {VariationID: "v1", Activated: true},
+		"vg2": nil,
+	}
+	cloned := va.clone()
+	assert.Equal(t, va, cloned)
+	cloned.Assignments["vg1"].VariationID = "v2"
+	assert.Equal(t, "v1", va.Assignments["vg1"].VariationID)
+}
@@ -0,0 +1,45 @@
+package decision
+
+// PruneAssignments returns a copy of the assignments without the ones of variation groups
+// that are not in the environment campaigns anymore, for instance because their campaign has been deleted
+func PruneAssignments(environmentInfos Environment, assignments *VisitorAssignments) *VisitorAssignments {
+	if assignments == nil {
+		return nil
+	}
+
+	vgIDs := getVariationGroupIDs(environmentInfos.Campaigns)
+	pruned := assignments.clone()
+	for vgID := range pruned.Assignments {
+		if !vgIDs[vgID] {
+			logger.Logf(DebugLevel, "pruning assignment of deleted variation group %s", vgID)
+			delete(pruned.Assignments, vgID)
+		}
+	}
+	for vgID := range pruned.History {
+		if !vgIDs[vgID] {
+			delete(pruned.History, vgID)
+		}
+	}
+	return pruned
+}
+
+// getVariationGroupIDs returns the IDs of the variation groups of the campaigns
+func getVariationGroupIDs(campaigns []*Campaign) map[string]bool {
+	vgIDs := map[string]bool{}
+	for _, c := range campaigns {
+		if c == nil {
+			continue
+		}
+		for _, vg := range c.VariationGroups {
+			if vg != nil {
+				vgIDs[vg.ID] = true
+			}
+		}
+	}
+	return vgIDs
+}
+
+// isPrunedVariationGroup returns true if the assignment of the variation group should be pruned on save
+func (env *Environment) isPrunedVariationGroup(vgID string) bool {
+	return env.PruneDeletedAssignments && env.variationGroupIDs != nil && !env.variationGroupIDs[vgID]
+}
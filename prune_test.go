@@ -0,0 +1,62 @@
+package decision
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPruneAssignments(t *testing.T) {
+	assignments := &VisitorAssignments{
+		Timestamp: 1,
+		Version:   2,
+		Assignments: map[string]*VisitorCache{
+			"vg1":        {VariationID: "v1"},
+			"vg_deleted": {VariationID: "v1"},
+		},
+	}
+
+	pruned := PruneAssignments(createBatchEnvironment(), assignments)
+	assert.Len(t, pruned.Assignments, 1)
+	assert.Contains(t, pruned.Assignments, "vg1")
+	assert.Equal(t, int64(1), pruned.Timestamp)
+	assert.Equal(t, int64(2), pruned.Version)
+
+	// The given assignments should not be modified
+	assert.Len(t, assignments.Assignments, 2)
+
+	assert.Len(t, PruneAssignments(Environment{}, assignments).Assignments, 0)
+	assert.Nil(t, PruneAssignments(createBatchEnvironment(), nil))
+}
+
+func TestDecisionPruneAssignments(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryAssignmentStore(0)
+	existing := &VisitorAssignments{
+		Assignments: map[string]*VisitorCache{"vg_deleted": {VariationID: "v1", Activated: true}},
+	}
+
+	// Assignments are kept by default, as the environment may not contain all its campaigns
+	env := createBatchEnvironment()
+	assert.Nil(t, store.Save(ctx, "env_id", "vis1", existing))
+	_, err := GetDecision(createBatchVisitor("vis1", true), env, DecisionOptions{}, DecisionHandlers{AssignmentStore: store})
+	assert.Nil(t, err)
+	a, _ := store.Get(ctx, "env_id", "vis1")
+	assert.Len(t, a.Assignments, 2)
+
+	env.PruneDeletedAssignments = true
+	assert.Nil(t, store.Save(ctx, "env_id", "vis2", existing))
+	_, err = GetDecision(createBatchVisitor("vis2", true), env, DecisionOptions{}, DecisionHandlers{AssignmentStore: store})
+	assert.Nil(t, err)
+	a, _ = store.Get(ctx, "env_id", "vis2")
+	assert.Len(t, a.Assignments, 1)
+	assert.Contains(t, a.Assignments, "vg1")
+
+	assert.Nil(t, store.Save(ctx, "env_id", "vis3", existing))
+	_, err = GetDecisions([]Visitor{createBatchVisitor("vis3", true)}, env, DecisionOptions{}, BatchDecisionHandlers{AssignmentStore: store})
+	assert.Nil(t, err)
+	a, _ = store.Get(ctx, "env_id", "vis3")
+	assert.Len(t, a.Assignments, 1)
+	assert.Contains(t, a.Assignments, "vg1")
+}
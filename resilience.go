@@ -0,0 +1,381 @@
+package decision
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// CircuitOpenError is returned without calling the handler when its circuit breaker is open
+var CircuitOpenError = errors.New("circuit breaker open")
+
+// CircuitState is the state of a circuit breaker
+type CircuitState int
+
+const (
+	// CircuitClosed lets all the calls through
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects all the calls with CircuitOpenError
+	CircuitOpen
+	// CircuitHalfOpen lets a limited number of probe calls through, closing the circuit if they succeed
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+const (
+	defaultRetryBackoff    = 50 * time.Millisecond
+	defaultMaxRetryBackoff = time.Second
+	defaultOpenDuration    = 10 * time.Second
+	defaultHalfOpenProbes  = 1
+)
+
+// ResiliencePolicy configures the timeout, retries and circuit breaker of a handler
+type ResiliencePolicy struct {
+	// Timeout bounds each call of the handler. 0 means no timeout
+	Timeout time.Duration
+	// MaxRetries is the maximum number of retries of a failed call. 0 means no retry
+	MaxRetries int
+	// RetryBackoff is the maximum delay before the first retry, doubled for each retry. Delays are jittered. Defaults to 50ms
+	RetryBackoff time.Duration
+	// MaxRetryBackoff caps the retry delay. Defaults to 1s
+	MaxRetryBackoff time.Duration
+	// FailureThreshold is the number of consecutive failed calls opening the circuit. 0 disables the circuit breaker
+	FailureThreshold int
+	// OpenDuration is the time the circuit stays open before letting probe calls through. Defaults to 10s
+	OpenDuration time.Duration
+	// HalfOpenProbes is the maximum number of concurrent probe calls when the circuit is half-open. Defaults to 1
+	HalfOpenProbes int
+}
+
+// ResilienceOptions configures the resilience policy of each kind of handler
+type ResilienceOptions struct {
+	// Cache applies to the GetCache, SaveCache and CompareAndSaveCache handlers, that share the same circuit breaker
+	Cache ResiliencePolicy
+	// Activation applies to the ActivateCampaigns handler
+	Activation ResiliencePolicy
+	// Troubleshooting applies to the SendTroubleshooting handler
+	Troubleshooting ResiliencePolicy
+	// OnStateChange is called when the circuit breaker of a kind of handler, "cache", "activation" or "troubleshooting", changes state
+	OnStateChange func(handler string, from CircuitState, to CircuitState)
+}
+
+// ResilientHandlers wraps the decision handlers with timeouts, jittered retries and circuit breakers.
+// When the cache circuit is open, the cache handlers fail with CircuitOpenError without calling the store,
+// and the decision applies the cache failure policy of the environment
+type ResilientHandlers struct {
+	handlers DecisionHandlers
+
+	cache           *resilientCaller
+	activation      *resilientCaller
+	troubleshooting *resilientCaller
+}
+
+// NewResilientHandlers creates resilient handlers wrapping the handlers, or their AssignmentStore
+func NewResilientHandlers(handlers DecisionHandlers, options ResilienceOptions) *ResilientHandlers {
+	return &ResilientHandlers{
+		handlers:        handlers.withAssignmentStore(),
+		cache:           newResilientCaller("cache", options.Cache, options.OnStateChange),
+		activation:      newResilientCaller("activation", options.Activation, options.OnStateChange),
+		troubleshooting: newResilientCaller("troubleshooting", options.Troubleshooting, options.OnStateChange),
+	}
+}
+
+// Handlers returns the wrapped decision handlers. Handlers that are not set are left nil
+func (r *ResilientHandlers) Handlers() DecisionHandlers {
+	handlers := DecisionHandlers{}
+	if r.handlers.GetCache != nil {
+		handlers.GetCache = r.GetCache
+	}
+	if r.handlers.SaveCache != nil {
+		handlers.SaveCache = r.SaveCache
+	}
+	if r.handlers.CompareAndSaveCache != nil {
+		handlers.CompareAndSaveCache = r.CompareAndSaveCache
+	}
+	if r.handlers.ActivateCampaigns != nil {
+		handlers.ActivateCampaigns = r.ActivateCampaigns
+	}
+	if r.handlers.SendTroubleshooting != nil {
+		handlers.SendTroubleshooting = r.SendTroubleshooting
+	}
+	return handlers
+}
+
+// CacheState returns the state of the circuit breaker of the cache handlers
+func (r *ResilientHandlers) CacheState() CircuitState {
+	return r.cache.breaker.State()
+}
+
+// ActivationState returns the state of the circuit breaker of the ActivateCampaigns handler
+func (r *ResilientHandlers) ActivationState() CircuitState {
+	return r.activation.breaker.State()
+}
+
+// TroubleshootingState returns the state of the circuit breaker of the SendTroubleshooting handler
+func (r *ResilientHandlers) TroubleshootingState() CircuitState {
+	return r.troubleshooting.breaker.State()
+}
+
+// GetCache calls the GetCache handler with the cache policy
+func (r *ResilientHandlers) GetCache(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+	var assignments *VisitorAssignments
+	err := r.cache.call(ctx, func(ctx context.Context) error {
+		var err error
+		assignments, err = r.handlers.GetCache(ctx, environmentID, id)
+		return err
+	})
+	return assignments, err
+}
+
+// SaveCache calls the SaveCache handler with the cache policy
+func (r *ResilientHandlers) SaveCache(ctx context.Context, environmentID string, id string, assignments *VisitorAssignments) error {
+	return r.cache.call(ctx, func(ctx context.Context) error {
+		return r.handlers.SaveCache(ctx, environmentID, id, assignments)
+	})
+}
+
+// CompareAndSaveCache calls the CompareAndSaveCache handler with the cache policy.
+// Version conflicts are returned without retrying, the decision reloading the assignments before saving again
+func (r *ResilientHandlers) CompareAndSaveCache(ctx context.Context, environmentID string, id string, assignments *VisitorAssignments) error {
+	return r.cache.call(ctx, func(ctx context.Context) error {
+		return r.handlers.CompareAndSaveCache(ctx, environmentID, id, assignments)
+	})
+}
+
+// ActivateCampaigns calls the ActivateCampaigns handler with the activation policy
+func (r *ResilientHandlers) ActivateCampaigns(ctx context.Context, activations []*VisitorActivation) error {
+	return r.activation.call(ctx, func(ctx context.Context) error {
+		return r.handlers.ActivateCampaigns(ctx, activations)
+	})
+}
+
+// SendTroubleshooting calls the SendTroubleshooting handler with the troubleshooting policy
+func (r *ResilientHandlers) SendTroubleshooting(ctx context.Context, event *TroubleshootingEvent) error {
+	return r.troubleshooting.call(ctx, func(ctx context.Context) error {
+		return r.handlers.SendTroubleshooting(ctx, event)
+	})
+}
+
+// resilientCaller calls a kind of handler with its resilience policy
+type resilientCaller struct {
+	name    string
+	policy  ResiliencePolicy
+	breaker *circuitBreaker
+}
+
+func newResilientCaller(name string, policy ResiliencePolicy, onStateChange func(handler string, from CircuitState, to CircuitState)) *resilientCaller {
+	if policy.RetryBackoff <= 0 {
+		policy.RetryBackoff = defaultRetryBackoff
+	}
+	if policy.MaxRetryBackoff <= 0 {
+		policy.MaxRetryBackoff = defaultMaxRetryBackoff
+	}
+	if policy.OpenDuration <= 0 {
+		policy.OpenDuration = defaultOpenDuration
+	}
+	if policy.HalfOpenProbes <= 0 {
+		policy.HalfOpenProbes = defaultHalfOpenProbes
+	}
+
+	c := &resilientCaller{
+		name:   name,
+		policy: policy,
+	}
+	c.breaker = &circuitBreaker{
+		failureThreshold: policy.FailureThreshold,
+		openDuration:     policy.OpenDuration,
+		halfOpenProbes:   policy.HalfOpenProbes,
+		onStateChange: func(from CircuitState, to CircuitState) {
+			logger.Logf(WarnLevel, "%s circuit breaker is now %s", name, to)
+			if onStateChange != nil {
+				onStateChange(name, from, to)
+			}
+		},
+	}
+	return c
+}
+
+// call calls the handler function through the circuit breaker, with a timeout by attempt and retries with jittered exponential backoff
+func (c *resilientCaller) call(ctx context.Context, f func(ctx context.Context) error) error {
+	backoff := c.policy.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := c.attempt(ctx, f)
+		if err == nil || attempt >= c.policy.MaxRetries || !isRetryableError(ctx, err) {
+			return err
+		}
+
+		logger.Logf(WarnLevel, "retrying %s handler after error: %v", c.name, err)
+		timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff)) + 1))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		backoff *= 2
+		if backoff > c.policy.MaxRetryBackoff {
+			backoff = c.policy.MaxRetryBackoff
+		}
+	}
+}
+
+// attempt calls the handler function once, if the circuit breaker allows it
+func (c *resilientCaller) attempt(ctx context.Context, f func(ctx context.Context) error) error {
+	done, err := c.breaker.allow()
+	if err != nil {
+		return err
+	}
+
+	attemptCtx := ctx
+	if c.policy.Timeout > 0 {
+		var cancel context.CancelFunc
+		attemptCtx, cancel = context.WithTimeout(ctx, c.policy.Timeout)
+		defer cancel()
+	}
+	err = f(attemptCtx)
+	switch {
+	case err == nil || errors.Is(err, VersionConflictError):
+		// Version conflicts are expected answers of a healthy store
+		done(callSucceeded)
+	case ctx.Err() != nil:
+		// The caller gave up on the call, which tells nothing about the handler health
+		done(callIgnored)
+	default:
+		done(callFailed)
+	}
+	return err
+}
+
+// isRetryableError returns false for the errors that would be returned again by a retry,
+// and once the caller context is done, whether it is canceled or past its deadline
+func isRetryableError(ctx context.Context, err error) bool {
+	return ctx.Err() == nil &&
+		!errors.Is(err, VersionConflictError) &&
+		!errors.Is(err, CircuitOpenError) &&
+		!errors.Is(err, OperationNotSupportedError) &&
+		!errors.Is(err, StoreClosedError) &&
+		!errors.Is(err, context.Canceled)
+}
+
+// callOutcome is the result of a call reported to the circuit breaker
+type callOutcome int
+
+const (
+	callSucceeded callOutcome = iota
+	callFailed
+	// callIgnored releases the call without counting it as a success or a failure
+	callIgnored
+)
+
+// circuitBreaker opens after failureThreshold consecutive failures, rejects the calls for openDuration,
+// then lets halfOpenProbes calls through, closing if one succeeds and opening again if one fails
+type circuitBreaker struct {
+	failureThreshold int
+	openDuration     time.Duration
+	halfOpenProbes   int
+	onStateChange    func(from CircuitState, to CircuitState)
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probes   int
+}
+
+// State returns the state of the circuit breaker, an open circuit being half-open once its open duration is over
+func (b *circuitBreaker) State() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == CircuitOpen && time.Since(b.openedAt) >= b.openDuration {
+		return CircuitHalfOpen
+	}
+	return b.state
+}
+
+// allow returns CircuitOpenError if the call is rejected,
+// and otherwise the function to call with the outcome of the call
+func (b *circuitBreaker) allow() (func(outcome callOutcome), error) {
+	if b.failureThreshold <= 0 {
+		return func(callOutcome) {}, nil
+	}
+
+	b.mu.Lock()
+	var transitions []CircuitState
+	if b.state == CircuitOpen && time.Since(b.openedAt) >= b.openDuration {
+		transitions = b.setState(transitions, CircuitHalfOpen)
+	}
+	probe := b.state == CircuitHalfOpen
+	rejected := b.state == CircuitOpen || (probe && b.probes >= b.halfOpenProbes)
+	if probe && !rejected {
+		b.probes++
+	}
+	b.mu.Unlock()
+	b.notify(transitions)
+
+	if rejected {
+		return nil, CircuitOpenError
+	}
+	return func(outcome callOutcome) {
+		b.mu.Lock()
+		var transitions []CircuitState
+		if probe {
+			b.probes--
+		}
+		switch {
+		case outcome == callIgnored:
+		case outcome == callSucceeded:
+			b.failures = 0
+			if b.state == CircuitHalfOpen {
+				transitions = b.setState(transitions, CircuitClosed)
+			}
+		case b.state == CircuitHalfOpen:
+			transitions = b.open(transitions)
+		case b.state == CircuitClosed:
+			b.failures++
+			if b.failures >= b.failureThreshold {
+				transitions = b.open(transitions)
+			}
+		}
+		b.mu.Unlock()
+		b.notify(transitions)
+	}, nil
+}
+
+func (b *circuitBreaker) open(transitions []CircuitState) []CircuitState {
+	b.openedAt = time.Now()
+	b.failures = 0
+	return b.setState(transitions, CircuitOpen)
+}
+
+// setState changes the state and appends the transition, as its previous and new states, to the transitions to notify
+func (b *circuitBreaker) setState(transitions []CircuitState, state CircuitState) []CircuitState {
+	if b.state == state {
+		return transitions
+	}
+	transitions = append(transitions, b.state, state)
+	b.state = state
+	return transitions
+}
+
+// notify calls the state change hook for each transition, without holding the lock so that the hook can read the state
+func (b *circuitBreaker) notify(transitions []CircuitState) {
+	if b.onStateChange == nil {
+		return
+	}
+	for i := 0; i+1 < len(transitions); i += 2 {
+		b.onStateChange(transitions[i], transitions[i+1])
+	}
+}
@@ -0,0 +1,244 @@
+package decision
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errResilienceTest = errors.New("store unavailable")
+
+func TestResilientHandlersTimeoutAndRetries(t *testing.T) {
+	var nbCalls int32
+	handlers := NewResilientHandlers(DecisionHandlers{
+		GetCache: func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+			if atomic.AddInt32(&nbCalls, 1) < 3 {
+				// Hanging calls are bounded by the timeout
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			return &VisitorAssignments{Timestamp: 1}, nil
+		},
+		ActivateCampaigns: func(ctx context.Context, activations []*VisitorActivation) error {
+			return errResilienceTest
+		},
+	}, ResilienceOptions{
+		Cache:      ResiliencePolicy{Timeout: 5 * time.Millisecond, MaxRetries: 2, RetryBackoff: time.Millisecond},
+		Activation: ResiliencePolicy{MaxRetries: 1, RetryBackoff: time.Millisecond},
+	}).Handlers()
+
+	assignments, err := handlers.GetCache(context.Background(), "env_id", "vis1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), assignments.Timestamp)
+	assert.Equal(t, int32(3), nbCalls)
+
+	// Retries stop after MaxRetries, returning the last error
+	assert.Equal(t, errResilienceTest, handlers.ActivateCampaigns(context.Background(), nil))
+
+	// Handlers that are not set are left nil
+	assert.Nil(t, handlers.SaveCache)
+	assert.Nil(t, handlers.SendTroubleshooting)
+}
+
+func TestResilientHandlersNoRetry(t *testing.T) {
+	var nbCalls int32
+	handlers := DecisionHandlers{
+		CompareAndSaveCache: func(ctx context.Context, environmentID string, id string, assignments *VisitorAssignments) error {
+			atomic.AddInt32(&nbCalls, 1)
+			return VersionConflictError
+		},
+		SaveCache: func(ctx context.Context, environmentID string, id string, assignments *VisitorAssignments) error {
+			atomic.AddInt32(&nbCalls, 1)
+			return errResilienceTest
+		},
+	}
+
+	// Version conflicts are neither retried nor counted as failures
+	resilient := NewResilientHandlers(handlers, ResilienceOptions{
+		Cache: ResiliencePolicy{MaxRetries: 3, RetryBackoff: time.Millisecond, FailureThreshold: 1},
+	})
+	assert.Equal(t, VersionConflictError, resilient.CompareAndSaveCache(context.Background(), "env_id", "vis1", nil))
+	assert.Equal(t, int32(1), nbCalls)
+	assert.Equal(t, CircuitClosed, resilient.CacheState())
+
+	// Calls rejected by the open circuit are not retried
+	assert.Equal(t, CircuitOpenError, resilient.SaveCache(context.Background(), "env_id", "vis1", nil))
+	assert.Equal(t, int32(2), nbCalls)
+	assert.Equal(t, CircuitOpen, resilient.CacheState())
+
+	// Retries stop when the context is done
+	resilient = NewResilientHandlers(handlers, ResilienceOptions{
+		Cache: ResiliencePolicy{MaxRetries: 3, RetryBackoff: time.Hour},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.Equal(t, errResilienceTest, resilient.SaveCache(ctx, "env_id", "vis1", nil))
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestResilientHandlersCallerContext(t *testing.T) {
+	var nbCalls int32
+	resilient := NewResilientHandlers(DecisionHandlers{
+		GetCache: func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+			atomic.AddInt32(&nbCalls, 1)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}, ResilienceOptions{
+		Cache: ResiliencePolicy{Timeout: time.Hour, MaxRetries: 3, RetryBackoff: time.Millisecond, FailureThreshold: 1},
+	})
+
+	// Calls abandoned by the caller are neither retried nor counted as failures
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := resilient.GetCache(canceledCtx, "env_id", "vis1")
+	assert.Equal(t, context.Canceled, err)
+	expiredCtx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, err = resilient.GetCache(expiredCtx, "env_id", "vis1")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, int32(2), nbCalls)
+	assert.Equal(t, CircuitClosed, resilient.CacheState())
+
+	// Attempts timing out while the caller waits are failures
+	resilient = NewResilientHandlers(DecisionHandlers{GetCache: resilient.handlers.GetCache}, ResilienceOptions{
+		Cache: ResiliencePolicy{Timeout: time.Millisecond, FailureThreshold: 1},
+	})
+	_, err = resilient.GetCache(context.Background(), "env_id", "vis1")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, CircuitOpen, resilient.CacheState())
+}
+
+func TestResilientHandlersCircuitBreaker(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	var nbCalls int32
+	var mu sync.Mutex
+	transitions := []string{}
+	resilient := NewResilientHandlers(DecisionHandlers{
+		GetCache: func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+			atomic.AddInt32(&nbCalls, 1)
+			if failing.Load() {
+				return nil, errResilienceTest
+			}
+			return nil, nil
+		},
+	}, ResilienceOptions{
+		Cache: ResiliencePolicy{FailureThreshold: 2, OpenDuration: 20 * time.Millisecond},
+		OnStateChange: func(handler string, from CircuitState, to CircuitState) {
+			mu.Lock()
+			defer mu.Unlock()
+			transitions = append(transitions, handler+":"+from.String()+"->"+to.String())
+		},
+	})
+	ctx := context.Background()
+
+	_, err := resilient.GetCache(ctx, "env_id", "vis1")
+	assert.Equal(t, errResilienceTest, err)
+	assert.Equal(t, CircuitClosed, resilient.CacheState())
+	_, err = resilient.GetCache(ctx, "env_id", "vis1")
+	assert.Equal(t, errResilienceTest, err)
+	assert.Equal(t, CircuitOpen, resilient.CacheState())
+
+	// The open circuit rejects the calls without calling the handler
+	_, err = resilient.GetCache(ctx, "env_id", "vis1")
+	assert.Equal(t, CircuitOpenError, err)
+	assert.Equal(t, int32(2), nbCalls)
+
+	// A failed probe opens the circuit again
+	time.Sleep(25 * time.Millisecond)
+	assert.Equal(t, CircuitHalfOpen, resilient.CacheState())
+	_, err = resilient.GetCache(ctx, "env_id", "vis1")
+	assert.Equal(t, errResilienceTest, err)
+	assert.Equal(t, CircuitOpen, resilient.CacheState())
+
+	// A successful probe closes the circuit
+	failing.Store(false)
+	time.Sleep(25 * time.Millisecond)
+	_, err = resilient.GetCache(ctx, "env_id", "vis1")
+	assert.Nil(t, err)
+	assert.Equal(t, CircuitClosed, resilient.CacheState())
+	assert.Equal(t, CircuitClosed, resilient.ActivationState())
+	assert.Equal(t, CircuitClosed, resilient.TroubleshootingState())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{
+		"cache:closed->open",
+		"cache:open->half-open",
+		"cache:half-open->open",
+		"cache:open->half-open",
+		"cache:half-open->closed",
+	}, transitions)
+}
+
+func TestResilientHandlersHalfOpenProbes(t *testing.T) {
+	release := make(chan struct{})
+	var nbCalls int32
+	resilient := NewResilientHandlers(DecisionHandlers{
+		ActivateCampaigns: func(ctx context.Context, activations []*VisitorActivation) error {
+			if atomic.AddInt32(&nbCalls, 1) == 1 {
+				return errResilienceTest
+			}
+			<-release
+			return nil
+		},
+	}, ResilienceOptions{
+		Activation: ResiliencePolicy{FailureThreshold: 1, OpenDuration: time.Millisecond},
+	})
+	ctx := context.Background()
+
+	assert.Equal(t, errResilienceTest, resilient.ActivateCampaigns(ctx, nil))
+	time.Sleep(5 * time.Millisecond)
+
+	// Only one probe is let through while the circuit is half-open
+	done := make(chan error)
+	go func() {
+		done <- resilient.ActivateCampaigns(ctx, nil)
+	}()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&nbCalls) == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, CircuitOpenError, resilient.ActivateCampaigns(ctx, nil))
+
+	close(release)
+	assert.Nil(t, <-done)
+	assert.Nil(t, resilient.ActivateCampaigns(ctx, nil))
+	assert.Equal(t, CircuitClosed, resilient.ActivationState())
+}
+
+func TestResilientHandlersCacheFailurePolicy(t *testing.T) {
+	var nbCalls int32
+	resilient := NewResilientHandlers(DecisionHandlers{
+		GetCache: func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+			atomic.AddInt32(&nbCalls, 1)
+			return nil, errResilienceTest
+		},
+		SaveCache: func(ctx context.Context, environmentID string, id string, assignments *VisitorAssignments) error {
+			return nil
+		},
+	}, ResilienceOptions{
+		Cache: ResiliencePolicy{FailureThreshold: 1, OpenDuration: time.Hour},
+	})
+
+	// Once the circuit is open, decisions apply the cache failure policy without calling the store
+	env := createBatchEnvironment()
+	env.CacheFailurePolicy = CacheFailureOpen
+	for i := 0; i < 3; i++ {
+		decision, err := GetDecision(createBatchVisitor("vis1", true), env, DecisionOptions{}, resilient.Handlers())
+		assert.Nil(t, err)
+		assert.Len(t, decision.Campaigns, 1)
+	}
+	assert.Equal(t, int32(1), nbCalls)
+	assert.Equal(t, CircuitOpen, resilient.CacheState())
+
+	policy := CacheFailureClosed
+	_, err := GetDecision(createBatchVisitor("vis1", true), env, DecisionOptions{CacheFailurePolicy: &policy}, resilient.Handlers())
+	assert.ErrorIs(t, err, CircuitOpenError)
+}
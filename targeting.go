@@ -11,14 +11,51 @@ import (
 	"google.golang.org/protobuf/types/known/structpb"
 )
 
+// compiledTargeting is a preprocessed targeting, extracted once from the protobuf targeting
+type compiledTargeting struct {
+	groups [][]compiledInnerTargeting
+}
+
+type compiledInnerTargeting struct {
+	key      string
+	provider string
+	operator protoTargeting.Targeting_TargetingOperator
+	value    *structpb.Value
+}
+
+// compileTargeting extracts the targeting groups of a protobuf targeting
+func compileTargeting(targetings *protoTargeting.Targeting) *compiledTargeting {
+	compiled := &compiledTargeting{
+		groups: make([][]compiledInnerTargeting, 0, len(targetings.GetTargetingGroups())),
+	}
+	for _, targetingGroup := range targetings.GetTargetingGroups() {
+		group := make([]compiledInnerTargeting, 0, len(targetingGroup.GetTargetings()))
+		for _, t := range targetingGroup.GetTargetings() {
+			group = append(group, compiledInnerTargeting{
+				key:      t.GetKey().GetValue(),
+				provider: t.GetProvider().GetValue(),
+				operator: t.GetOperator(),
+				value:    t.GetValue(),
+			})
+		}
+		compiled.groups = append(compiled.groups, group)
+	}
+	return compiled
+}
+
 // targetingMatch returns true if a visitor ID and context match the variationGroup targeting
 func targetingMatch(targetings *protoTargeting.Targeting, visitorID string, context *targeting.Context) (bool, error) {
+	return compileTargeting(targetings).match(visitorID, context)
+}
+
+// match returns true if a visitor ID and context match the compiled targeting
+func (ct *compiledTargeting) match(visitorID string, context *targeting.Context) (bool, error) {
 	globalMatch := false
-	for _, targetingGroup := range targetings.GetTargetingGroups() {
-		matchGroup := len(targetingGroup.GetTargetings()) > 0
-		for _, t := range targetingGroup.GetTargetings() {
-			v, ok := context.GetValueByProvider(t.GetKey().GetValue(), t.GetProvider().GetValue())
-			switch t.GetKey().GetValue() {
+	for _, targetingGroup := range ct.groups {
+		matchGroup := len(targetingGroup) > 0
+		for _, t := range targetingGroup {
+			v, ok := context.GetValueByProvider(t.key, t.provider)
+			switch t.key {
 			case "fs_all_users":
 				// All users targeting will
 				continue
@@ -27,8 +64,8 @@ func targetingMatch(targetings *protoTargeting.Targeting, visitorID string, cont
 				ok = true
 			}
 
-			if ok || isEmptyContextOperator(t.GetOperator()) {
-				matchTargeting, err := targetingMatchOperator(t.GetOperator(), t.GetValue(), v)
+			if ok || isEmptyContextOperator(t.operator) {
+				matchTargeting, err := targetingMatchOperator(t.operator, t.value, v)
 				if err != nil {
 					return false, err
 				}
@@ -0,0 +1,335 @@
+package decision
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// InvalidRecordError is returned when an imported assignments record is invalid
+var InvalidRecordError = errors.New("invalid assignments record")
+
+const (
+	defaultTransferProgressInterval = 1000
+	// maxRecordSize is the maximum size of an imported NDJSON line
+	maxRecordSize = 16 * 1024 * 1024
+)
+
+// TransferOptions configures the assignments export and import
+type TransferOptions struct {
+	// OnProgress is called every ProgressInterval records and once the transfer is done
+	OnProgress func(progress TransferProgress)
+	// ProgressInterval is the number of records between progress reports. Defaults to 1000
+	ProgressInterval int
+	// SkipInvalid skips the invalid imported records instead of stopping the import
+	SkipInvalid bool
+	// Overwrite replaces the stored assignments of the imported IDs instead of merging the imported assignments into them
+	Overwrite bool
+	// AssignmentTTLPolicy computes the TTL of the imported assignments merged into the stored ones.
+	// If nil, the TTL is extended to the latest expiry of the imported and stored assignments
+	AssignmentTTLPolicy *AssignmentTTLPolicy
+}
+
+// TransferProgress counts the records processed by an export or an import
+type TransferProgress struct {
+	// Processed is the number of IDs exported or lines imported
+	Processed int
+	// Transferred is the number of records written or saved
+	Transferred int
+	// Skipped is the number of exported IDs without assignments or of invalid imported records
+	Skipped int
+}
+
+// assignmentsRecord is the NDJSON record of the assignments of an ID
+type assignmentsRecord struct {
+	EnvironmentID string                       `json:"environment_id"`
+	VisitorID     string                       `json:"visitor_id"`
+	Timestamp     int64                        `json:"timestamp"`
+	TTL           int64                        `json:"ttl_ms,omitempty"`
+	Assignments   map[string]*assignmentRecord `json:"assignments"`
+	History       map[string][]*historyRecord  `json:"history,omitempty"`
+}
+
+type assignmentRecord struct {
+	VariationID string `json:"variation_id"`
+	Activated   bool   `json:"activated,omitempty"`
+	AssignedAt  int64  `json:"assigned_at,omitempty"`
+}
+
+type historyRecord struct {
+	VariationID string `json:"variation_id"`
+	FirstSeen   int64  `json:"first_seen"`
+	LastSeen    int64  `json:"last_seen"`
+}
+
+// ExportAssignments writes the assignments of the IDs of the environment as newline-delimited JSON records,
+// reading them with the GetCache handler or the AssignmentStore. IDs without assignments are skipped.
+// If the IDs are nil, all the IDs of the environment are exported if the AssignmentStore is a ScanStore
+func ExportAssignments(ctx context.Context, w io.Writer, handlers DecisionHandlers, environmentID string, ids []string, options TransferOptions) (TransferProgress, error) {
+	handlers = handlers.withAssignmentStore()
+	progress := TransferProgress{}
+	if handlers.GetCache == nil {
+		return progress, OperationNotSupportedError
+	}
+	ids, err := handlers.storeIDs(ctx, environmentID, ids)
+	if err != nil {
+		return progress, err
+	}
+
+	reporter := newProgressReporter(options)
+	defer func() { reporter.done(progress) }()
+
+	encoder := json.NewEncoder(w)
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return progress, err
+		}
+
+		assignments, err := handlers.GetCache(ctx, environmentID, id)
+		if err != nil {
+			return progress, fmt.Errorf("error when getting assignments of %s: %w", id, err)
+		}
+		progress.Processed++
+		if assignments == nil {
+			progress.Skipped++
+			reporter.report(progress)
+			continue
+		}
+
+		record := assignmentsRecord{
+			EnvironmentID: environmentID,
+			VisitorID:     id,
+			Timestamp:     assignments.Timestamp,
+			TTL:           assignments.TTL.Milliseconds(),
+			Assignments:   make(map[string]*assignmentRecord, len(assignments.Assignments)),
+		}
+		for vgID, a := range assignments.Assignments {
+			if a != nil {
+				record.Assignments[vgID] = &assignmentRecord{VariationID: a.VariationID, Activated: a.Activated, AssignedAt: a.AssignedAt}
+			}
+		}
+		for vgID, entries := range assignments.History {
+			if record.History == nil {
+				record.History = make(map[string][]*historyRecord, len(assignments.History))
+			}
+			for _, e := range entries {
+				record.History[vgID] = append(record.History[vgID], &historyRecord{VariationID: e.VariationID, FirstSeen: e.FirstSeen, LastSeen: e.LastSeen})
+			}
+		}
+		if err := encoder.Encode(record); err != nil {
+			return progress, err
+		}
+		progress.Transferred++
+		reporter.report(progress)
+	}
+	return progress, nil
+}
+
+// ImportAssignments reads newline-delimited JSON assignments records and saves them with the SaveCache handler or the AssignmentStore.
+// Imported assignments are merged into the stored ones, unless Overwrite is set.
+// Invalid records stop the import with an InvalidRecordError giving their line, unless SkipInvalid is set
+func ImportAssignments(ctx context.Context, r io.Reader, handlers DecisionHandlers, options TransferOptions) (TransferProgress, error) {
+	handlers = handlers.withAssignmentStore()
+	progress := TransferProgress{}
+	if handlers.SaveCache == nil || (!options.Overwrite && handlers.GetCache == nil) {
+		return progress, OperationNotSupportedError
+	}
+
+	reporter := newProgressReporter(options)
+	defer func() { reporter.done(progress) }()
+
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		if err := ctx.Err(); err != nil {
+			return progress, err
+		}
+
+		data, err := readRecordLine(reader)
+		if err == io.EOF {
+			return progress, nil
+		}
+		if err != nil {
+			return progress, fmt.Errorf("line %d: %w", line, err)
+		}
+		if len(bytes.TrimSpace(data)) == 0 {
+			continue
+		}
+		progress.Processed++
+
+		record, err := decodeAssignmentsRecord(data)
+		if err != nil {
+			if options.SkipInvalid {
+				logger.Logf(WarnLevel, "skipping invalid assignments record at line %d: %v", line, err)
+				progress.Skipped++
+				reporter.report(progress)
+				continue
+			}
+			return progress, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if err := importRecord(ctx, handlers, record, options); err != nil {
+			return progress, fmt.Errorf("line %d: error when saving assignments of %s: %w", line, record.VisitorID, err)
+		}
+		progress.Transferred++
+		reporter.report(progress)
+	}
+}
+
+// readRecordLine reads a line, without its line ending, failing if it is larger than maxRecordSize
+func readRecordLine(reader *bufio.Reader) ([]byte, error) {
+	var data []byte
+	for {
+		chunk, isPrefix, err := reader.ReadLine()
+		if err != nil {
+			if err == io.EOF && len(data) > 0 {
+				return data, nil
+			}
+			return nil, err
+		}
+		data = append(data, chunk...)
+		if len(data) > maxRecordSize {
+			return nil, fmt.Errorf("%w: record larger than %d bytes", InvalidRecordError, maxRecordSize)
+		}
+		if !isPrefix {
+			return data, nil
+		}
+	}
+}
+
+// decodeAssignmentsRecord decodes and validates an assignments record
+func decodeAssignmentsRecord(data []byte) (*assignmentsRecord, error) {
+	record := &assignmentsRecord{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(record); err != nil {
+		return nil, fmt.Errorf("%w: %v", InvalidRecordError, err)
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("%w: several values on the same line", InvalidRecordError)
+	}
+
+	switch {
+	case record.EnvironmentID == "":
+		return nil, fmt.Errorf("%w: missing environment_id", InvalidRecordError)
+	case record.VisitorID == "":
+		return nil, fmt.Errorf("%w: missing visitor_id", InvalidRecordError)
+	case record.Timestamp < 0:
+		return nil, fmt.Errorf("%w: negative timestamp", InvalidRecordError)
+	case record.TTL < 0:
+		return nil, fmt.Errorf("%w: negative ttl_ms", InvalidRecordError)
+	case record.Assignments == nil:
+		return nil, fmt.Errorf("%w: missing assignments", InvalidRecordError)
+	}
+	for vgID, a := range record.Assignments {
+		if vgID == "" {
+			return nil, fmt.Errorf("%w: empty variation group ID", InvalidRecordError)
+		}
+		if a == nil || a.VariationID == "" {
+			return nil, fmt.Errorf("%w: missing variation_id for variation group %s", InvalidRecordError, vgID)
+		}
+		if a.AssignedAt < 0 {
+			return nil, fmt.Errorf("%w: negative assigned_at for variation group %s", InvalidRecordError, vgID)
+		}
+	}
+	for vgID, entries := range record.History {
+		if vgID == "" {
+			return nil, fmt.Errorf("%w: empty history variation group ID", InvalidRecordError)
+		}
+		for _, e := range entries {
+			if e == nil || e.VariationID == "" {
+				return nil, fmt.Errorf("%w: missing history variation_id for variation group %s", InvalidRecordError, vgID)
+			}
+			if e.FirstSeen < 0 || e.LastSeen < e.FirstSeen {
+				return nil, fmt.Errorf("%w: invalid history timestamps for variation group %s", InvalidRecordError, vgID)
+			}
+		}
+	}
+	return record, nil
+}
+
+// importRecord saves the assignments of the record, merged into the stored ones unless overwrite is set.
+// Merged assignments keep the newest timestamp, and each assignment keeps its own assigned-at timestamp,
+// so that importing older assignments neither expires nor extends the stored ones
+func importRecord(ctx context.Context, handlers DecisionHandlers, record *assignmentsRecord, options TransferOptions) error {
+	assignments := &VisitorAssignments{
+		Timestamp:   record.Timestamp,
+		TTL:         time.Duration(record.TTL) * time.Millisecond,
+		Assignments: make(map[string]*VisitorCache, len(record.Assignments)),
+	}
+	for vgID, a := range record.Assignments {
+		assignments.Assignments[vgID] = &VisitorCache{VariationID: a.VariationID, Activated: a.Activated, AssignedAt: a.AssignedAt}
+	}
+	for vgID, entries := range record.History {
+		if assignments.History == nil {
+			assignments.History = map[string][]AssignmentHistoryEntry{}
+		}
+		for _, e := range entries {
+			assignments.History[vgID] = append(assignments.History[vgID], AssignmentHistoryEntry{VariationID: e.VariationID, FirstSeen: e.FirstSeen, LastSeen: e.LastSeen})
+		}
+	}
+	if options.Overwrite {
+		return handlers.SaveCache(ctx, record.EnvironmentID, record.VisitorID, assignments)
+	}
+
+	existing, err := handlers.GetCache(ctx, record.EnvironmentID, record.VisitorID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		assignments = mergeQueuedAssignments(withRecordAssignedAt(existing), withRecordAssignedAt(assignments))
+		if options.AssignmentTTLPolicy != nil {
+			assignments.TTL = options.AssignmentTTLPolicy.AssignmentsTTL(assignments.Assignments, time.Unix(assignments.Timestamp, 0))
+		}
+	}
+	return handlers.SaveCache(ctx, record.EnvironmentID, record.VisitorID, assignments)
+}
+
+// withRecordAssignedAt returns a copy of the assignments where the assignments without assigned-at timestamp
+// are assigned at the assignments timestamp
+func withRecordAssignedAt(assignments *VisitorAssignments) *VisitorAssignments {
+	filled := assignments.clone()
+	for vgID, a := range filled.Assignments {
+		if a != nil && a.AssignedAt <= 0 && filled.Timestamp > 0 {
+			copied := *a
+			copied.AssignedAt = filled.Timestamp
+			filled.Assignments[vgID] = &copied
+		}
+	}
+	return filled
+}
+
+// progressReporter calls the progress callback every progress interval
+type progressReporter struct {
+	onProgress func(progress TransferProgress)
+	interval   int
+	last       int
+}
+
+func newProgressReporter(options TransferOptions) *progressReporter {
+	interval := options.ProgressInterval
+	if interval <= 0 {
+		interval = defaultTransferProgressInterval
+	}
+	return &progressReporter{
+		onProgress: options.OnProgress,
+		interval:   interval,
+	}
+}
+
+func (r *progressReporter) report(progress TransferProgress) {
+	if r.onProgress != nil && progress.Processed-r.last >= r.interval {
+		r.last = progress.Processed
+		r.onProgress(progress)
+	}
+}
+
+func (r *progressReporter) done(progress TransferProgress) {
+	if r.onProgress != nil {
+		r.onProgress(progress)
+	}
+}
@@ -0,0 +1,220 @@
+package decision
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportAssignments(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Unix()
+	store := NewMemoryAssignmentStore(0)
+	assert.Nil(t, store.Save(ctx, "env", "vis1", &VisitorAssignments{
+		Timestamp:   now,
+		TTL:         time.Hour,
+		Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1", Activated: true, AssignedAt: now - 60}, "vg2": {VariationID: "v2"}},
+	}))
+	assert.Nil(t, store.Save(ctx, "env", "vis2", &VisitorAssignments{Assignments: map[string]*VisitorCache{}}))
+
+	progresses := []TransferProgress{}
+	var buf bytes.Buffer
+	progress, err := ExportAssignments(ctx, &buf, DecisionHandlers{AssignmentStore: store}, "env", []string{"vis1", "unknown", "vis2"}, TransferOptions{
+		ProgressInterval: 2,
+		OnProgress: func(progress TransferProgress) {
+			progresses = append(progresses, progress)
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, TransferProgress{Processed: 3, Transferred: 2, Skipped: 1}, progress)
+	assert.Equal(t, []TransferProgress{{Processed: 2, Transferred: 1, Skipped: 1}, progress}, progresses)
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	assert.Len(t, lines, 2)
+	assert.JSONEq(t, fmt.Sprintf(`{"environment_id":"env","visitor_id":"vis1","timestamp":%d,"ttl_ms":3600000,"assignments":{"vg1":{"variation_id":"v1","activated":true,"assigned_at":%d},"vg2":{"variation_id":"v2"}}}`, now, now-60), lines[0])
+	assert.JSONEq(t, `{"environment_id":"env","visitor_id":"vis2","timestamp":0,"assignments":{}}`, lines[1])
+
+	// Errors stop the export
+	_, err = ExportAssignments(ctx, &buf, DecisionHandlers{
+		GetCache: func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+			return nil, errCacheTest
+		},
+	}, "env", []string{"vis1"}, TransferOptions{})
+	assert.ErrorIs(t, err, errCacheTest)
+
+	_, err = ExportAssignments(ctx, &buf, DecisionHandlers{}, "env", []string{"vis1"}, TransferOptions{})
+	assert.Equal(t, OperationNotSupportedError, err)
+
+	// Without IDs, all the IDs of the store are exported
+	buf.Reset()
+	progress, err = ExportAssignments(ctx, &buf, DecisionHandlers{AssignmentStore: store}, "env", nil, TransferOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, TransferProgress{Processed: 2, Transferred: 2}, progress)
+	assert.Contains(t, buf.String(), `"visitor_id":"vis1"`)
+	assert.Contains(t, buf.String(), `"visitor_id":"vis2"`)
+
+	// Stores that cannot list their IDs need the IDs to export
+	_, err = ExportAssignments(ctx, &buf, DecisionHandlers{GetCache: store.Get}, "env", nil, TransferOptions{})
+	assert.Equal(t, OperationNotSupportedError, err)
+}
+
+func TestImportAssignments(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryAssignmentStore(0)
+	assert.Nil(t, store.Save(ctx, "env", "vis1", &VisitorAssignments{Assignments: map[string]*VisitorCache{"vg0": {VariationID: "v0"}, "vg1": {VariationID: "v0"}}}))
+
+	now := time.Now().Unix()
+	input := fmt.Sprintf(`{"environment_id":"env","visitor_id":"vis1","timestamp":%d,"ttl_ms":3600000,"assignments":{"vg1":{"variation_id":"v1","activated":true,"assigned_at":1}}}
+
+{"environment_id":"env2","visitor_id":"vis2","timestamp":1,"assignments":{"vg2":{"variation_id":"v2"}}}`, now)
+	progress, err := ImportAssignments(ctx, strings.NewReader(input), DecisionHandlers{AssignmentStore: store}, TransferOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, TransferProgress{Processed: 2, Transferred: 2}, progress)
+
+	// Imported assignments are merged into the stored ones, which never expire
+	a, _ := store.Get(ctx, "env", "vis1")
+	assert.Equal(t, now, a.Timestamp)
+	assert.Equal(t, time.Duration(0), a.TTL)
+	assert.Equal(t, map[string]*VisitorCache{"vg0": {VariationID: "v0"}, "vg1": {VariationID: "v1", Activated: true, AssignedAt: 1}}, a.Assignments)
+	a, _ = store.Get(ctx, "env2", "vis2")
+	assert.Equal(t, "v2", a.Assignments["vg2"].VariationID)
+
+	_, err = ImportAssignments(ctx, strings.NewReader(input), DecisionHandlers{AssignmentStore: store}, TransferOptions{Overwrite: true})
+	assert.Nil(t, err)
+	a, _ = store.Get(ctx, "env", "vis1")
+	assert.Len(t, a.Assignments, 1)
+
+	_, err = ImportAssignments(ctx, strings.NewReader(input), DecisionHandlers{}, TransferOptions{})
+	assert.Equal(t, OperationNotSupportedError, err)
+}
+
+func TestImportOlderAssignments(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryAssignmentStore(0)
+	now := time.Now().Unix()
+	assert.Nil(t, store.Save(ctx, "env_id", "vis1", &VisitorAssignments{
+		Timestamp:   now,
+		TTL:         24 * time.Hour,
+		Assignments: map[string]*VisitorCache{"vg_default": {VariationID: "v1"}},
+	}))
+
+	// Importing older assignments into live ones keeps the live timestamp and TTL
+	input := `{"environment_id":"env_id","visitor_id":"vis1","timestamp":1600000000,"ttl_ms":2592000000,"assignments":{"vg_ttl":{"variation_id":"v2"}}}`
+	_, err := ImportAssignments(ctx, strings.NewReader(input), DecisionHandlers{AssignmentStore: store}, TransferOptions{})
+	assert.Nil(t, err)
+	a, _ := store.Get(ctx, "env_id", "vis1")
+	assert.NotNil(t, a)
+	assert.Equal(t, now, a.Timestamp)
+	assert.Equal(t, 24*time.Hour, a.TTL)
+	assert.Equal(t, now, a.Assignments["vg_default"].AssignedAt)
+	assert.Equal(t, int64(1600000000), a.Assignments["vg_ttl"].AssignedAt)
+
+	// The TTL policy computes the TTL from the assigned-at timestamp of each assignment
+	policy := compileEnvironment(createTTLEnvironment()).AssignmentTTLPolicy()
+	input = fmt.Sprintf(`{"environment_id":"env_id","visitor_id":"vis1","timestamp":%d,"assignments":{"vg_ttl":{"variation_id":"v1"}}}`, now-60)
+	_, err = ImportAssignments(ctx, strings.NewReader(input), DecisionHandlers{AssignmentStore: store}, TransferOptions{AssignmentTTLPolicy: policy})
+	assert.Nil(t, err)
+	a, _ = store.Get(ctx, "env_id", "vis1")
+	assert.Equal(t, now, a.Timestamp)
+	assert.Equal(t, 24*time.Hour, a.TTL)
+	assert.Equal(t, now-60, a.Assignments["vg_ttl"].AssignedAt)
+	assert.False(t, policy.IsExpired(a, "vg_ttl", time.Now()))
+}
+
+func TestImportAssignmentsValidation(t *testing.T) {
+	ctx := context.Background()
+	invalidRecords := map[string]string{
+		"invalid json":       `{"environment_id":`,
+		"unknown field":      `{"environment_id":"env","visitor_id":"vis1","assignments":{},"unknown":1}`,
+		"several values":     `{"environment_id":"env","visitor_id":"vis1","assignments":{}} {}`,
+		"missing env":        `{"visitor_id":"vis1","assignments":{}}`,
+		"missing visitor":    `{"environment_id":"env","assignments":{}}`,
+		"negative timestamp": `{"environment_id":"env","visitor_id":"vis1","timestamp":-1,"assignments":{}}`,
+		"negative ttl":       `{"environment_id":"env","visitor_id":"vis1","ttl_ms":-1,"assignments":{}}`,
+		"missing assignment": `{"environment_id":"env","visitor_id":"vis1"}`,
+		"empty vg":           `{"environment_id":"env","visitor_id":"vis1","assignments":{"":{"variation_id":"v1"}}}`,
+		"missing variation":  `{"environment_id":"env","visitor_id":"vis1","assignments":{"vg1":{}}}`,
+		"null assignment":    `{"environment_id":"env","visitor_id":"vis1","assignments":{"vg1":null}}`,
+		"negative assigned":  `{"environment_id":"env","visitor_id":"vis1","assignments":{"vg1":{"variation_id":"v1","assigned_at":-1}}}`,
+	}
+	valid := `{"environment_id":"env","visitor_id":"vis1","assignments":{"vg1":{"variation_id":"v1"}}}`
+
+	for name, invalid := range invalidRecords {
+		store := NewMemoryAssignmentStore(0)
+		progress, err := ImportAssignments(ctx, strings.NewReader(valid+"\n"+invalid+"\n"+valid), DecisionHandlers{AssignmentStore: store}, TransferOptions{})
+		assert.ErrorIs(t, err, InvalidRecordError, name)
+		assert.Contains(t, err.Error(), "line 2", name)
+		assert.Equal(t, TransferProgress{Processed: 2, Transferred: 1}, progress, name)
+
+		progress, err = ImportAssignments(ctx, strings.NewReader(valid+"\n"+invalid+"\n"+valid), DecisionHandlers{AssignmentStore: store}, TransferOptions{SkipInvalid: true})
+		assert.Nil(t, err, name)
+		assert.Equal(t, TransferProgress{Processed: 3, Transferred: 2, Skipped: 1}, progress, name)
+	}
+
+	// Save errors stop the import
+	_, err := ImportAssignments(ctx, strings.NewReader(valid), DecisionHandlers{
+		SaveCache: func(ctx context.Context, environmentID string, id string, assignments *VisitorAssignments) error {
+			return errCacheTest
+		},
+	}, TransferOptions{Overwrite: true, SkipInvalid: true})
+	assert.ErrorIs(t, err, errCacheTest)
+
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = ImportAssignments(canceledCtx, strings.NewReader(valid), DecisionHandlers{AssignmentStore: NewMemoryAssignmentStore(0)}, TransferOptions{})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestTransferAssignmentsHistory(t *testing.T) {
+	ctx := context.Background()
+	source := NewMemoryAssignmentStore(0)
+	assert.Nil(t, source.Save(ctx, "env", "vis1", &VisitorAssignments{
+		Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v1"}},
+		History:     map[string][]AssignmentHistoryEntry{"vg1": {{VariationID: "v2", FirstSeen: 1, LastSeen: 2}, {VariationID: "v1", FirstSeen: 3, LastSeen: 3}}},
+	}))
+
+	var buf bytes.Buffer
+	_, err := ExportAssignments(ctx, &buf, DecisionHandlers{AssignmentStore: source}, "env", []string{"vis1"}, TransferOptions{})
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"environment_id":"env","visitor_id":"vis1","timestamp":0,"assignments":{"vg1":{"variation_id":"v1"}},"history":{"vg1":[{"variation_id":"v2","first_seen":1,"last_seen":2},{"variation_id":"v1","first_seen":3,"last_seen":3}]}}`, buf.String())
+
+	destination := NewMemoryAssignmentStore(0)
+	_, err = ImportAssignments(ctx, &buf, DecisionHandlers{AssignmentStore: destination}, TransferOptions{})
+	assert.Nil(t, err)
+	a, _ := destination.Get(ctx, "env", "vis1")
+	assert.Equal(t, []AssignmentHistoryEntry{{VariationID: "v2", FirstSeen: 1, LastSeen: 2}, {VariationID: "v1", FirstSeen: 3, LastSeen: 3}}, a.History["vg1"])
+
+	_, err = ImportAssignments(ctx, strings.NewReader(`{"environment_id":"env","visitor_id":"vis1","assignments":{},"history":{"vg1":[{"variation_id":"v1","first_seen":2,"last_seen":1}]}}`), DecisionHandlers{AssignmentStore: destination}, TransferOptions{})
+	assert.ErrorIs(t, err, InvalidRecordError)
+}
+
+func TestExportImportAssignments(t *testing.T) {
+	ctx := context.Background()
+	source := NewMemoryAssignmentStore(0)
+	ids := []string{}
+	for i := 0; i < 100; i++ {
+		id := "vis" + strings.Repeat("x", i)
+		ids = append(ids, id)
+		assert.Nil(t, source.Save(ctx, "env", id, &VisitorAssignments{Timestamp: int64(i), Assignments: map[string]*VisitorCache{"vg1": {VariationID: id}}}))
+	}
+
+	// Assignments are streamed from a store to another one
+	var buf bytes.Buffer
+	_, err := ExportAssignments(ctx, &buf, DecisionHandlers{AssignmentStore: source}, "env", ids, TransferOptions{})
+	assert.Nil(t, err)
+	destination, _ := NewFileAssignmentStore(t.TempDir(), FileStoreOptions{})
+	progress, err := ImportAssignments(ctx, &buf, DecisionHandlers{AssignmentStore: destination}, TransferOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 100, progress.Transferred)
+
+	for i, id := range ids {
+		a, _ := destination.Get(ctx, "env", id)
+		assert.Equal(t, int64(i), a.Timestamp)
+		assert.Equal(t, id, a.Assignments["vg1"].VariationID)
+	}
+}
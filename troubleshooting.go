@@ -0,0 +1,116 @@
+package decision
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	troubleshootingProto "github.com/flagship-io/flagship-proto/troubleshooting"
+)
+
+// troubleshootingHashSalt salts the visitor hash so that the troubleshooting traffic is independent of the campaign buckets
+const troubleshootingHashSalt = "troubleshooting"
+
+// TroubleshootingEvent stores the details of a decision made during a troubleshooting session
+type TroubleshootingEvent struct {
+	EnvironmentID string
+	VisitorID     string
+	AnonymousID   string
+	Timestamp     time.Time
+	// Campaigns stores the targeting, allocation hash and variation source of each evaluated campaign
+	Campaigns             []*CampaignExplanation
+	StandardCacheHit      bool
+	AnonymousCacheHit     bool
+	DecisionGroupCacheHit bool
+	TargetingDuration     time.Duration
+	CacheDuration         time.Duration
+	DecisionDuration      time.Duration
+	// Err is the error that stopped the decision, or the cache error if the cache failure policy returned an empty decision
+	Err error
+}
+
+// complete fills the troubleshooting event with the details of the decision
+func (e *TroubleshootingEvent) complete(
+	explanation *DecisionExplanation,
+	allCacheAssignments *allVisitorAssignments,
+	targetingDuration time.Duration,
+	startTime time.Time,
+	err error,
+) {
+	if explanation != nil {
+		e.Campaigns = explanation.Campaigns
+	}
+	if allCacheAssignments != nil {
+		e.StandardCacheHit = allCacheAssignments.Standard != nil
+		e.AnonymousCacheHit = allCacheAssignments.Anonymous != nil
+		e.DecisionGroupCacheHit = allCacheAssignments.DecisionGroup != nil
+	}
+	e.TargetingDuration = targetingDuration
+	e.DecisionDuration = time.Since(startTime)
+	e.Err = err
+}
+
+// isTroubleshootingActive returns true if the troubleshooting window is open and the visitor falls into its traffic
+func isTroubleshootingActive(troubleshooting *troubleshootingProto.Troubleshooting, visitorID string, now time.Time) bool {
+	if troubleshooting == nil || troubleshooting.GetStartDate() == nil || troubleshooting.GetEndDate() == nil {
+		return false
+	}
+
+	if now.Before(troubleshooting.GetStartDate().AsTime()) || now.After(troubleshooting.GetEndDate().AsTime()) {
+		return false
+	}
+
+	z, err := genHashFloat(visitorID, troubleshootingHashSalt)
+	if err != nil {
+		logger.Logf(WarnLevel, "error on troubleshooting traffic allocation: %v", err)
+		return false
+	}
+	return z < float32(troubleshooting.GetTraffic())
+}
+
+// sendTroubleshooting sends the troubleshooting event in a new goroutine
+func sendTroubleshooting(
+	ctx context.Context,
+	wg *sync.WaitGroup,
+	sendHandler func(ctx context.Context, event *TroubleshootingEvent) error,
+	event *TroubleshootingEvent,
+) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		logger.Logf(InfoLevel, "sending troubleshooting event for visitor ID %s", event.VisitorID)
+		err := sendHandler(ctx, event)
+		if err != nil {
+			logger.Logf(ErrorLevel, "error occured on troubleshooting sending: %v", err)
+		}
+	}()
+}
+
+// completeBatch fills the troubleshooting event of a visitor of a batch decision, if it is in the troubleshooting session.
+// The cache duration is the one of the batch cache loading
+func (e *TroubleshootingEvent) completeBatch(
+	explanation *DecisionExplanation,
+	allCacheAssignments *allVisitorAssignments,
+	targetingDuration time.Duration,
+	cacheDuration time.Duration,
+	startTime time.Time,
+	err error,
+) {
+	if e == nil {
+		return
+	}
+	e.CacheDuration = cacheDuration
+	e.complete(explanation, allCacheAssignments, targetingDuration, startTime, err)
+}
+
+// sendStoppedTroubleshooting sends the troubleshooting event of a decision stopped by an error,
+// waiting for it like for the other side effects
+func sendStoppedTroubleshooting(
+	ctx context.Context,
+	sendHandler func(ctx context.Context, event *TroubleshootingEvent) error,
+	event *TroubleshootingEvent,
+) {
+	var wg sync.WaitGroup
+	sendTroubleshooting(context.WithoutCancel(ctx), &wg, sendHandler, event)
+	waitSideEffects(ctx, &wg)
+}
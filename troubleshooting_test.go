@@ -0,0 +1,178 @@
+package decision
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/flagship-io/flagship-common/targeting"
+	troubleshootingProto "github.com/flagship-io/flagship-proto/troubleshooting"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func createTroubleshooting(start time.Time, end time.Time, traffic int32) *troubleshootingProto.Troubleshooting {
+	return &troubleshootingProto.Troubleshooting{
+		StartDate: timestamppb.New(start),
+		EndDate:   timestamppb.New(end),
+		Traffic:   traffic,
+	}
+}
+
+func TestIsTroubleshootingActive(t *testing.T) {
+	now := time.Now()
+
+	assert.False(t, isTroubleshootingActive(nil, "vid", now))
+	assert.False(t, isTroubleshootingActive(&troubleshootingProto.Troubleshooting{Traffic: 100}, "vid", now))
+	assert.True(t, isTroubleshootingActive(createTroubleshooting(now.Add(-time.Hour), now.Add(time.Hour), 100), "vid", now))
+	assert.False(t, isTroubleshootingActive(createTroubleshooting(now.Add(time.Minute), now.Add(time.Hour), 100), "vid", now))
+	assert.False(t, isTroubleshootingActive(createTroubleshooting(now.Add(-time.Hour), now.Add(-time.Minute), 100), "vid", now))
+	assert.False(t, isTroubleshootingActive(createTroubleshooting(now.Add(-time.Hour), now.Add(time.Hour), 0), "vid", now))
+
+	// The traffic share should be respected
+	troubleshooting := createTroubleshooting(now.Add(-time.Hour), now.Add(time.Hour), 30)
+	nbActive := 0
+	for i := 0; i < 10000; i++ {
+		if isTroubleshootingActive(troubleshooting, time.Duration(i).String(), now) {
+			nbActive++
+		}
+	}
+	assert.InDelta(t, 3000, nbActive, 300)
+}
+
+func TestDecisionTroubleshooting(t *testing.T) {
+	now := time.Now()
+	vi := Visitor{
+		ID: "v1",
+		Context: &targeting.Context{
+			Standard: targeting.ContextMap{
+				"isVIP": structpb.NewBoolValue(true),
+			},
+		},
+	}
+
+	ei := Environment{
+		ID:              "e123",
+		CacheEnabled:    true,
+		Troubleshooting: createTroubleshooting(now.Add(-time.Hour), now.Add(time.Hour), 100),
+		Campaigns:       createExplanationCampaigns()[:3],
+	}
+
+	events := make(chan *TroubleshootingEvent, 1)
+	handlers := DecisionHandlers{
+		GetCache: func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+			return &VisitorAssignments{
+				Assignments: map[string]*VisitorCache{
+					"vg_ab": {VariationID: "v2"},
+				},
+			}, nil
+		},
+		SendTroubleshooting: func(ctx context.Context, event *TroubleshootingEvent) error {
+			events <- event
+			return nil
+		},
+	}
+
+	decision, err := GetDecision(vi, ei, DecisionOptions{}, handlers)
+	assert.Nil(t, err)
+	assert.Len(t, decision.Campaigns, 1)
+
+	event := <-events
+	assert.Equal(t, "e123", event.EnvironmentID)
+	assert.Equal(t, "v1", event.VisitorID)
+	assert.True(t, event.StandardCacheHit)
+	assert.False(t, event.AnonymousCacheHit)
+	assert.False(t, event.DecisionGroupCacheHit)
+	assert.True(t, event.DecisionDuration >= event.TargetingDuration)
+	assert.Len(t, event.Campaigns, 3)
+	assert.Equal(t, SkipReasonNoTargetingMatch, event.Campaigns[0].SkipReason)
+	assert.Equal(t, SkipReasonBucketMiss, event.Campaigns[1].SkipReason)
+	assert.Equal(t, VariationSourceCache, event.Campaigns[2].Source)
+	assert.True(t, event.Campaigns[2].HasHash)
+
+	// No event should be sent outside of the troubleshooting window
+	ei.Troubleshooting = createTroubleshooting(now.Add(-2*time.Hour), now.Add(-time.Hour), 100)
+	_, err = GetDecision(vi, ei, DecisionOptions{}, handlers)
+	assert.Nil(t, err)
+	assert.Len(t, events, 0)
+}
+
+func TestDecisionTroubleshootingCacheError(t *testing.T) {
+	now := time.Now()
+	ei := createBatchEnvironment()
+	ei.CacheEnabled = true
+	ei.Troubleshooting = createTroubleshooting(now.Add(-time.Hour), now.Add(time.Hour), 100)
+
+	cacheErr := errors.New("cache error")
+	events := make(chan *TroubleshootingEvent, 1)
+	handlers := DecisionHandlers{
+		GetCache: func(ctx context.Context, environmentID string, id string) (*VisitorAssignments, error) {
+			return nil, cacheErr
+		},
+		SendTroubleshooting: func(ctx context.Context, event *TroubleshootingEvent) error {
+			events <- event
+			return nil
+		},
+	}
+
+	// The decision stopped by the cache failure policy is traced with the cache error
+	decision, err := GetDecision(createBatchVisitor("vis1", true), ei, DecisionOptions{}, handlers)
+	assert.Nil(t, err)
+	assert.Len(t, decision.Campaigns, 0)
+	event := <-events
+	assert.Equal(t, "vis1", event.VisitorID)
+	assert.ErrorIs(t, event.Err, cacheErr)
+	assert.False(t, event.StandardCacheHit)
+}
+
+func TestBatchDecisionTroubleshooting(t *testing.T) {
+	now := time.Now()
+	ei := createBatchEnvironment()
+	ei.CacheEnabled = true
+	ei.Troubleshooting = createTroubleshooting(now.Add(-time.Hour), now.Add(time.Hour), 100)
+
+	events := make(chan *TroubleshootingEvent, 2)
+	cacheErr := errors.New("cache error")
+	var getErr error
+	handlers := BatchDecisionHandlers{
+		BatchGetCache: func(ctx context.Context, environmentID string, ids []string) (map[string]*VisitorAssignments, error) {
+			if getErr != nil {
+				return nil, getErr
+			}
+			return map[string]*VisitorAssignments{
+				"vis1": {Assignments: map[string]*VisitorCache{"vg1": {VariationID: "v2"}}},
+			}, nil
+		},
+		SendTroubleshooting: func(ctx context.Context, event *TroubleshootingEvent) error {
+			events <- event
+			return nil
+		},
+	}
+
+	// Each visitor of the batch gets its own event
+	visitors := []Visitor{createBatchVisitor("vis1", true), createBatchVisitor("vis2", true)}
+	decisions, err := GetDecisions(visitors, ei, DecisionOptions{}, handlers)
+	assert.Nil(t, err)
+	assert.Len(t, decisions, 2)
+	assert.Nil(t, decisions[0].Explanation)
+	received := map[string]*TroubleshootingEvent{}
+	for i := 0; i < 2; i++ {
+		event := <-events
+		received[event.VisitorID] = event
+	}
+	assert.True(t, received["vis1"].StandardCacheHit)
+	assert.Equal(t, VariationSourceCache, received["vis1"].Campaigns[0].Source)
+	assert.False(t, received["vis2"].StandardCacheHit)
+	assert.Equal(t, VariationSourceAllocation, received["vis2"].Campaigns[0].Source)
+	assert.Nil(t, received["vis2"].Err)
+
+	// Decisions stopped by the cache failure policy are traced with the cache error
+	getErr = cacheErr
+	_, err = GetDecisions(visitors[:1], ei, DecisionOptions{}, handlers)
+	assert.Nil(t, err)
+	event := <-events
+	assert.Equal(t, "vis1", event.VisitorID)
+	assert.ErrorIs(t, event.Err, cacheErr)
+}